@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -11,13 +13,18 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/crohr/smart-git-proxy/internal/clientauth"
 	"github.com/crohr/smart-git-proxy/internal/cloudmap"
 	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/credhelper"
+	"github.com/crohr/smart-git-proxy/internal/githubapp"
 	"github.com/crohr/smart-git-proxy/internal/gitproxy"
 	"github.com/crohr/smart-git-proxy/internal/logging"
 	"github.com/crohr/smart-git-proxy/internal/metrics"
 	"github.com/crohr/smart-git-proxy/internal/mirror"
+	"github.com/crohr/smart-git-proxy/internal/policy"
 	"github.com/crohr/smart-git-proxy/internal/route53"
+	"github.com/crohr/smart-git-proxy/internal/tlsconfig"
 )
 
 func main() {
@@ -37,6 +44,10 @@ func main() {
 		os.Exit(1)
 	}
 
+	mirrorStore.SetBundleInterval(cfg.BundleInterval)
+	mirrorStore.SetAuthCache(cfg.AuthCacheAllowTTL, cfg.AuthCacheDenyTTL)
+	mirrorStore.SetUpstreamCAs(cfg.UpstreamCAURLs())
+
 	// One-shot maintenance mode: run and exit
 	if cfg.MaintenanceRepo != "" {
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
@@ -58,8 +69,85 @@ func main() {
 		return
 	}
 
+	// One-shot client token minting: print and exit
+	if cfg.MintClientToken != "" {
+		token, err := clientauth.NewHMAC([]byte(cfg.ClientTokenSecret), cfg.ClientTokenTTL).Mint(cfg.MintClientToken, cfg.ClientTokenTTL, nil)
+		if err != nil {
+			log.Fatalf("mint client token: %v", err)
+		}
+		fmt.Println(token)
+		return
+	}
+
 	metricsRegistry := metrics.New()
 	server := gitproxy.New(cfg, mirrorStore, logger, metricsRegistry)
+	if len(cfg.UpstreamCAFiles) > 0 {
+		tr, err := tlsconfig.UpstreamTransport(cfg.UpstreamCAURLs())
+		if err != nil {
+			logger.Error("upstream CA init failed", "err", err)
+			os.Exit(1)
+		}
+		server.SetUpstreamTransport(tr)
+		mirrorStore.SetUpstreamTransport(tr)
+	}
+	if cfg.ConnectCACertFile != "" {
+		minter, err := tlsconfig.NewMinter(cfg.ConnectCACertFile, cfg.ConnectCAKeyFile)
+		if err != nil {
+			logger.Error("connect CA init failed", "err", err)
+			os.Exit(1)
+		}
+		server.SetConnectCA(minter)
+	}
+	if cfg.AuthMode == "github-app" {
+		app, err := githubapp.New(cfg.GitHubAppID, cfg.GitHubAppKeyFile, cfg.GitHubAPIURL, cfg.GitHubAppInstalls, logger)
+		if err != nil {
+			logger.Error("github app init failed", "err", err)
+			os.Exit(1)
+		}
+		server.SetGitHubApp(app)
+	}
+	if cfg.AuthMode == "credential-helper" {
+		helper := credhelper.New(cfg.CredentialHelper, cfg.CredentialHelperTTL, logger)
+		server.SetCredentialHelper(helper)
+		mirrorStore.SetCredentialHook(helper.Report)
+	}
+	if cfg.ClientAuthEnabled() {
+		var chain clientauth.Chain
+		if cfg.ClientAPIKeysFile != "" {
+			keys, err := clientauth.LoadAPIKeys(cfg.ClientAPIKeysFile)
+			if err != nil {
+				logger.Error("client api keys init failed", "err", err)
+				os.Exit(1)
+			}
+			chain = append(chain, keys)
+		}
+		if cfg.ClientTokenSecret != "" {
+			chain = append(chain, clientauth.NewHMAC([]byte(cfg.ClientTokenSecret), cfg.ClientTokenTTL))
+		}
+		if cfg.ClientOIDCJWKS != "" {
+			oidc, err := clientauth.NewOIDC(cfg.ClientOIDCJWKS, cfg.ClientOIDCIssuer, cfg.ClientOIDCAudience)
+			if err != nil {
+				logger.Error("client oidc init failed", "err", err)
+				os.Exit(1)
+			}
+			chain = append(chain, oidc)
+		}
+		server.SetClientAuth(chain)
+	}
+	if cfg.PolicyFile != "" {
+		p, err := policy.Load(cfg.PolicyFile, logger)
+		if err != nil {
+			logger.Error("policy init failed", "err", err)
+			os.Exit(1)
+		}
+		server.SetPolicy(p)
+	}
+	if cfg.SubmoduleDepth > 0 {
+		mirrorStore.SetSyncHook(server.PrefetchSubmodules)
+	}
+	bundleCtx, stopBundles := context.WithCancel(context.Background())
+	defer stopBundles()
+	mirrorStore.StartBundleRefresh(bundleCtx)
 
 	mux := http.NewServeMux()
 	mux.Handle(cfg.HealthPath, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
@@ -71,18 +159,65 @@ func main() {
 
 	httpServer := &http.Server{
 		Addr:              cfg.ListenAddr,
-		Handler:           mux,
+		Handler:           server.WithConnect(mux),
 		ReadHeaderTimeout: 15 * time.Second,
 	}
 
+	if cfg.TLSCertFile != "" {
+		httpServer.TLSConfig, err = tlsconfig.New(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSClientCAFile, logger)
+		if err != nil {
+			logger.Error("tls init failed", "err", err)
+			os.Exit(1)
+		}
+	}
+
 	go func() {
-		logger.Info("listening", "addr", cfg.ListenAddr, "mirror_dir", cfg.MirrorDir, "allowed_upstreams", cfg.AllowedUpstreams, "sync_stale_after", cfg.SyncStaleAfter)
-		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Info("listening", "addr", cfg.ListenAddr, "mirror_dir", cfg.MirrorDir, "allowed_upstreams", cfg.AllowedUpstreams, "sync_stale_after", cfg.SyncStaleAfter, "tls", httpServer.TLSConfig != nil, "mtls", cfg.TLSClientCAFile != "")
+		var err error
+		if httpServer.TLSConfig != nil {
+			// Certificates come from TLSConfig.GetCertificate
+			err = httpServer.ListenAndServeTLS("", "")
+		} else {
+			err = httpServer.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			logger.Error("http server failed", "err", err)
 			os.Exit(1)
 		}
 	}()
 
+	var sshListener net.Listener
+	if cfg.SSHListenAddr != "" {
+		sshListener, err = net.Listen("tcp", cfg.SSHListenAddr)
+		if err != nil {
+			logger.Error("ssh listen failed", "addr", cfg.SSHListenAddr, "err", err)
+			os.Exit(1)
+		}
+		go func() {
+			logger.Info("ssh listening", "addr", cfg.SSHListenAddr)
+			if err := server.ServeSSH(sshListener); err != nil {
+				logger.Error("ssh server failed", "err", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	var daemonListener net.Listener
+	if cfg.GitDaemonListenAddr != "" {
+		daemonListener, err = net.Listen("tcp", cfg.GitDaemonListenAddr)
+		if err != nil {
+			logger.Error("git daemon listen failed", "addr", cfg.GitDaemonListenAddr, "err", err)
+			os.Exit(1)
+		}
+		go func() {
+			logger.Info("git daemon listening", "addr", cfg.GitDaemonListenAddr)
+			if err := server.ServeGitDaemon(daemonListener); err != nil {
+				logger.Error("git daemon failed", "err", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
 	// DNS registration (Route53 preferred, Cloud Map deprecated)
 	var cloudMapMgr *cloudmap.Manager
 	var route53Mgr *route53.Manager
@@ -118,6 +253,7 @@ func main() {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
+	stopBundles()
 
 	// Deregister before shutting down HTTP server
 	if route53Mgr != nil {
@@ -127,6 +263,12 @@ func main() {
 		cloudMapMgr.Stop(ctx)
 	}
 
+	if sshListener != nil {
+		_ = sshListener.Close()
+	}
+	if daemonListener != nil {
+		_ = daemonListener.Close()
+	}
 	if err := httpServer.Shutdown(ctx); err != nil {
 		logger.Error("graceful shutdown failed", "err", err)
 	}
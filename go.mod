@@ -12,6 +12,8 @@ require (
 	github.com/aws/aws-sdk-go-v2/service/servicediscovery v1.39.19
 	github.com/aws/aws-sdk-go-v2/service/ssm v1.58.1
 	github.com/prometheus/client_golang v1.23.2
+	golang.org/x/crypto v0.45.0
+	golang.org/x/mod v0.30.0
 	golang.org/x/sync v0.18.0
 )
 
@@ -0,0 +1,98 @@
+// Package clientauth authenticates clients of the proxy itself, as opposed to
+// the upstream credentials they may send along for the git host. Clients
+// present a token in the Proxy-Authorization header, checked by API keys,
+// HMAC-signed tokens or OIDC JWTs such as GitHub Actions ID tokens.
+package clientauth
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrNoCredentials is returned when a request carries no proxy credential.
+var ErrNoCredentials = errors.New("no proxy credentials")
+
+// errNotMine is returned by an Authenticator for tokens of another kind, so
+// a Chain moves on to the next one.
+var errNotMine = errors.New("token not recognized")
+
+// Identity is an authenticated client.
+type Identity struct {
+	Method  string         // Authenticator that accepted the client: api-key, hmac or oidc
+	Subject string         // Key name, or the sub claim of a token
+	Claims  map[string]any // Token claims, nil for API keys
+}
+
+// Claim returns the string value of claim name, or "" if it is missing or
+// not a string.
+func (id *Identity) Claim(name string) string {
+	s, _ := id.Claims[name].(string)
+	return s
+}
+
+// Authenticator checks a proxy token.
+type Authenticator interface {
+	Authenticate(ctx context.Context, token string) (*Identity, error)
+}
+
+// Chain tries each Authenticator in turn, so API keys, HMAC tokens and OIDC
+// tokens can be accepted side by side.
+type Chain []Authenticator
+
+// Authenticate returns the identity from the first authenticator accepting
+// token, or the error of the one that recognized but rejected it.
+func (c Chain) Authenticate(ctx context.Context, token string) (*Identity, error) {
+	err := errNotMine
+	for _, a := range c {
+		id, aerr := a.Authenticate(ctx, token)
+		if aerr == nil {
+			return id, nil
+		}
+		if !errors.Is(aerr, errNotMine) {
+			err = aerr
+		}
+	}
+	if errors.Is(err, errNotMine) {
+		return nil, errors.New("invalid proxy credentials")
+	}
+	return nil, err
+}
+
+// Token returns the proxy token of r, from a Bearer or Basic (the password)
+// Proxy-Authorization header.
+func Token(r *http.Request) (string, error) {
+	header := r.Header.Get("Proxy-Authorization")
+	if header == "" {
+		return "", ErrNoCredentials
+	}
+	scheme, value, _ := strings.Cut(header, " ")
+	switch strings.ToLower(scheme) {
+	case "bearer":
+		return strings.TrimSpace(value), nil
+	case "basic":
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return "", fmt.Errorf("invalid basic proxy credentials: %w", err)
+		}
+		_, password, _ := strings.Cut(string(decoded), ":")
+		return password, nil
+	}
+	return "", fmt.Errorf("unsupported proxy authorization scheme %q", scheme)
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a copy of ctx carrying id.
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext returns the identity stored in ctx by WithIdentity.
+func FromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(*Identity)
+	return id, ok
+}
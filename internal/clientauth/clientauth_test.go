@@ -0,0 +1,178 @@
+package clientauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestToken(t *testing.T) {
+	for header, want := range map[string]string{
+		"Bearer abc": "abc",
+		"Basic " + base64.StdEncoding.EncodeToString([]byte("ci:abc")): "abc",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Proxy-Authorization", header)
+		if got, err := Token(r); err != nil || got != want {
+			t.Errorf("%s: got %q (%v), want %q", header, got, err, want)
+		}
+	}
+	if _, err := Token(httptest.NewRequest(http.MethodGet, "/", nil)); err != ErrNoCredentials {
+		t.Fatalf("expected ErrNoCredentials, got %v", err)
+	}
+}
+
+func TestChain(t *testing.T) {
+	keysFile := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(keysFile, []byte("# CI runners\nrunners k3y\n\nlaptop other-key\n"), 0o600); err != nil {
+		t.Fatalf("write keys: %v", err)
+	}
+	keys, err := LoadAPIKeys(keysFile)
+	if err != nil {
+		t.Fatalf("load keys: %v", err)
+	}
+	signer := NewHMAC([]byte("s3cret"), time.Hour)
+	chain := Chain{keys, signer}
+	ctx := context.Background()
+
+	if id, err := chain.Authenticate(ctx, "k3y"); err != nil || id.Method != "api-key" || id.Subject != "runners" {
+		t.Fatalf("unexpected api key identity %+v (%v)", id, err)
+	}
+	token, err := signer.Mint("deploy", time.Minute, map[string]any{"repository_owner": "acme"})
+	if err != nil {
+		t.Fatalf("mint: %v", err)
+	}
+	id, err := chain.Authenticate(ctx, token)
+	if err != nil || id.Method != "hmac" || id.Subject != "deploy" || id.Claim("repository_owner") != "acme" {
+		t.Fatalf("unexpected hmac identity %+v (%v)", id, err)
+	}
+
+	for name, bad := range map[string]string{
+		"unknown key":  "nope",
+		"tampered":     token[:len(token)-2] + "xx",
+		"other secret": mustMint(t, NewHMAC([]byte("other"), time.Hour), time.Minute),
+		"expired":      mustMint(t, signer, -time.Minute),
+		"too long":     mustMint(t, signer, 2*time.Hour),
+	} {
+		if _, err := chain.Authenticate(ctx, bad); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func mustMint(t *testing.T, h *HMAC, ttl time.Duration) string {
+	t.Helper()
+	token, err := h.Mint("x", ttl, nil)
+	if err != nil {
+		t.Fatalf("mint: %v", err)
+	}
+	return token
+}
+
+// signJWT returns an RS256 JWT with claims, signed by key under kid.
+func signJWT(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func jwks(kid string, key *rsa.PrivateKey) []byte {
+	data, _ := json.Marshal(map[string]any{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": kid,
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}})
+	return data
+}
+
+func TestOIDC(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	const issuer = "https://token.actions.githubusercontent.com"
+	now := time.Now().Unix()
+	claims := func(overrides map[string]any) map[string]any {
+		c := map[string]any{"iss": issuer, "aud": "smart-git-proxy", "sub": "repo:acme/app:ref:refs/heads/main", "repository_owner": "acme", "iat": now, "nbf": now, "exp": now + 300}
+		for k, v := range overrides {
+			c[k] = v
+		}
+		return c
+	}
+
+	// Keys served over HTTP and rotated: an unknown kid triggers a refetch
+	var fetches atomic.Int32
+	current := jwks("k1", key)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Write(current)
+	}))
+	defer ts.Close()
+	o, err := NewOIDC(ts.URL, issuer, "smart-git-proxy")
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	ctx := context.Background()
+	id, err := o.Authenticate(ctx, signJWT(t, key, "k1", claims(nil)))
+	if err != nil || id.Method != "oidc" || id.Claim("repository_owner") != "acme" || !strings.HasPrefix(id.Subject, "repo:acme/app") {
+		t.Fatalf("unexpected identity %+v (%v)", id, err)
+	}
+	current = jwks("k2", key)
+	o.fetchedAt = time.Now().Add(-2 * jwksMinInterval)
+	if _, err := o.Authenticate(ctx, signJWT(t, key, "k2", claims(nil))); err != nil || fetches.Load() != 2 {
+		t.Fatalf("expected rotated key to be fetched, got %v after %d fetches", err, fetches.Load())
+	}
+
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	for name, token := range map[string]string{
+		"wrong key":      signJWT(t, other, "k2", claims(nil)),
+		"wrong issuer":   signJWT(t, key, "k2", claims(map[string]any{"iss": "https://evil.example.com"})),
+		"wrong audience": signJWT(t, key, "k2", claims(map[string]any{"aud": []string{"https://github.com/acme"}})),
+		"expired":        signJWT(t, key, "k2", claims(map[string]any{"exp": now - 600})),
+		"not yet valid":  signJWT(t, key, "k2", claims(map[string]any{"nbf": now + 600})),
+	} {
+		if _, err := o.Authenticate(ctx, token); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := o.Authenticate(ctx, "not-a-jwt"); err != errNotMine {
+		t.Fatalf("expected errNotMine for opaque tokens, got %v", err)
+	}
+
+	// Keys from a file, audience in an array
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(file, jwks("k1", key), 0o600); err != nil {
+		t.Fatalf("write jwks: %v", err)
+	}
+	fromFile, err := NewOIDC(file, issuer, "smart-git-proxy")
+	if err != nil {
+		t.Fatalf("new from file: %v", err)
+	}
+	if _, err := fromFile.Authenticate(ctx, signJWT(t, key, "k1", claims(map[string]any{"aud": []string{"other", "smart-git-proxy"}}))); err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	if _, err := NewOIDC(filepath.Join(t.TempDir(), "missing.json"), issuer, "smart-git-proxy"); err == nil {
+		t.Fatalf("expected an error for a missing jwks file")
+	}
+}
@@ -0,0 +1,208 @@
+package clientauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksMaxAge is how long fetched signing keys are used before refetching.
+	jwksMaxAge = time.Hour
+	// jwksMinInterval rate-limits refetches for tokens signed by unknown keys.
+	jwksMinInterval = time.Minute
+)
+
+// OIDC accepts RS256 JWTs from an OpenID Connect issuer, e.g. GitHub Actions
+// ID tokens (https://token.actions.githubusercontent.com), verified against
+// the issuer's JWKS.
+type OIDC struct {
+	jwks     string // JWKS URL, or file path
+	issuer   string
+	audience string
+	http     *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey // by kid
+	fetchedAt time.Time
+}
+
+// NewOIDC returns an authenticator for tokens issued by issuer for audience,
+// signed by keys from jwks, an http(s) URL or a file. Files are read right
+// away so a bad path fails at startup; URLs are fetched on first use.
+func NewOIDC(jwks, issuer, audience string) (*OIDC, error) {
+	o := &OIDC{
+		jwks:     jwks,
+		issuer:   issuer,
+		audience: audience,
+		http:     &http.Client{Timeout: 10 * time.Second},
+	}
+	if !o.remote() {
+		if err := o.refreshLocked(context.Background()); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+func (o *OIDC) remote() bool {
+	return strings.HasPrefix(o.jwks, "https://") || strings.HasPrefix(o.jwks, "http://")
+}
+
+// Authenticate verifies the signature, issuer, audience and validity dates
+// of a JWT.
+func (o *OIDC) Authenticate(ctx context.Context, token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errNotMine
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(rawHeader, &header) != nil {
+		return nil, errNotMine
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("oidc token: unsupported alg %q", header.Alg)
+	}
+	key, err := o.key(ctx, header.Kid)
+	if err != nil {
+		return nil, fmt.Errorf("oidc token: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("oidc token: invalid signature")
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return nil, errors.New("oidc token: invalid signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("oidc token: %w", err)
+	}
+	claims, err := decodeClaims(payload)
+	if err != nil {
+		return nil, fmt.Errorf("oidc token: %w", err)
+	}
+	now := time.Now()
+	skew := int64(clockSkew / time.Second)
+	switch iss, _ := claims["iss"].(string); {
+	case iss != o.issuer:
+		return nil, fmt.Errorf("oidc token: unexpected issuer %q", iss)
+	case !o.audienceMatches(claims["aud"]):
+		return nil, errors.New("oidc token: unexpected audience")
+	case numericClaim(claims, "exp") < now.Unix()-skew:
+		return nil, errors.New("oidc token: expired")
+	case numericClaim(claims, "nbf") > now.Unix()+skew:
+		return nil, errors.New("oidc token: not valid yet")
+	}
+	sub, _ := claims["sub"].(string)
+	return &Identity{Method: "oidc", Subject: sub, Claims: claims}, nil
+}
+
+// audienceMatches reports whether the aud claim, a string or an array of
+// strings, contains the expected audience.
+func (o *OIDC) audienceMatches(aud any) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == o.audience
+	case []any:
+		return slices.Contains(v, any(o.audience))
+	}
+	return false
+}
+
+// key returns the signing key kid, refetching the JWKS when it is old or
+// doesn't know kid, which happens after the issuer rotates its keys.
+func (o *OIDC) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	key, ok := o.keys[kid]
+	age := time.Since(o.fetchedAt)
+	if age > jwksMaxAge || (!ok && age > jwksMinInterval) {
+		if err := o.refreshLocked(ctx); err != nil {
+			if ok {
+				// Keep using known keys while the issuer is unreachable
+				return key, nil
+			}
+			return nil, err
+		}
+		key, ok = o.keys[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+func (o *OIDC) refreshLocked(ctx context.Context) error {
+	data, err := o.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("parse jwks %s: %w", o.jwks, err)
+	}
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, nerr := base64.RawURLEncoding.DecodeString(k.N)
+		e, eerr := base64.RawURLEncoding.DecodeString(k.E)
+		if nerr != nil || eerr != nil || len(e) == 0 || len(e) > 4 {
+			return fmt.Errorf("parse jwks %s: invalid key %q", o.jwks, k.Kid)
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	o.keys, o.fetchedAt = keys, time.Now()
+	return nil
+}
+
+func (o *OIDC) fetch(ctx context.Context) ([]byte, error) {
+	if !o.remote() {
+		data, err := os.ReadFile(o.jwks)
+		if err != nil {
+			return nil, fmt.Errorf("read jwks: %w", err)
+		}
+		return data, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.jwks, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := o.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch jwks: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch jwks %s: %s", o.jwks, res.Status)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, 1<<20))
+}
@@ -5,7 +5,9 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -16,17 +18,65 @@ type Config struct {
 	MirrorDir            string
 	MirrorMaxSize        SizeSpec // Max size (absolute or %), zero means default 80%
 	SyncStaleAfter       time.Duration
+	AuthCacheAllowTTL    time.Duration // How long upstream granting a token access to a private repo is remembered
+	AuthCacheDenyTTL     time.Duration // How long upstream refusing a token access to a private repo is remembered
 	AllowedUpstreams     []string
+	UpstreamTemplates    map[string]string // Upstream URL template per host, e.g. https://ghe.example.com/git/{owner}/{repo}.git
+	UpstreamCAFiles      map[string]string // CA bundle per host to verify its upstream certificate
+	RouteAliases         map[string]string // First path segment aliases, e.g. gh -> github.com
+	DefaultUpstreamHost  string            // Host for paths that don't start with an allowed host or alias
 	LogLevel             string
 	AuthMode             string
 	StaticToken          string
+	RequireClientAuth    bool             // Check private mirrors with the client's credential rather than the upstream one
+	CredentialsFile      string           // JSON file of upstream credentials per host or host/owner, for auth-mode=static
+	Credentials          []Credential     // Loaded from CredentialsFile
+	GitHubAppID          int64            // GitHub App used to mint installation tokens with auth-mode=github-app
+	GitHubAppKeyFile     string           // PEM private key of the GitHub App
+	GitHubAppInstalls    map[string]int64 // Installation ID per owner, others are looked up from the API
+	GitHubAPIURL         string           // GitHub REST API root the app tokens are requested from
+	GitHubAppHost        string           // Only upstream host app tokens are sent to, derived from GitHubAPIURL by default
+	CredentialHelper     string           // git credential helper upstream credentials come from with auth-mode=credential-helper
+	CredentialHelperTTL  time.Duration    // How long credentials from the helper are reused before asking again
+	ClientAPIKeysFile    string           // "<name> <key>" lines of keys clients may authenticate to the proxy with
+	ClientTokenSecret    string           // Secret of the HMAC-signed tokens clients may authenticate with
+	ClientTokenTTL       time.Duration    // Lifetime of minted HMAC tokens, and the longest one accepted
+	ClientOIDCJWKS       string           // JWKS URL or file verifying OIDC tokens clients may authenticate with
+	ClientOIDCIssuer     string           // Expected iss of client OIDC tokens
+	ClientOIDCAudience   string           // Expected aud of client OIDC tokens
+	ClientOwnerClaim     string           // If set, token clients only read repos of the owner named by this claim
+	MintClientToken      string           // If set, print an HMAC token for this subject and exit
+	PolicyFile           string           // Ordered allow/deny rules on host/owner/repo, reloaded on change
 	MetricsPath          string
 	HealthPath           string
 	AWSCloudMapServiceID string // If set, register with AWS Cloud Map and send heartbeats
 	Route53HostedZoneID  string // Route53 hosted zone ID for DNS registration
 	Route53RecordName    string // Route53 record name (e.g., git-proxy.example.com)
 	SerializeUploadPack  bool
+	EnablePush           bool // Forward git-receive-pack to upstream with the client's credentials
+	EnableLFS            bool // Proxy the Git LFS batch API and cache downloaded objects
+	EnableArchive        bool // Serve tarballs and zipballs generated from the mirrors
+	EnableRaw            bool // Serve single files from the mirrors under /raw/
+	EnableAPI            bool // Serve the read-only JSON refs and commits API under /api/
+	EnableGoProxy        bool // Serve the GOPROXY protocol under /gomod/ from mirrored module repos
+	EnablePackCache      bool // Reuse upload-pack output across clients sending identical requests
+	CoalesceUploadPack   bool // Share one running upload-pack between identical concurrent requests
+	SyncMissingWants     bool // Sync right away when a client wants objects the mirror doesn't have yet
 	UploadPackThreads    int
+	MissingWantsInterval time.Duration // Minimum time between two SyncMissingWants syncs of a repo
+	SubmoduleDepth       int           // Levels of submodules to mirror in the background after a clone or sync, 0 disables
+	SubmoduleExclude     []string      // Repo patterns (path.Match) whose submodules are never prefetched
+	BundleInterval       time.Duration // If set, generate clone bundles (advertised via bundle-uri) and refresh them at this interval
+	TLSCertFile          string        // If set with TLSKeyFile, serve HTTPS (reloaded on change)
+	TLSKeyFile           string
+	TLSClientCAFile      string // If set, require client certificates signed by these CAs (mTLS)
+	ConnectCACertFile    string // If set with ConnectCAKeyFile, accept CONNECT and intercept TLS to allowed upstreams
+	ConnectCAKeyFile     string
+	ConnectAllowedPorts  []string // Ports CONNECT tunnels not intercepted may reach
+	SSHListenAddr        string   // If set, serve git-upload-pack over SSH on this address
+	SSHHostKeyFile       string   // SSH host private key, generated if missing
+	SSHAuthorizedKeys    string   // authorized_keys file for SSH client authentication
+	GitDaemonListenAddr  string   // If set, serve upload-pack over git:// on this address
 	MaintainAfterSync    bool
 	MaintenanceRepo      string // If set, run maintenance on this repo (or "all") and exit
 }
@@ -44,20 +94,67 @@ func LoadArgs(args []string) (*Config, error) {
 	fs.StringVar(&cfg.ListenAddr, "listen-addr", envOrDefault("LISTEN_ADDR", ":8080"), "HTTP listen address")
 	fs.StringVar(&cfg.MirrorDir, "mirror-dir", envOrDefault("MIRROR_DIR", "/mnt/git-mirrors"), "directory for bare git mirrors")
 	fs.StringVar(&cfg.LogLevel, "log-level", envOrDefault("LOG_LEVEL", "info"), "log level: debug,info,warn,error")
-	fs.StringVar(&cfg.AuthMode, "auth-mode", envOrDefault("AUTH_MODE", "pass-through"), "auth mode: pass-through|static|none (for upstream sync)")
+	fs.StringVar(&cfg.AuthMode, "auth-mode", envOrDefault("AUTH_MODE", "pass-through"), "auth mode: pass-through|static|github-app|credential-helper|none (for upstream sync)")
 	fs.StringVar(&cfg.StaticToken, "static-token", envOrDefault("STATIC_TOKEN", ""), "static token used when auth-mode=static")
+	fs.BoolVar(&cfg.RequireClientAuth, "require-client-auth", envOrDefaultBool("REQUIRE_CLIENT_AUTH", false), "serve private mirrors only to clients whose own credential upstream accepts, with auth-mode=static, github-app or credential-helper")
+	fs.StringVar(&cfg.CredentialsFile, "credentials-file", envOrDefault("CREDENTIALS_FILE", ""), "JSON file mapping host or host/owner patterns to upstream credentials, used when auth-mode=static")
+	fs.StringVar(&cfg.GitHubAppKeyFile, "github-app-private-key-file", envOrDefault("GITHUB_APP_PRIVATE_KEY_FILE", ""), "GitHub App private key (PEM) used when auth-mode=github-app")
+	fs.StringVar(&cfg.GitHubAPIURL, "github-api-url", envOrDefault("GITHUB_API_URL", "https://api.github.com"), "GitHub REST API root to request app installation tokens from")
+	fs.StringVar(&cfg.GitHubAppHost, "github-app-host", envOrDefault("GITHUB_APP_HOST", ""), "only upstream host GitHub App tokens are sent to (defaults to the host of github-api-url, without api.)")
+	fs.StringVar(&cfg.CredentialHelper, "credential-helper", envOrDefault("CREDENTIAL_HELPER", ""), "git credential helper (e.g. vault, /usr/local/bin/creds or !cmd) run for upstream credentials when auth-mode=credential-helper")
+	fs.StringVar(&cfg.ClientAPIKeysFile, "client-api-keys-file", envOrDefault("CLIENT_API_KEYS_FILE", ""), "file of \"<name> <key>\" lines, keys clients may send in Proxy-Authorization")
+	fs.StringVar(&cfg.ClientTokenSecret, "client-token-secret", envOrDefault("CLIENT_TOKEN_SECRET", ""), "secret of HMAC-signed tokens clients may send in Proxy-Authorization")
+	fs.StringVar(&cfg.ClientOIDCJWKS, "client-oidc-jwks", envOrDefault("CLIENT_OIDC_JWKS", ""), "JWKS URL or file verifying OIDC tokens clients may send in Proxy-Authorization")
+	fs.StringVar(&cfg.ClientOIDCIssuer, "client-oidc-issuer", envOrDefault("CLIENT_OIDC_ISSUER", "https://token.actions.githubusercontent.com"), "issuer of client OIDC tokens")
+	fs.StringVar(&cfg.ClientOIDCAudience, "client-oidc-audience", envOrDefault("CLIENT_OIDC_AUDIENCE", ""), "audience of client OIDC tokens (required with client-oidc-jwks)")
+	fs.StringVar(&cfg.ClientOwnerClaim, "client-owner-claim", envOrDefault("CLIENT_OWNER_CLAIM", ""), "token claim (e.g. repository_owner) naming the only repo owner token clients may read")
+	fs.StringVar(&cfg.MintClientToken, "mint-client-token", envOrDefault("MINT_CLIENT_TOKEN", ""), "if set, print an HMAC client token for this subject and exit")
+	fs.StringVar(&cfg.PolicyFile, "policy-file", envOrDefault("POLICY_FILE", ""), "JSON file of ordered allow/deny rules on host/owner/repo, reloaded on change (all allowed upstreams if empty)")
 	fs.StringVar(&cfg.MetricsPath, "metrics-path", envOrDefault("METRICS_PATH", "/metrics"), "path for Prometheus metrics")
 	fs.StringVar(&cfg.HealthPath, "health-path", envOrDefault("HEALTH_PATH", "/healthz"), "path for health checks")
 	fs.StringVar(&cfg.AWSCloudMapServiceID, "aws-cloud-map-service-id", envOrDefault("AWS_CLOUD_MAP_SERVICE_ID", ""), "AWS Cloud Map service ID for registration and health heartbeat")
 	fs.StringVar(&cfg.Route53HostedZoneID, "route53-hosted-zone-id", envOrDefault("ROUTE53_HOSTED_ZONE_ID", ""), "Route53 hosted zone ID for DNS registration")
 	fs.StringVar(&cfg.Route53RecordName, "route53-record-name", envOrDefault("ROUTE53_RECORD_NAME", ""), "Route53 record name (e.g., git-proxy.example.com)")
 	fs.BoolVar(&cfg.SerializeUploadPack, "serialize-upload-pack", envOrDefaultBool("SERIALIZE_UPLOAD_PACK", false), "serialize upload-pack per repo to reduce concurrent packing CPU")
+	fs.BoolVar(&cfg.EnablePush, "enable-push", envOrDefaultBool("ENABLE_PUSH", false), "forward pushes (git-receive-pack) to upstream with the client's credentials")
+	fs.BoolVar(&cfg.EnableLFS, "enable-lfs", envOrDefaultBool("ENABLE_LFS", false), "proxy the Git LFS batch API and serve LFS objects from the local cache")
+	fs.BoolVar(&cfg.EnableArchive, "enable-archive", envOrDefaultBool("ENABLE_ARCHIVE", false), "serve codeload-compatible tarballs and zipballs from the mirrors, cached on disk")
+	fs.BoolVar(&cfg.EnableRaw, "enable-raw", envOrDefaultBool("ENABLE_RAW", false), "serve single files from the mirrors under /raw/<host>/<owner>/<repo>/<ref>/<path>")
+	fs.BoolVar(&cfg.EnableAPI, "enable-api", envOrDefaultBool("ENABLE_API", false), "serve a read-only JSON API for refs and commits under /api/<host>/<owner>/<repo>/")
+	fs.BoolVar(&cfg.EnableGoProxy, "enable-goproxy", envOrDefaultBool("ENABLE_GOPROXY", false), "serve Go modules of allowed upstreams under /gomod/ (GOPROXY=<proxy>/gomod)")
+	fs.BoolVar(&cfg.EnablePackCache, "enable-pack-cache", envOrDefaultBool("ENABLE_PACK_CACHE", false), "cache upload-pack responses on disk and serve identical requests from the cache")
+	fs.BoolVar(&cfg.CoalesceUploadPack, "coalesce-upload-pack", envOrDefaultBool("COALESCE_UPLOAD_PACK", true), "share one upload-pack run between identical concurrent requests for the same repo")
+	fs.StringVar(&cfg.TLSCertFile, "tls-cert-file", envOrDefault("TLS_CERT_FILE", ""), "TLS certificate file, serve HTTPS when set (reloaded on change)")
+	fs.StringVar(&cfg.TLSKeyFile, "tls-key-file", envOrDefault("TLS_KEY_FILE", ""), "TLS private key file")
+	fs.StringVar(&cfg.TLSClientCAFile, "tls-client-ca-file", envOrDefault("TLS_CLIENT_CA_FILE", ""), "CA bundle to verify client certificates against, enables mutual TLS")
+	fs.StringVar(&cfg.ConnectCACertFile, "connect-ca-cert-file", envOrDefault("CONNECT_CA_CERT_FILE", ""), "CA certificate to mint interception certificates with, enables CONNECT (https_proxy) mode")
+	fs.StringVar(&cfg.ConnectCAKeyFile, "connect-ca-key-file", envOrDefault("CONNECT_CA_KEY_FILE", ""), "CA private key for CONNECT mode")
+	fs.StringVar(&cfg.SSHListenAddr, "ssh-listen-addr", envOrDefault("SSH_LISTEN_ADDR", ""), "SSH listen address for git-upload-pack (disabled if empty)")
+	fs.StringVar(&cfg.SSHHostKeyFile, "ssh-host-key-file", envOrDefault("SSH_HOST_KEY_FILE", ""), "SSH host private key file, generated if missing (ephemeral key if empty)")
+	fs.StringVar(&cfg.SSHAuthorizedKeys, "ssh-authorized-keys", envOrDefault("SSH_AUTHORIZED_KEYS", ""), "authorized_keys file listing SSH client keys allowed to fetch")
+	fs.StringVar(&cfg.GitDaemonListenAddr, "git-daemon-listen-addr", envOrDefault("GIT_DAEMON_LISTEN_ADDR", ""), "git:// listen address for unauthenticated upload-pack (disabled if empty)")
+	fs.BoolVar(&cfg.SyncMissingWants, "sync-missing-wants", envOrDefaultBool("SYNC_MISSING_WANTS", true), "sync the mirror outside of sync-stale-after when a fetch wants objects it doesn't have yet")
+	fs.IntVar(&cfg.SubmoduleDepth, "submodule-prefetch-depth", envOrDefaultInt("SUBMODULE_PREFETCH_DEPTH", 0), "levels of submodules on allowed upstreams to mirror in the background after a clone or sync (0 disables)")
 	fs.IntVar(&cfg.UploadPackThreads, "upload-pack-threads", envOrDefaultInt("UPLOAD_PACK_THREADS", 2), "pack.threads to use for upload-pack (0 means git default)")
 	fs.BoolVar(&cfg.MaintainAfterSync, "maintain-after-sync", envOrDefaultBool("MAINTAIN_AFTER_SYNC", true), "run lightweight maintenance (midx bitmap + commit-graph) after sync")
 	fs.StringVar(&cfg.MaintenanceRepo, "maintenance-repo", envOrDefault("MAINTENANCE_REPO", ""), "if set, run maintenance on the given repo key (host/owner/repo) or \"all\" and exit")
 
+	gitHubAppIDStr := fs.String("github-app-id", envOrDefault("GITHUB_APP_ID", ""), "GitHub App ID used when auth-mode=github-app")
+	gitHubAppInstallsStr := fs.String("github-app-installations", envOrDefault("GITHUB_APP_INSTALLATIONS", ""), "comma-separated owner=installation-id pairs, other owners are looked up from the API")
 	allowedUpstreamsStr := fs.String("allowed-upstreams", envOrDefault("ALLOWED_UPSTREAMS", "github.com"), "comma-separated list of allowed upstream hosts")
+	upstreamTemplatesStr := fs.String("upstream-templates", envOrDefault("UPSTREAM_TEMPLATES", ""), "comma-separated host=URL templates for upstream repos, with {host}, {owner} and {repo} placeholders")
+	upstreamCAFilesStr := fs.String("upstream-ca-files", envOrDefault("UPSTREAM_CA_FILES", ""), "comma-separated host=file CA bundles to verify upstream certificates with")
+	connectAllowedPortsStr := fs.String("connect-allowed-ports", envOrDefault("CONNECT_ALLOWED_PORTS", "443,22"), "comma-separated ports CONNECT tunnels may reach when they are not intercepted")
+	submodulePrefetchExcludeStr := fs.String("submodule-prefetch-exclude", envOrDefault("SUBMODULE_PREFETCH_EXCLUDE", ""), "comma-separated repo patterns (e.g. github.com/acme/*) whose submodules are not prefetched")
+	routeAliasesStr := fs.String("route-aliases", envOrDefault("ROUTE_ALIASES", ""), "comma-separated alias=host pairs, so /alias/owner/repo routes to host/owner/repo")
+	fs.StringVar(&cfg.DefaultUpstreamHost, "default-upstream-host", envOrDefault("DEFAULT_UPSTREAM_HOST", ""), "upstream host for /owner/repo paths without a host (disabled if empty)")
 	syncStaleAfterStr := fs.String("sync-stale-after", envOrDefault("SYNC_STALE_AFTER", "2s"), "sync mirror if older than this duration")
+	authCacheAllowTTLStr := fs.String("auth-cache-allow-ttl", envOrDefault("AUTH_CACHE_ALLOW_TTL", "1m"), "cache upstream allowing a token to read a private repo for this duration (0 disables)")
+	authCacheDenyTTLStr := fs.String("auth-cache-deny-ttl", envOrDefault("AUTH_CACHE_DENY_TTL", "10s"), "cache upstream denying a token access to a private repo for this duration (0 disables)")
+	credentialHelperTTLStr := fs.String("credential-helper-ttl", envOrDefault("CREDENTIAL_HELPER_TTL", "5m"), "reuse credentials from the credential helper for this duration, unless it sets an earlier expiry")
+	clientTokenTTLStr := fs.String("client-token-ttl", envOrDefault("CLIENT_TOKEN_TTL", "1h"), "lifetime of minted HMAC client tokens, and the longest lifetime accepted")
+	missingWantsIntervalStr := fs.String("sync-missing-wants-interval", envOrDefault("SYNC_MISSING_WANTS_INTERVAL", "10s"), "minimum time between two syncs of a repo forced by missing wants")
+	bundleIntervalStr := fs.String("bundle-interval", envOrDefault("BUNDLE_INTERVAL", ""), "generate clone bundles advertised through bundle-uri, refreshed at this interval (disabled if empty)")
 	mirrorMaxSizeStr := fs.String("mirror-max-size", envOrDefault("MIRROR_MAX_SIZE", ""), "max size for mirrors (e.g. 200GiB, 80%), defaults to 80% of available disk")
 
 	if err := fs.Parse(args); err != nil {
@@ -69,6 +166,31 @@ func LoadArgs(args []string) (*Config, error) {
 		return nil, fmt.Errorf("invalid sync-stale-after: %w", err)
 	}
 
+	if cfg.AuthCacheAllowTTL, err = time.ParseDuration(*authCacheAllowTTLStr); err != nil {
+		return nil, fmt.Errorf("invalid auth-cache-allow-ttl: %w", err)
+	}
+	if cfg.AuthCacheDenyTTL, err = time.ParseDuration(*authCacheDenyTTLStr); err != nil {
+		return nil, fmt.Errorf("invalid auth-cache-deny-ttl: %w", err)
+	}
+
+	if cfg.CredentialHelperTTL, err = time.ParseDuration(*credentialHelperTTLStr); err != nil {
+		return nil, fmt.Errorf("invalid credential-helper-ttl: %w", err)
+	}
+
+	if cfg.ClientTokenTTL, err = time.ParseDuration(*clientTokenTTLStr); err != nil {
+		return nil, fmt.Errorf("invalid client-token-ttl: %w", err)
+	}
+
+	if cfg.MissingWantsInterval, err = time.ParseDuration(*missingWantsIntervalStr); err != nil {
+		return nil, fmt.Errorf("invalid sync-missing-wants-interval: %w", err)
+	}
+
+	if *bundleIntervalStr != "" {
+		if cfg.BundleInterval, err = time.ParseDuration(*bundleIntervalStr); err != nil {
+			return nil, fmt.Errorf("invalid bundle-interval: %w", err)
+		}
+	}
+
 	// Parse mirror max size (empty string means use default 80% of available)
 	if *mirrorMaxSizeStr != "" {
 		if cfg.MirrorMaxSize, err = ParseSizeSpec(*mirrorMaxSizeStr); err != nil {
@@ -83,24 +205,102 @@ func LoadArgs(args []string) (*Config, error) {
 			cfg.AllowedUpstreams = append(cfg.AllowedUpstreams, h)
 		}
 	}
+	if err := parseUpstreams(cfg, *upstreamTemplatesStr, *upstreamCAFilesStr); err != nil {
+		return nil, err
+	}
 	if len(cfg.AllowedUpstreams) == 0 {
 		return nil, errors.New("at least one allowed upstream is required")
 	}
+	if err := parseRoutes(cfg, *routeAliasesStr); err != nil {
+		return nil, err
+	}
 
+	if cfg.SubmoduleDepth < 0 {
+		return nil, errors.New("submodule-prefetch-depth must not be negative")
+	}
+	for _, pattern := range strings.Split(*submodulePrefetchExcludeStr, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid submodule-prefetch-exclude pattern %q: %w", pattern, err)
+		}
+		cfg.SubmoduleExclude = append(cfg.SubmoduleExclude, pattern)
+	}
+
+	for _, port := range strings.Split(*connectAllowedPortsStr, ",") {
+		port = strings.TrimSpace(port)
+		if port == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("invalid connect-allowed-ports port %q", port)
+		}
+		cfg.ConnectAllowedPorts = append(cfg.ConnectAllowedPorts, port)
+	}
+
+	if cfg.CredentialsFile != "" {
+		if cfg.Credentials, err = loadCredentials(cfg.CredentialsFile); err != nil {
+			return nil, err
+		}
+	}
+	if err := parseGitHubApp(cfg, *gitHubAppIDStr, *gitHubAppInstallsStr); err != nil {
+		return nil, err
+	}
 	if err := validateAuth(cfg); err != nil {
 		return nil, err
 	}
+	if cfg.ClientOIDCJWKS != "" && cfg.ClientOIDCAudience == "" {
+		return nil, errors.New("client-oidc-jwks requires CLIENT_OIDC_AUDIENCE")
+	}
+	if cfg.ClientOwnerClaim != "" && cfg.ClientTokenSecret == "" && cfg.ClientOIDCJWKS == "" {
+		return nil, errors.New("client-owner-claim requires CLIENT_TOKEN_SECRET or CLIENT_OIDC_JWKS")
+	}
+	if cfg.MintClientToken != "" && cfg.ClientTokenSecret == "" {
+		return nil, errors.New("mint-client-token requires CLIENT_TOKEN_SECRET")
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return nil, errors.New("tls-cert-file and tls-key-file must be set together")
+	}
+	if cfg.TLSClientCAFile != "" && cfg.TLSCertFile == "" {
+		return nil, errors.New("tls-client-ca-file requires TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	if (cfg.ConnectCACertFile == "") != (cfg.ConnectCAKeyFile == "") {
+		return nil, errors.New("connect-ca-cert-file and connect-ca-key-file must be set together")
+	}
+	if cfg.SSHListenAddr != "" && cfg.SSHAuthorizedKeys == "" {
+		return nil, errors.New("ssh-listen-addr requires SSH_AUTHORIZED_KEYS")
+	}
+	if cfg.GitDaemonListenAddr != "" && cfg.ClientAuthEnabled() {
+		return nil, errors.New("git-daemon-listen-addr bypasses client authentication, unset it or CLIENT_API_KEYS_FILE, CLIENT_TOKEN_SECRET and CLIENT_OIDC_JWKS")
+	}
 
 	return cfg, nil
 }
 
+// ClientAuthEnabled reports whether clients must authenticate to the proxy.
+func (c *Config) ClientAuthEnabled() bool {
+	return c.ClientAPIKeysFile != "" || c.ClientTokenSecret != "" || c.ClientOIDCJWKS != ""
+}
+
 func validateAuth(cfg *Config) error {
 	switch cfg.AuthMode {
 	case "pass-through", "none":
 		return nil
 	case "static":
-		if cfg.StaticToken == "" {
-			return errors.New("auth-mode=static requires STATIC_TOKEN")
+		if cfg.StaticToken == "" && cfg.CredentialsFile == "" {
+			return errors.New("auth-mode=static requires STATIC_TOKEN or CREDENTIALS_FILE")
+		}
+		return nil
+	case "github-app":
+		if cfg.GitHubAppID == 0 || cfg.GitHubAppKeyFile == "" {
+			return errors.New("auth-mode=github-app requires GITHUB_APP_ID and GITHUB_APP_PRIVATE_KEY_FILE")
+		}
+		return nil
+	case "credential-helper":
+		if cfg.CredentialHelper == "" {
+			return errors.New("auth-mode=credential-helper requires CREDENTIAL_HELPER")
 		}
 		return nil
 	default:
@@ -108,6 +308,39 @@ func validateAuth(cfg *Config) error {
 	}
 }
 
+// parseGitHubApp reads GITHUB_APP_ID and GITHUB_APP_INSTALLATIONS, and
+// derives GITHUB_APP_HOST from GITHUB_API_URL when unset.
+func parseGitHubApp(cfg *Config, appID, installs string) error {
+	if appID != "" {
+		id, err := strconv.ParseInt(appID, 10, 64)
+		if err != nil || id <= 0 {
+			return fmt.Errorf("invalid github-app-id %q", appID)
+		}
+		cfg.GitHubAppID = id
+	}
+	owners, err := parseHostMap("github-app-installations", installs)
+	if err != nil {
+		return err
+	}
+	cfg.GitHubAppInstalls = make(map[string]int64, len(owners))
+	for owner, value := range owners {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || id <= 0 {
+			return fmt.Errorf("invalid github-app-installations entry for %s: %q is not an installation ID", owner, value)
+		}
+		cfg.GitHubAppInstalls[owner] = id
+	}
+	if cfg.GitHubAppHost == "" {
+		u, err := url.Parse(cfg.GitHubAPIURL)
+		if err != nil || u.Hostname() == "" {
+			return fmt.Errorf("invalid github-api-url %q", cfg.GitHubAPIURL)
+		}
+		// api.github.com serves github.com, GHES serves /api/v3 on its own host
+		cfg.GitHubAppHost = strings.TrimPrefix(u.Hostname(), "api.")
+	}
+	return nil
+}
+
 func envOrDefault(key, def string) string {
 	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
 		return v
@@ -2,6 +2,7 @@ package config
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -21,6 +22,30 @@ func TestDefaults(t *testing.T) {
 	if cfg.SyncStaleAfter != 2*time.Second {
 		t.Fatalf("sync stale after default mismatch: %v", cfg.SyncStaleAfter)
 	}
+	if cfg.AuthCacheAllowTTL != time.Minute || cfg.AuthCacheDenyTTL != 10*time.Second {
+		t.Fatalf("auth cache ttl defaults mismatch: %v/%v", cfg.AuthCacheAllowTTL, cfg.AuthCacheDenyTTL)
+	}
+	if cfg.EnablePush {
+		t.Fatalf("push forwarding must be opt-in")
+	}
+	if cfg.EnableGoProxy {
+		t.Fatalf("the Go module proxy must be opt-in")
+	}
+	if cfg.EnableAPI {
+		t.Fatalf("the JSON API must be opt-in")
+	}
+	if cfg.EnableRaw {
+		t.Fatalf("the raw file endpoint must be opt-in")
+	}
+	if cfg.EnableArchive {
+		t.Fatalf("the archive endpoint must be opt-in")
+	}
+	if cfg.EnableLFS {
+		t.Fatalf("the LFS proxy must be opt-in")
+	}
+	if len(cfg.ConnectAllowedPorts) != 2 || cfg.ConnectAllowedPorts[0] != "443" || cfg.ConnectAllowedPorts[1] != "22" {
+		t.Fatalf("connect allowed ports default mismatch: %v", cfg.ConnectAllowedPorts)
+	}
 }
 
 func TestStaticAuthRequiresToken(t *testing.T) {
@@ -31,6 +56,223 @@ func TestStaticAuthRequiresToken(t *testing.T) {
 	}
 }
 
+func TestCredentialsFile(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("GITEA_TOKEN", "gitea-secret")
+	file := filepath.Join(t.TempDir(), "credentials.json")
+	write := func(content string) {
+		if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+			t.Fatalf("write credentials: %v", err)
+		}
+	}
+	write(`[
+		{"match": "github.com", "token": "ghp_default"},
+		{"match": "github.com/acme-*", "token": "ghp_acme"},
+		{"match": "ghe.example.com", "username": "bot", "password": "pw"},
+		{"match": "gitea.local", "header": "token ${GITEA_TOKEN}"}
+	]`)
+	cfg, err := LoadArgs([]string{"-auth-mode=static", "-credentials-file=" + file})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	for _, tc := range []struct{ host, owner, want string }{
+		{"github.com", "other", "Bearer ghp_default"},
+		{"github.com", "acme-infra", "Bearer ghp_acme"},
+		{"ghe.example.com", "acme", "Basic Ym90OnB3"},
+		{"gitea.local", "acme", "token gitea-secret"},
+		{"gitlab.com", "acme", ""},
+	} {
+		if got, _ := cfg.UpstreamCredential(tc.host, tc.owner); got != tc.want {
+			t.Fatalf("%s/%s: got %q, want %q", tc.host, tc.owner, got, tc.want)
+		}
+	}
+
+	for _, content := range []string{
+		`{"match": "github.com"}`,
+		`[{"match": "github.com", "token": "a", "header": "b"}]`,
+		`[{"match": "github.com", "username": "bot"}]`,
+		`[{"match": "github.com/acme/widgets", "token": "a"}]`,
+		`[{"match": "github.com/[acme", "token": "a"}]`,
+	} {
+		write(content)
+		if _, err := LoadArgs([]string{"-auth-mode=static", "-credentials-file=" + file}); err == nil {
+			t.Fatalf("expected error for %s", content)
+		}
+	}
+}
+
+func TestGitHubAppAuth(t *testing.T) {
+	clearEnv(t)
+	if _, err := LoadArgs([]string{"-auth-mode=github-app", "-github-app-id=42"}); err == nil {
+		t.Fatalf("expected error when private key missing")
+	}
+	cfg, err := LoadArgs([]string{"-auth-mode=github-app", "-github-app-id=42", "-github-app-private-key-file=/etc/app.pem", "-github-app-installations=acme=7,other=9"})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.GitHubAppID != 42 || cfg.GitHubAppInstalls["acme"] != 7 || cfg.GitHubAppInstalls["other"] != 9 || cfg.GitHubAPIURL != "https://api.github.com" || cfg.GitHubAppHost != "github.com" {
+		t.Fatalf("unexpected github app config %+v", cfg)
+	}
+	if cfg, _ := LoadArgs([]string{"-github-api-url=https://ghe.example.com/api/v3"}); cfg == nil || cfg.GitHubAppHost != "ghe.example.com" {
+		t.Fatalf("expected the app host derived from the GHES API URL, got %+v", cfg)
+	}
+	for _, args := range [][]string{
+		{"-github-app-id=abc"},
+		{"-github-app-installations=acme=x"},
+	} {
+		if _, err := LoadArgs(args); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
+
+func TestCredentialHelperAuth(t *testing.T) {
+	clearEnv(t)
+	if _, err := LoadArgs([]string{"-auth-mode=credential-helper"}); err == nil {
+		t.Fatalf("expected error when credential helper missing")
+	}
+	cfg, err := LoadArgs([]string{"-auth-mode=credential-helper", "-credential-helper=vault --mount ci"})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.CredentialHelper != "vault --mount ci" || cfg.CredentialHelperTTL != 5*time.Minute {
+		t.Fatalf("unexpected credential helper config %+v", cfg)
+	}
+	if _, err := LoadArgs([]string{"-credential-helper-ttl=soon"}); err == nil {
+		t.Fatalf("expected error for invalid ttl")
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	clearEnv(t)
+	cfg, err := LoadArgs(nil)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.ClientAuthEnabled() || cfg.ClientTokenTTL != time.Hour || cfg.ClientOIDCIssuer != "https://token.actions.githubusercontent.com" {
+		t.Fatalf("unexpected client auth defaults %+v", cfg)
+	}
+	cfg, err = LoadArgs([]string{"-client-oidc-jwks=https://token.actions.githubusercontent.com/.well-known/jwks", "-client-oidc-audience=git-proxy", "-client-owner-claim=repository_owner"})
+	if err != nil || !cfg.ClientAuthEnabled() {
+		t.Fatalf("expected client auth enabled (%v)", err)
+	}
+	for _, args := range [][]string{
+		{"-client-oidc-jwks=/etc/jwks.json"},
+		{"-client-api-keys-file=/etc/keys", "-client-owner-claim=repository_owner"},
+		{"-mint-client-token=ci"},
+		{"-client-token-ttl=soon"},
+		{"-client-api-keys-file=/etc/keys", "-git-daemon-listen-addr=:9418"},
+	} {
+		if _, err := LoadArgs(args); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
+
+func TestSSHRequiresAuthorizedKeys(t *testing.T) {
+	clearEnv(t)
+	if _, err := LoadArgs([]string{"-ssh-listen-addr=:2222"}); err == nil {
+		t.Fatalf("expected error when authorized keys missing")
+	}
+	if _, err := LoadArgs([]string{"-ssh-listen-addr=:2222", "-ssh-authorized-keys=/etc/keys"}); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+}
+
+func TestTLSRequiresCertAndKey(t *testing.T) {
+	clearEnv(t)
+	if _, err := LoadArgs([]string{"-tls-cert-file=/etc/tls/cert.pem"}); err == nil {
+		t.Fatalf("expected error when tls key missing")
+	}
+	if _, err := LoadArgs([]string{"-tls-client-ca-file=/etc/tls/ca.pem"}); err == nil {
+		t.Fatalf("expected error when client CA set without a certificate")
+	}
+	if _, err := LoadArgs([]string{"-connect-ca-cert-file=/etc/tls/ca.pem"}); err == nil {
+		t.Fatalf("expected error when connect CA key missing")
+	}
+	if _, err := LoadArgs([]string{"-connect-allowed-ports=443,ssh"}); err == nil {
+		t.Fatalf("expected error for an invalid connect port")
+	}
+}
+
+func TestUpstreamTemplates(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("UPSTREAM_TEMPLATES", "ghe.example.com=https://ghe.example.com:8443/git/{owner}/{repo}.git, gitea.local=http://gitea.local:3000/{owner}/{repo}")
+	t.Setenv("UPSTREAM_CA_FILES", "ghe.example.com=/etc/ssl/ghe.pem")
+	t.Setenv("ALLOWED_UPSTREAMS", "github.com,ghe.example.com,gitea.local")
+	cfg, err := LoadArgs([]string{})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	for _, tc := range []struct{ host, want string }{
+		{"github.com", "https://github.com/acme/widgets.git"},
+		{"ghe.example.com", "https://ghe.example.com:8443/git/acme/widgets.git"},
+		{"gitea.local", "http://gitea.local:3000/acme/widgets"},
+	} {
+		if got := cfg.UpstreamURL(tc.host, "acme", "widgets"); got != tc.want {
+			t.Fatalf("upstream url for %s: got %s, want %s", tc.host, got, tc.want)
+		}
+	}
+	if got := cfg.UpstreamCAURLs()["https://ghe.example.com:8443/"]; got != "/etc/ssl/ghe.pem" {
+		t.Fatalf("unexpected CA URLs %v", cfg.UpstreamCAURLs())
+	}
+
+	for _, bad := range []string{"ghe.example.com", "ghe.example.com=ftp://ghe/{repo}", "ghe.example.com=https://ghe/static.git"} {
+		if _, err := LoadArgs([]string{"-upstream-templates=" + bad}); err == nil {
+			t.Fatalf("expected error for template %q", bad)
+		}
+	}
+	if _, err := LoadArgs([]string{"-upstream-templates=other.example.com=https://other.example.com/{repo}"}); err == nil {
+		t.Fatalf("expected error for a template of a host that is not allowed")
+	}
+	if _, err := LoadArgs([]string{"-upstream-templates=", "-upstream-ca-files=other.example.com=/ca.pem"}); err == nil {
+		t.Fatalf("expected error for CA file of a host that is not allowed")
+	}
+}
+
+func TestRouteAliases(t *testing.T) {
+	clearEnv(t)
+	cfg, err := LoadArgs([]string{"-allowed-upstreams=github.com,ghe.example.com", "-route-aliases=gh=github.com,ghe=ghe.example.com", "-default-upstream-host=github.com"})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.RouteAliases["gh"] != "github.com" || cfg.RouteAliases["ghe"] != "ghe.example.com" {
+		t.Fatalf("unexpected aliases %v", cfg.RouteAliases)
+	}
+	for _, args := range [][]string{
+		{"-route-aliases=gh=gitlab.com"},
+		{"-route-aliases=github.com=github.com"},
+		{"-default-upstream-host=gitlab.com"},
+	} {
+		if _, err := LoadArgs(args); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
+
+func TestSubmodulePrefetch(t *testing.T) {
+	clearEnv(t)
+	cfg, err := LoadArgs(nil)
+	if err != nil || cfg.SubmoduleDepth != 0 {
+		t.Fatalf("expected submodule prefetching to be opt-in, got depth %d (%v)", cfg.SubmoduleDepth, err)
+	}
+	cfg, err = LoadArgs([]string{"-submodule-prefetch-depth=1", "-submodule-prefetch-exclude=github.com/acme/*, github.com/other/big"})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.SubmoduleDepth != 1 || len(cfg.SubmoduleExclude) != 2 || cfg.SubmoduleExclude[1] != "github.com/other/big" {
+		t.Fatalf("unexpected submodule prefetch config %d %v", cfg.SubmoduleDepth, cfg.SubmoduleExclude)
+	}
+	for _, args := range [][]string{
+		{"-submodule-prefetch-depth=-1"},
+		{"-submodule-prefetch-exclude=github.com/[acme"},
+	} {
+		if _, err := LoadArgs(args); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
+
 func TestEnvOverrides(t *testing.T) {
 	clearEnv(t)
 	t.Setenv("SYNC_STALE_AFTER", "5s")
@@ -92,6 +334,16 @@ func clearEnv(t *testing.T) {
 		"LISTEN_ADDR", "MIRROR_DIR", "MIRROR_MAX_SIZE", "SYNC_STALE_AFTER", "ALLOWED_UPSTREAMS", "LOG_LEVEL",
 		"AUTH_MODE", "STATIC_TOKEN",
 		"SERIALIZE_UPLOAD_PACK", "UPLOAD_PACK_THREADS", "MAINTAIN_AFTER_SYNC", "MAINTENANCE_REPO", "ENABLE_PACK_CACHE",
+		"SSH_LISTEN_ADDR", "SSH_HOST_KEY_FILE", "SSH_AUTHORIZED_KEYS",
+		"GIT_DAEMON_LISTEN_ADDR", "TLS_CERT_FILE", "TLS_KEY_FILE", "TLS_CLIENT_CA_FILE",
+		"BUNDLE_INTERVAL", "SYNC_MISSING_WANTS", "UPSTREAM_TEMPLATES", "UPSTREAM_CA_FILES",
+		"ROUTE_ALIASES", "DEFAULT_UPSTREAM_HOST", "CONNECT_CA_CERT_FILE", "CONNECT_CA_KEY_FILE", "CONNECT_ALLOWED_PORTS",
+		"ENABLE_ARCHIVE", "ENABLE_RAW", "ENABLE_API", "ENABLE_GOPROXY",
+		"SUBMODULE_PREFETCH_DEPTH", "SUBMODULE_PREFETCH_EXCLUDE", "GITHUB_APP_ID", "GITHUB_APP_PRIVATE_KEY_FILE",
+		"GITHUB_APP_INSTALLATIONS", "GITHUB_API_URL", "GITHUB_APP_HOST", "CREDENTIALS_FILE", "AUTH_CACHE_ALLOW_TTL", "AUTH_CACHE_DENY_TTL",
+		"REQUIRE_CLIENT_AUTH", "CLIENT_API_KEYS_FILE", "CLIENT_TOKEN_SECRET", "CLIENT_TOKEN_TTL", "CLIENT_OIDC_JWKS",
+		"CLIENT_OIDC_ISSUER", "CLIENT_OIDC_AUDIENCE", "CLIENT_OWNER_CLAIM", "MINT_CLIENT_TOKEN", "POLICY_FILE",
+		"CREDENTIAL_HELPER", "CREDENTIAL_HELPER_TTL", "SYNC_MISSING_WANTS_INTERVAL",
 	} {
 		_ = os.Unsetenv(k)
 	}
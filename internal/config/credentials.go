@@ -0,0 +1,94 @@
+package config
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// Credential is an entry of CREDENTIALS_FILE: the upstream credential for
+// repos whose host, or host/owner, matches Match (a path.Match pattern).
+// Exactly one of Token, Username/Password or Header is set.
+type Credential struct {
+	Match    string `json:"match"`
+	Token    string `json:"token,omitempty"`    // Sent as a Bearer token
+	Username string `json:"username,omitempty"` // Sent as basic credentials with Password
+	Password string `json:"password,omitempty"`
+	Header   string `json:"header,omitempty"` // Sent as the whole Authorization header, e.g. "token abc"
+}
+
+// AuthHeader returns the Authorization header value for the credential.
+func (c Credential) AuthHeader() string {
+	switch {
+	case c.Token != "":
+		return "Bearer " + c.Token
+	case c.Username != "":
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password))
+	}
+	return c.Header
+}
+
+// loadCredentials reads a JSON array of credentials from file. ${VAR}
+// references in values are expanded from the environment, so secrets can
+// stay out of the file.
+func loadCredentials(file string) ([]Credential, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read credentials file: %w", err)
+	}
+	var creds []Credential
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("parse credentials file %s: %w", file, err)
+	}
+	for i := range creds {
+		c := &creds[i]
+		c.Token, c.Username, c.Password, c.Header = os.ExpandEnv(c.Token), os.ExpandEnv(c.Username), os.ExpandEnv(c.Password), os.ExpandEnv(c.Header)
+		if err := c.validate(); err != nil {
+			return nil, fmt.Errorf("credentials file %s: entry %d: %w", file, i, err)
+		}
+	}
+	return creds, nil
+}
+
+func (c Credential) validate() error {
+	if c.Match == "" || strings.Count(c.Match, "/") > 1 {
+		return fmt.Errorf("match %q must be a host or host/owner pattern", c.Match)
+	}
+	if _, err := path.Match(c.Match, ""); err != nil {
+		return fmt.Errorf("match %q: %w", c.Match, err)
+	}
+	kinds := 0
+	for _, set := range []bool{c.Token != "", c.Username != "" || c.Password != "", c.Header != ""} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return errors.New("exactly one of token, username/password or header is required")
+	}
+	if (c.Username == "") != (c.Password == "") {
+		return errors.New("username and password must be set together")
+	}
+	return nil
+}
+
+// UpstreamCredential returns the Authorization header configured for repos
+// of owner on host. Entries matching host/owner win over host-only entries;
+// among those, the first one in the file wins.
+func (c *Config) UpstreamCredential(host, owner string) (string, bool) {
+	for _, level := range []string{host + "/" + owner, host} {
+		for _, cred := range c.Credentials {
+			if strings.Count(cred.Match, "/") != strings.Count(level, "/") {
+				continue
+			}
+			if ok, _ := path.Match(cred.Match, level); ok {
+				return cred.AuthHeader(), true
+			}
+		}
+	}
+	return "", false
+}
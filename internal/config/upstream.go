@@ -0,0 +1,109 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// defaultUpstreamTemplate maps a proxy path to its upstream repo URL when the
+// host has no template of its own.
+const defaultUpstreamTemplate = "https://{host}/{owner}/{repo}.git"
+
+// UpstreamURL returns the URL of the upstream repo for host/owner/repo,
+// expanding the UPSTREAM_TEMPLATES entry of host (or the default template).
+func (c *Config) UpstreamURL(host, owner, repo string) string {
+	tmpl, ok := c.UpstreamTemplates[host]
+	if !ok {
+		tmpl = defaultUpstreamTemplate
+	}
+	return strings.NewReplacer("{host}", host, "{owner}", owner, "{repo}", repo).Replace(tmpl)
+}
+
+// UpstreamCAURLs returns the CA bundle to verify each upstream with, keyed by
+// the scheme and host part of its URL.
+func (c *Config) UpstreamCAURLs() map[string]string {
+	cas := make(map[string]string, len(c.UpstreamCAFiles))
+	for host, file := range c.UpstreamCAFiles {
+		u, err := url.Parse(c.UpstreamURL(host, "", ""))
+		if err != nil {
+			continue
+		}
+		cas[u.Scheme+"://"+u.Host+"/"] = file
+	}
+	return cas
+}
+
+// parseHostMap parses a comma-separated list of host=value pairs.
+func parseHostMap(name, s string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host, value, ok := strings.Cut(entry, "=")
+		host, value = strings.TrimSpace(host), strings.TrimSpace(value)
+		if !ok || host == "" || value == "" {
+			return nil, fmt.Errorf("invalid %s entry %q, expected host=value", name, entry)
+		}
+		m[host] = value
+	}
+	return m, nil
+}
+
+// parseUpstreams reads UPSTREAM_TEMPLATES and UPSTREAM_CA_FILES, whose hosts
+// must be allowed upstreams.
+func parseUpstreams(cfg *Config, templates, caFiles string) error {
+	var err error
+	if cfg.UpstreamTemplates, err = parseHostMap("upstream-templates", templates); err != nil {
+		return err
+	}
+	for host, tmpl := range cfg.UpstreamTemplates {
+		u, err := url.Parse(strings.NewReplacer("{host}", host, "{owner}", "owner", "{repo}", "repo").Replace(tmpl))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid upstream template for %s: %q is not an http(s) URL", host, tmpl)
+		}
+		if !strings.Contains(tmpl, "{repo}") {
+			return fmt.Errorf("invalid upstream template for %s: %q has no {repo} placeholder", host, tmpl)
+		}
+		if !slices.Contains(cfg.AllowedUpstreams, host) {
+			return fmt.Errorf("upstream-templates: %s is not an allowed upstream", host)
+		}
+	}
+
+	if cfg.UpstreamCAFiles, err = parseHostMap("upstream-ca-files", caFiles); err != nil {
+		return err
+	}
+	for host := range cfg.UpstreamCAFiles {
+		if !slices.Contains(cfg.AllowedUpstreams, host) {
+			return fmt.Errorf("upstream-ca-files: %s is not an allowed upstream", host)
+		}
+	}
+	return nil
+}
+
+// parseRoutes reads ROUTE_ALIASES and checks that aliases and
+// DEFAULT_UPSTREAM_HOST point to allowed upstreams.
+func parseRoutes(cfg *Config, aliases string) error {
+	var err error
+	if cfg.RouteAliases, err = parseHostMap("route-aliases", aliases); err != nil {
+		return err
+	}
+	for alias, host := range cfg.RouteAliases {
+		if strings.Contains(alias, "/") {
+			return fmt.Errorf("route-aliases: alias %q must be a single path segment", alias)
+		}
+		if slices.Contains(cfg.AllowedUpstreams, alias) {
+			return fmt.Errorf("route-aliases: alias %q shadows an allowed upstream", alias)
+		}
+		if !slices.Contains(cfg.AllowedUpstreams, host) {
+			return fmt.Errorf("route-aliases: %s is not an allowed upstream", host)
+		}
+	}
+	if cfg.DefaultUpstreamHost != "" && !slices.Contains(cfg.AllowedUpstreams, cfg.DefaultUpstreamHost) {
+		return fmt.Errorf("default-upstream-host: %s is not an allowed upstream", cfg.DefaultUpstreamHost)
+	}
+	return nil
+}
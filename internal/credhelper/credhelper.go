@@ -0,0 +1,193 @@
+// Package credhelper gets upstream credentials from an external git
+// credential helper, speaking the git credential protocol to it.
+package credhelper
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// helperTimeout bounds each helper run, so a stuck secrets manager doesn't
+// hold syncs forever.
+const helperTimeout = 30 * time.Second
+
+// Helper runs a credential helper and caches the credentials it returns per
+// upstream protocol and host.
+type Helper struct {
+	command string // Shell command the action (get, store or erase) is appended to
+	ttl     time.Duration
+	log     *slog.Logger
+
+	group singleflight.Group // One get per host at a time, run outside mu
+	mu    sync.Mutex
+	creds map[string]credential // by protocol://host
+}
+
+type credential struct {
+	username  string
+	password  string
+	expiresAt time.Time
+	stored    bool // Already reported to the helper as working
+}
+
+func (c credential) authHeader() string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.username+":"+c.password))
+}
+
+// New returns a helper running spec the way git runs credential.helper: a
+// spec starting with ! is a shell command, an absolute path is run as is
+// and anything else names git-credential-<spec>, with arguments appended.
+// Credentials are cached for ttl, or until the expiry the helper sets.
+func New(spec string, ttl time.Duration, log *slog.Logger) *Helper {
+	command := spec
+	switch {
+	case strings.HasPrefix(spec, "!"):
+		command = spec[1:]
+	case filepath.IsAbs(spec):
+	default:
+		command = "git credential-" + spec
+	}
+	return &Helper{command: command, ttl: ttl, log: log, creds: make(map[string]credential)}
+}
+
+// AuthHeader returns the Authorization header for upstreamURL, asking the
+// helper for a credential when none is cached. Concurrent callers for the
+// same host share one helper run, and other hosts aren't held up by it.
+func (h *Helper) AuthHeader(ctx context.Context, upstreamURL string) (string, error) {
+	key, attrs, err := describe(upstreamURL)
+	if err != nil {
+		return "", err
+	}
+	if c, ok := h.cached(key); ok {
+		return c.authHeader(), nil
+	}
+
+	v, err, _ := h.group.Do(key, func() (any, error) {
+		// A get that just ended may have cached it
+		if c, ok := h.cached(key); ok {
+			return c, nil
+		}
+		out, err := h.run(ctx, "get", attrs)
+		if err != nil {
+			return credential{}, err
+		}
+		c := credential{expiresAt: time.Now().Add(h.ttl)}
+		for _, line := range strings.Split(string(out), "\n") {
+			k, v, _ := strings.Cut(line, "=")
+			switch k {
+			case "username":
+				c.username = v
+			case "password":
+				c.password = v
+			case "password_expiry_utc":
+				if sec, err := strconv.ParseInt(v, 10, 64); err == nil && time.Unix(sec, 0).Before(c.expiresAt) {
+					c.expiresAt = time.Unix(sec, 0)
+				}
+			}
+		}
+		if c.password == "" {
+			return credential{}, fmt.Errorf("credential helper returned no password for %s", key)
+		}
+		h.mu.Lock()
+		h.creds[key] = c
+		h.mu.Unlock()
+		return c, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return v.(credential).authHeader(), nil
+}
+
+// cached returns the unexpired credential of key, if any.
+func (h *Helper) cached(key string) (credential, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c, ok := h.creds[key]
+	return c, ok && time.Now().Before(c.expiresAt)
+}
+
+// Report tells the helper whether upstream accepted authHeader for
+// upstreamURL: the first success stores the credential, a refusal erases it
+// so the next AuthHeader asks again. Headers that didn't come from the
+// helper, or were since replaced, are ignored.
+func (h *Helper) Report(ctx context.Context, upstreamURL, authHeader string, accepted bool) {
+	key, attrs, err := describe(upstreamURL)
+	if err != nil {
+		return
+	}
+	h.mu.Lock()
+	c, ok := h.creds[key]
+	if !ok || c.authHeader() != authHeader || (accepted && c.stored) {
+		h.mu.Unlock()
+		return
+	}
+	action := "store"
+	if accepted {
+		c.stored = true
+		h.creds[key] = c
+	} else {
+		action = "erase"
+		delete(h.creds, key)
+	}
+	h.mu.Unlock()
+
+	if !accepted {
+		h.log.Warn("upstream refused helper credential, erasing it", "upstream", key)
+	}
+	attrs = append(attrs, "username="+c.username, "password="+c.password)
+	if _, err := h.run(ctx, action, attrs); err != nil {
+		h.log.Warn("credential helper failed", "action", action, "upstream", key, "err", err)
+	}
+}
+
+// run sends attrs to the helper for action and returns what it printed.
+func (h *Helper) run(ctx context.Context, action string, attrs []string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, helperTimeout)
+	defer cancel()
+	var input bytes.Buffer
+	for _, attr := range attrs {
+		input.WriteString(attr + "\n")
+	}
+	input.WriteString("\n")
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", h.command+" "+action)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = &input, &stdout, &stderr
+	// Don't wait on processes the helper started once it was killed
+	cmd.WaitDelay = time.Second
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("credential helper %s: %w: %s", action, err, strings.TrimSpace(stderr.String()))
+	}
+	// The reply ends at the first blank line, as git reads it
+	var out bytes.Buffer
+	sc := bufio.NewScanner(&stdout)
+	for sc.Scan() && sc.Text() != "" {
+		out.WriteString(sc.Text() + "\n")
+	}
+	return out.Bytes(), nil
+}
+
+// describe returns the cache key and credential attributes of upstreamURL.
+// Like git by default, the path is left out, so helpers answer per host.
+func describe(upstreamURL string) (key string, attrs []string, err error) {
+	u, err := url.Parse(upstreamURL)
+	if err != nil || u.Host == "" {
+		return "", nil, errors.New("credential helper: invalid upstream URL")
+	}
+	return u.Scheme + "://" + u.Host, []string{"protocol=" + u.Scheme, "host=" + u.Host}, nil
+}
@@ -0,0 +1,155 @@
+package credhelper
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHelper writes a helper script that logs each action and its input to
+// log, and answers get with password.
+func fakeHelper(t *testing.T, dir, password string) (script, log string) {
+	t.Helper()
+	script, log = filepath.Join(dir, "git-credential-fake"), filepath.Join(dir, "calls")
+	body := `#!/bin/sh
+echo "$1" >> ` + log + `
+cat >> ` + log + `
+if [ "$1" = get ]; then
+	printf 'username=bot\npassword=` + password + `\n\nignored=1\n'
+fi
+`
+	if err := os.WriteFile(script, []byte(body), 0o755); err != nil {
+		t.Fatalf("write helper: %v", err)
+	}
+	return script, log
+}
+
+func calls(t *testing.T, log string) string {
+	t.Helper()
+	data, err := os.ReadFile(log)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("read calls: %v", err)
+	}
+	return string(data)
+}
+
+func TestHelper(t *testing.T) {
+	dir := t.TempDir()
+	script, log := fakeHelper(t, dir, "s3cret")
+	h := New(script, time.Hour, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	ctx := context.Background()
+	const upstream = "https://git.example.com/acme/widgets.git"
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte("bot:s3cret"))
+
+	header, err := h.AuthHeader(ctx, upstream)
+	if err != nil || header != want {
+		t.Fatalf("expected %q, got %q (%v)", want, header, err)
+	}
+	if got := calls(t, log); got != "get\nprotocol=https\nhost=git.example.com\n\n" {
+		t.Fatalf("unexpected get request:\n%s", got)
+	}
+
+	// Cached per host, stored once after upstream accepted it
+	if header, _ := h.AuthHeader(ctx, "https://git.example.com/acme/other.git"); header != want {
+		t.Fatalf("expected the cached credential, got %q", header)
+	}
+	h.Report(ctx, upstream, header, true)
+	h.Report(ctx, upstream, header, true)
+	h.Report(ctx, upstream, "Bearer someone-else", false)
+	if got := calls(t, log); strings.Count(got, "get\n") != 1 || strings.Count(got, "store\n") != 1 || strings.Contains(got, "erase") {
+		t.Fatalf("unexpected calls:\n%s", got)
+	}
+
+	// Refused credentials are erased and asked for again
+	h.Report(ctx, upstream, header, false)
+	if got := calls(t, log); !strings.Contains(got, "erase\nprotocol=https\nhost=git.example.com\nusername=bot\npassword=s3cret\n\n") {
+		t.Fatalf("expected an erase request, got:\n%s", got)
+	}
+	if _, err := h.AuthHeader(ctx, upstream); err != nil {
+		t.Fatalf("auth header: %v", err)
+	}
+	if got := calls(t, log); strings.Count(got, "get\n") != 2 {
+		t.Fatalf("expected a second get, got:\n%s", got)
+	}
+}
+
+func TestHelperErrors(t *testing.T) {
+	dir := t.TempDir()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	script, _ := fakeHelper(t, dir, "")
+	if _, err := New(script, time.Hour, log).AuthHeader(context.Background(), "https://git.example.com/a/b.git"); err == nil {
+		t.Fatal("expected an error without a password")
+	}
+	h := New("!echo broken >&2; exit 1", time.Hour, log)
+	if _, err := h.AuthHeader(context.Background(), "https://git.example.com/a/b.git"); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Fatalf("expected the helper's stderr in the error, got %v", err)
+	}
+}
+
+func TestHelperRunsOutsideLock(t *testing.T) {
+	dir := t.TempDir()
+	log, release := filepath.Join(dir, "calls"), filepath.Join(dir, "release")
+	// Gets for slow.example.com hang until the release file exists
+	script := filepath.Join(dir, "git-credential-slow")
+	body := "#!/bin/sh\necho \"$1\" >> " + log + "\n" +
+		"if grep -q host=slow; then\n\twhile [ ! -e " + release + " ]; do sleep 0.01; done\nfi\n" +
+		"printf 'username=bot\\npassword=pw\\n'\n"
+	if err := os.WriteFile(script, []byte(body), 0o755); err != nil {
+		t.Fatalf("write helper: %v", err)
+	}
+	h := New(script, time.Hour, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	ctx := context.Background()
+	const fast, slow = "https://fast.example.com/a/b.git", "https://slow.example.com/a/b.git"
+	header, err := h.AuthHeader(ctx, fast)
+	if err != nil {
+		t.Fatalf("auth header: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Go(func() {
+			if _, err := h.AuthHeader(ctx, slow); err != nil {
+				t.Errorf("slow auth header: %v", err)
+			}
+		})
+	}
+	for strings.Count(calls(t, log), "get") < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The hanging get holds up neither other hosts nor reports
+	done := make(chan struct{})
+	go func() {
+		h.AuthHeader(ctx, fast)
+		h.Report(ctx, fast, header, true)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a slow helper run blocked another host")
+	}
+
+	os.WriteFile(release, nil, 0o600)
+	wg.Wait()
+	if got := calls(t, log); strings.Count(got, "get") != 2 || strings.Count(got, "store") != 1 {
+		t.Fatalf("expected concurrent gets to share one run, got:\n%s", got)
+	}
+
+	// The caller's context stops a hanging helper
+	os.Remove(release)
+	t.Cleanup(func() { os.WriteFile(release, nil, 0o600) })
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := New(script, time.Hour, slog.New(slog.NewTextHandler(io.Discard, nil))).AuthHeader(ctx, slow); err == nil || time.Since(start) > 5*time.Second {
+		t.Fatalf("expected the helper to be stopped by the context, got %v after %v", err, time.Since(start))
+	}
+}
@@ -0,0 +1,265 @@
+// Package githubapp mints GitHub App installation tokens, used to
+// authenticate upstream syncs without a long-lived personal access token.
+package githubapp
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// refreshBefore is how long before expiry an installation token is
+	// replaced, so syncs never start with a token about to expire.
+	refreshBefore = 5 * time.Minute
+	// jwtLifetime stays under the 10 minutes GitHub accepts for app JWTs.
+	jwtLifetime = 9 * time.Minute
+	// notInstalledTTL is how long an owner the app is not installed on is
+	// remembered, so its syncs don't each ask the API again.
+	notInstalledTTL = 5 * time.Minute
+)
+
+// Client mints and caches installation tokens of a GitHub App.
+type Client struct {
+	appID         int64
+	key           *rsa.PrivateKey
+	apiURL        string
+	installations map[string]int64 // configured installation per lowercased owner
+	http          *http.Client
+	log           *slog.Logger
+
+	group singleflight.Group // API calls, so concurrent syncs share one lookup or mint
+
+	mu           sync.Mutex
+	discovered   map[string]int64     // installation per lowercased owner, looked up from the API
+	notInstalled map[string]time.Time // lowercased owners the API has no installation for, until when
+	tokens       map[int64]token
+}
+
+type token struct {
+	value     string
+	expiresAt time.Time
+}
+
+// New returns a client for app appID, signing its requests with the RSA
+// private key in keyFile (PEM, PKCS#1 or PKCS#8). apiURL is the REST API
+// root, e.g. https://api.github.com or https://ghe.example.com/api/v3.
+// Owners missing from installations have their installation looked up.
+func New(appID int64, keyFile, apiURL string, installations map[string]int64, log *slog.Logger) (*Client, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read github app key: %w", err)
+	}
+	key, err := parseKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("github app key %s: %w", keyFile, err)
+	}
+	c := &Client{
+		appID:         appID,
+		key:           key,
+		apiURL:        strings.TrimSuffix(apiURL, "/"),
+		installations: make(map[string]int64, len(installations)),
+		http:          &http.Client{Timeout: 30 * time.Second},
+		log:           log,
+		discovered:    make(map[string]int64),
+		notInstalled:  make(map[string]time.Time),
+		tokens:        make(map[int64]token),
+	}
+	for owner, id := range installations {
+		c.installations[strings.ToLower(owner)] = id
+	}
+	return c, nil
+}
+
+func parseKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+	return key, nil
+}
+
+// Token returns an installation token for the installation covering
+// owner/repo, minting a new one when the cached token is close to expiry.
+// The API is called without holding the cache lock, so one slow call only
+// delays the syncs waiting for the same installation.
+func (c *Client) Token(ctx context.Context, owner, repo string) (string, error) {
+	id, err := c.installation(ctx, owner, repo)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	t, ok := c.tokens[id]
+	c.mu.Unlock()
+	if ok && time.Until(t.expiresAt) > refreshBefore {
+		return t.value, nil
+	}
+
+	v, err, _ := c.group.Do("token:"+strconv.FormatInt(id, 10), func() (any, error) {
+		// A flight that just ended may have minted it
+		c.mu.Lock()
+		t, ok := c.tokens[id]
+		c.mu.Unlock()
+		if ok && time.Until(t.expiresAt) > refreshBefore {
+			return t.value, nil
+		}
+		var res struct {
+			Token     string    `json:"token"`
+			ExpiresAt time.Time `json:"expires_at"`
+		}
+		if err := c.call(ctx, http.MethodPost, "/app/installations/"+strconv.FormatInt(id, 10)+"/access_tokens", &res); err != nil {
+			return "", err
+		}
+		if res.Token == "" {
+			return "", fmt.Errorf("github app: no token for installation %d", id)
+		}
+		c.mu.Lock()
+		c.tokens[id] = token{value: res.Token, expiresAt: res.ExpiresAt}
+		c.mu.Unlock()
+		c.log.Info("github app installation token minted", "installation", id, "expires_at", res.ExpiresAt)
+		return res.Token, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return v.(string), nil
+}
+
+// installation returns the installation of the app on owner, from the
+// configuration or, failing that, from the API (cached per owner, including
+// owners the app is not installed on).
+func (c *Client) installation(ctx context.Context, owner, repo string) (int64, error) {
+	key := strings.ToLower(owner)
+	if id, ok := c.installations[key]; ok {
+		return id, nil
+	}
+	c.mu.Lock()
+	id, ok := c.discovered[key]
+	retryAt, missing := c.notInstalled[key]
+	c.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+	if missing && time.Now().Before(retryAt) {
+		return 0, fmt.Errorf("github app: not installed on %s (cached)", owner)
+	}
+
+	v, err, _ := c.group.Do("installation:"+key, func() (any, error) {
+		c.mu.Lock()
+		id, ok := c.discovered[key]
+		c.mu.Unlock()
+		if ok {
+			return id, nil
+		}
+		var res struct {
+			ID int64 `json:"id"`
+		}
+		err := c.call(ctx, http.MethodGet, "/repos/"+url.PathEscape(owner)+"/"+url.PathEscape(repo)+"/installation", &res)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		var se *statusError
+		if errors.As(err, &se) && se.code == http.StatusNotFound {
+			c.notInstalled[key] = time.Now().Add(notInstalledTTL)
+		}
+		if err != nil {
+			return int64(0), err
+		}
+		delete(c.notInstalled, key)
+		c.discovered[key] = res.ID
+		return res.ID, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return v.(int64), nil
+}
+
+// statusError is a non-2xx answer of the API.
+type statusError struct {
+	method, path, status string
+	code                 int
+	body                 string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("github app: %s %s: %s: %s", e.method, e.path, e.status, e.body)
+}
+
+// call sends an API request authenticated as the app and decodes the JSON
+// answer into v.
+func (c *Client) call(ctx context.Context, method, path string, v any) error {
+	jwt, err := c.jwt(time.Now())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.apiURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	res, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("github app: %w", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("github app: %s %s: %w", method, path, err)
+	}
+	if res.StatusCode/100 != 2 {
+		return &statusError{method: method, path: path, status: res.Status, code: res.StatusCode, body: strings.TrimSpace(string(body))}
+	}
+	return json.Unmarshal(body, v)
+}
+
+// jwt returns the RS256 JSON Web Token authenticating as the app. It is
+// backdated by a minute to allow for clock drift with GitHub.
+func (c *Client) jwt(now time.Time) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]int64{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(jwtLifetime).Unix(),
+		"iss": c.appID,
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", fmt.Errorf("sign github app jwt: %w", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
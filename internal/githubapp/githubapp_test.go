@@ -0,0 +1,170 @@
+package githubapp
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newStandIn serves the two GitHub API endpoints the client uses, checking
+// the app JWT against key and counting installation lookups. Tokens expire
+// after ttl.
+func newStandIn(t *testing.T, key *rsa.PrivateKey, ttl time.Duration, minted, lookups *atomic.Int32) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	check := func(w http.ResponseWriter, r *http.Request) bool {
+		jwt, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		parts := strings.Split(jwt, ".")
+		if !ok || len(parts) != 3 {
+			http.Error(w, "missing jwt", http.StatusUnauthorized)
+			return false
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], sig); err != nil {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return false
+		}
+		var claims struct{ Iss, Iat, Exp int64 }
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		if err := json.Unmarshal(payload, &claims); err != nil || claims.Iss != 42 || claims.Exp-claims.Iat > 600 {
+			http.Error(w, "bad claims", http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+	mux.HandleFunc("GET /repos/{owner}/{repo}/installation", func(w http.ResponseWriter, r *http.Request) {
+		if !check(w, r) {
+			return
+		}
+		lookups.Add(1)
+		if r.PathValue("owner") != "acme" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"id": 7}`)
+	})
+	mux.HandleFunc("POST /app/installations/{id}/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		if !check(w, r) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond) // let concurrent callers pile up
+		n := minted.Add(1)
+		json.NewEncoder(w).Encode(map[string]any{
+			"token":      fmt.Sprintf("ghs_%s_%d", r.PathValue("id"), n),
+			"expires_at": time.Now().Add(ttl).UTC().Format(time.RFC3339),
+		})
+	})
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func writeKey(t *testing.T) (*rsa.PrivateKey, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "app.pem")
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(keyFile, pemData, 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	return key, keyFile
+}
+
+func TestTokenCachedUntilCloseToExpiry(t *testing.T) {
+	key, keyFile := writeKey(t)
+	var minted, lookups atomic.Int32
+	ts := newStandIn(t, key, time.Hour, &minted, &lookups)
+	c, err := New(42, keyFile, ts.URL, map[string]int64{"Other": 9}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	ctx := context.Background()
+
+	// Installation looked up from the API, then cached
+	first, err := c.Token(ctx, "acme", "widgets")
+	if err != nil || first != "ghs_7_1" {
+		t.Fatalf("unexpected token %q (%v)", first, err)
+	}
+	if again, _ := c.Token(ctx, "ACME", "gadgets"); again != first || minted.Load() != 1 {
+		t.Fatalf("expected cached token, got %q after %d mints", again, minted.Load())
+	}
+
+	// Configured installation, owners are case-insensitive
+	if other, err := c.Token(ctx, "other", "repo"); err != nil || other != "ghs_9_2" {
+		t.Fatalf("unexpected token %q (%v)", other, err)
+	}
+
+	// A token close to expiry is replaced
+	c.tokens[7] = token{value: first, expiresAt: time.Now().Add(refreshBefore - time.Second)}
+	if renewed, _ := c.Token(ctx, "acme", "widgets"); renewed != "ghs_7_3" {
+		t.Fatalf("expected renewed token, got %q", renewed)
+	}
+
+	// No installation on the owner, remembered
+	if _, err := c.Token(ctx, "nobody", "repo"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("expected 404 error, got %v", err)
+	}
+	if _, err := c.Token(ctx, "nobody", "other"); err == nil || lookups.Load() != 2 {
+		t.Fatalf("expected a cached lookup failure, got %v after %d lookups", err, lookups.Load())
+	}
+}
+
+func TestConcurrentTokensShareCalls(t *testing.T) {
+	key, keyFile := writeKey(t)
+	var minted, lookups atomic.Int32
+	ts := newStandIn(t, key, time.Hour, &minted, &lookups)
+	c, err := New(42, keyFile, ts.URL, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if token, err := c.Token(context.Background(), "acme", "widgets"); err != nil || token != "ghs_7_1" {
+				t.Errorf("unexpected token %q (%v)", token, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if minted.Load() != 1 || lookups.Load() != 1 {
+		t.Fatalf("expected one lookup and one mint, got %d and %d", lookups.Load(), minted.Load())
+	}
+}
+
+func TestWrongKeyRejected(t *testing.T) {
+	key, _ := writeKey(t)
+	_, otherKeyFile := writeKey(t)
+	var minted, lookups atomic.Int32
+	ts := newStandIn(t, key, time.Hour, &minted, &lookups)
+	c, err := New(42, otherKeyFile, ts.URL, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	if _, err := c.Token(context.Background(), "acme", "widgets"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expected 401 error, got %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package gitproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+// apiPrefix starts JSON API URLs: /api/<host>/<owner>/<repo>/<operation>.
+const apiPrefix = "/api/"
+
+// splitAPIPath splits the part of an API URL after apiPrefix into the repo
+// path and the operation, applying route aliases first.
+func (s *Server) splitAPIPath(rest string) (repoPath, op string, ok bool) {
+	parts := strings.SplitN(s.resolveRoute(rest), "/", 4)
+	if len(parts) < 4 || parts[3] == "" {
+		return "", "", false
+	}
+	return strings.Join(parts[:3], "/"), parts[3], true
+}
+
+// serveAPI answers read-only questions about the refs and commits of the
+// mirror:
+//
+//	GET /api/<repo>/refs?prefix=refs/tags/      list refs
+//	GET /api/<repo>/resolve?ref=main            resolve a ref to a commit
+//	GET /api/<repo>/is-ancestor?commit=X&ref=Y  whether X is an ancestor of Y
+//	GET /api/<repo>/commits/<rev>               commit metadata
+func (s *Server) serveAPI(w http.ResponseWriter, r *http.Request, repoRelPath *mirror.RepoRelPath, repoPath string, received time.Time) error {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return nil
+	}
+	_, op, _ := s.splitAPIPath(strings.TrimPrefix(r.URL.Path, apiPrefix))
+	q := r.URL.Query()
+
+	var answer func() (any, error)
+	switch {
+	case op == "refs":
+		answer = func() (any, error) { return s.mirror.ListRefs(r.Context(), repoPath, q.Get("prefix")) }
+	case op == "resolve":
+		answer = func() (any, error) {
+			sha, err := s.mirror.ResolveRef(r.Context(), repoPath, q.Get("ref"))
+			return map[string]string{"ref": q.Get("ref"), "sha": sha}, err
+		}
+	case op == "is-ancestor":
+		answer = func() (any, error) {
+			ok, err := s.mirror.IsAncestor(r.Context(), repoPath, q.Get("commit"), q.Get("ref"))
+			return map[string]any{"commit": q.Get("commit"), "ref": q.Get("ref"), "ancestor": ok}, err
+		}
+	case strings.HasPrefix(op, "commits/"):
+		answer = func() (any, error) { return s.mirror.Commit(r.Context(), repoPath, strings.TrimPrefix(op, "commits/")) }
+	default:
+		writeJSONError(w, http.StatusNotFound, "unknown operation "+op)
+		return nil
+	}
+
+	v, err := answer()
+	if errors.Is(err, mirror.ErrUnknownRevision) && s.cfg.SyncMissingWants {
+		// The ref or commit may have been pushed since the last sync
+		s.syncForWants(r, repoRelPath, "missing", received)
+		v, err = answer()
+	}
+	if errors.Is(err, mirror.ErrUnknownRevision) {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return nil
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "lookup failed")
+		return err
+	}
+	writeJSON(w, http.StatusOK, v)
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"message": message})
+}
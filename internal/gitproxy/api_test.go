@@ -0,0 +1,74 @@
+package gitproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+func TestRefsAPI(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+
+	root := t.TempDir()
+	upstream := filepath.Join(root, "upstream")
+	makeUpstreamRepo(t, upstream)
+	mustRun(t, upstream, "git", "tag", "-a", "v1.0.0", "-m", "release", "HEAD~1")
+	mustRun(t, upstream, "git", "tag", "v1.1.0")
+	out, _ := exec.Command("git", "-C", upstream, "rev-parse", "dev", "dev~1").Output()
+	shas := strings.Fields(string(out))
+	head, first := shas[0], shas[1]
+
+	srv, m := newTestServer(t, filepath.Join(root, "mirrors"))
+	srv.cfg.EnableAPI = true
+	seedMirror(t, m, upstream, "github.com/acme/widgets")
+	ts := newHTTPTestServer(t, srv)
+
+	get := func(path string, v any) int {
+		t.Helper()
+		res, err := http.Get(ts.URL + "/api/github.com/acme/widgets/" + path)
+		if err != nil {
+			t.Fatalf("get %s: %v", path, err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+				t.Fatalf("decode %s: %v", path, err)
+			}
+		}
+		return res.StatusCode
+	}
+
+	var refs []mirror.Ref
+	if get("refs?prefix=refs/tags/v1.", &refs); len(refs) != 2 || refs[0].Name != "refs/tags/v1.0.0" || refs[0].Peeled != first {
+		t.Fatalf("unexpected tags %+v", refs)
+	}
+
+	var resolved map[string]string
+	if get("resolve?ref=v1.0.0", &resolved); resolved["sha"] != first {
+		t.Fatalf("unexpected resolve answer %v", resolved)
+	}
+	if status := get("resolve?ref=nope", &resolved); status != http.StatusNotFound {
+		t.Fatalf("unknown ref: expected 404, got %d", status)
+	}
+
+	var ancestor map[string]any
+	if get("is-ancestor?commit=v1.0.0&ref=dev", &ancestor); ancestor["ancestor"] != true {
+		t.Fatalf("expected v1.0.0 to be an ancestor of dev: %v", ancestor)
+	}
+	if get("is-ancestor?commit=dev&ref=v1.0.0", &ancestor); ancestor["ancestor"] != false {
+		t.Fatalf("expected dev not to be an ancestor of v1.0.0: %v", ancestor)
+	}
+
+	var commit mirror.CommitInfo
+	get("commits/dev", &commit)
+	if commit.SHA != head || commit.Message != "second" || len(commit.Parents) != 1 || commit.Parents[0] != first || commit.Author.Email != "test@example.com" {
+		t.Fatalf("unexpected commit %+v", commit)
+	}
+}
@@ -0,0 +1,92 @@
+package gitproxy
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+// archivePathRe matches source archive URLs, in both the github.com form
+// (/owner/repo/archive/<ref>.tar.gz) and the codeload form
+// (/owner/repo/tar.gz/<ref>), after the host.
+var archivePathRe = regexp.MustCompile(`^/?(.+?)/(?:archive/(.+)\.(tar\.gz|zip)|(tar\.gz|zip)/(.+))$`)
+
+// parseArchivePath splits an archive URL path into the repo path, the
+// requested ref or commit, and the archive format.
+func parseArchivePath(p string) (repoPath, rev, format string, ok bool) {
+	m := archivePathRe.FindStringSubmatch(p)
+	if m == nil {
+		return "", "", "", false
+	}
+	if m[2] != "" {
+		return m[1], m[2], m[3], true
+	}
+	return m[1], m[5], m[4], true
+}
+
+// archivePrefix returns the top-level directory GitHub uses in archives of
+// rev: the repo name, then the ref without refs/heads/ or refs/tags/ (and
+// without the v of version tags), with slashes replaced by dashes.
+func archivePrefix(repoRelPath *mirror.RepoRelPath, rev string) string {
+	name := strings.TrimPrefix(rev, "refs/heads/")
+	if tag, ok := strings.CutPrefix(rev, "refs/tags/"); ok {
+		name = tag
+		if len(tag) > 1 && tag[0] == 'v' && tag[1] >= '0' && tag[1] <= '9' {
+			name = tag[1:]
+		}
+	}
+	repo := repoRelPath.Repo[len(repoRelPath.Repo)-1]
+	return repo + "-" + strings.ReplaceAll(name, "/", "-")
+}
+
+// serveArchive serves a tarball or zipball of a ref or commit of the mirror.
+func (s *Server) serveArchive(w http.ResponseWriter, r *http.Request, repoRelPath *mirror.RepoRelPath, repoPath string, received time.Time) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+	_, rev, format, _ := parseArchivePath(r.URL.Path)
+	prefix := archivePrefix(repoRelPath, rev)
+
+	path, commit, err := s.mirror.Archive(r.Context(), repoPath, rev, format, prefix)
+	if errors.Is(err, mirror.ErrUnknownRevision) && s.cfg.SyncMissingWants {
+		// The ref or commit may have been pushed since the last sync
+		s.syncForWants(r, repoRelPath, "missing", received)
+		path, commit, err = s.mirror.Archive(r.Context(), repoPath, rev, format, prefix)
+	}
+	if errors.Is(err, mirror.ErrUnknownRevision) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		http.Error(w, "archive failed", http.StatusInternalServerError)
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "archive unavailable", http.StatusInternalServerError)
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "archive unavailable", http.StatusInternalServerError)
+		return err
+	}
+
+	contentType := "application/x-gzip"
+	if format == "zip" {
+		contentType = "application/zip"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "attachment; filename="+prefix+"."+format)
+	w.Header().Set("ETag", `"`+commit+`"`)
+	http.ServeContent(w, r, "", info.ModTime(), f)
+	return nil
+}
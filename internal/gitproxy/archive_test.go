@@ -0,0 +1,128 @@
+package gitproxy
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+func TestArchivePrefix(t *testing.T) {
+	repo := &mirror.RepoRelPath{Host: "github.com", Owner: "acme", Repo: []string{"widgets"}}
+	for rev, want := range map[string]string{
+		"refs/tags/v1.2.3":     "widgets-1.2.3",
+		"refs/tags/version":    "widgets-version",
+		"refs/heads/feature/x": "widgets-feature-x",
+		"main":                 "widgets-main",
+	} {
+		if got := archivePrefix(repo, rev); got != want {
+			t.Fatalf("prefix for %s: got %s, want %s", rev, got, want)
+		}
+	}
+}
+
+func TestArchiveFromMirror(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+
+	root := t.TempDir()
+	upstream := filepath.Join(root, "upstream")
+	makeUpstreamRepo(t, upstream)
+	mustRun(t, upstream, "git", "tag", "v1.0.0")
+
+	srv, m := newTestServer(t, filepath.Join(root, "mirrors"))
+	srv.cfg.EnableArchive = true
+	seedMirror(t, m, upstream, "github.com/acme/widgets")
+	ts := newHTTPTestServer(t, srv)
+
+	get := func(path string) (*http.Response, []byte) {
+		t.Helper()
+		res, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("get %s: %v", path, err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res, body
+	}
+
+	for i := 0; i < 2; i++ {
+		res, body := get("/github.com/acme/widgets/archive/refs/tags/v1.0.0.tar.gz")
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("tarball: expected 200, got %d: %s", res.StatusCode, body)
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("gzip: %v", err)
+		}
+		if !tarContains(t, tar.NewReader(gz), "widgets-1.0.0/file.txt") {
+			t.Fatalf("tarball is missing widgets-1.0.0/file.txt")
+		}
+	}
+	if matches, _ := filepath.Glob(filepath.Join(m.Root(), ".archives", "*", "*.tar.gz")); len(matches) != 1 {
+		t.Fatalf("expected one cached tarball, got %v", matches)
+	}
+
+	res, body := get("/github.com/acme/widgets/zip/dev")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("zipball: expected 200, got %d: %s", res.StatusCode, body)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("zip: %v", err)
+	}
+	found := false
+	for _, f := range zr.File {
+		found = found || f.Name == "widgets-dev/file.txt"
+	}
+	if !found {
+		t.Fatalf("zipball is missing widgets-dev/file.txt")
+	}
+
+	// A new commit with the same tree gets its own archive, carrying its id
+	mustRun(t, upstream, "git", "commit", "--allow-empty", "-m", "same tree")
+	relPath, _ := mirror.ParseRepoRelPath("github.com/acme/widgets")
+	if err := m.Refresh(context.Background(), relPath, upstream, "", time.Now()); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	head, _ := exec.Command("git", "-C", upstream, "rev-parse", "HEAD").Output()
+	commit := strings.TrimSpace(string(head))
+	res, body = get("/github.com/acme/widgets/zip/dev")
+	if zr, err = zip.NewReader(bytes.NewReader(body), int64(len(body))); err != nil {
+		t.Fatalf("zip: %v", err)
+	}
+	if res.Header.Get("ETag") != `"`+commit+`"` || zr.Comment != commit {
+		t.Fatalf("expected the archive of %s, got ETag %s and comment %q", commit, res.Header.Get("ETag"), zr.Comment)
+	}
+
+	if res, _ := get("/github.com/acme/widgets/tar.gz/does-not-exist"); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("unknown ref: expected 404, got %d", res.StatusCode)
+	}
+}
+
+func tarContains(t *testing.T, tr *tar.Reader, name string) bool {
+	t.Helper()
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return false
+		}
+		if err != nil {
+			t.Fatalf("tar: %v", err)
+		}
+		if hdr.Name == name {
+			return true
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package gitproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+// newGatedUpstream serves the repos under root below /prefix, answering with
+// the status returned by status instead when it isn't 200. Permission checks
+// (upload-pack info/refs requests) are counted in probes.
+func newGatedUpstream(t *testing.T, root string, status func(r *http.Request) int, probes *atomic.Int32) *httptest.Server {
+	t.Helper()
+	backend := newGitHTTPBackend(t, root)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/info/refs") && r.URL.Query().Get("service") == "git-upload-pack" {
+			probes.Add(1)
+		}
+		switch code := status(r); code {
+		case http.StatusOK:
+			backend.ServeHTTP(w, r)
+		case http.StatusUnauthorized:
+			w.Header().Set("WWW-Authenticate", `Basic realm="upstream"`)
+			w.WriteHeader(code)
+		case http.StatusNotFound:
+			// git shows this to the user as "remote: Repository not found."
+			http.Error(w, "Repository not found.", code)
+		default:
+			w.WriteHeader(code)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestAuthDecisionCache(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+
+	root := t.TempDir()
+	repos := filepath.Join(root, "upstream")
+	makeUpstreamRepo(t, filepath.Join(root, "work"))
+	mustRun(t, "", "git", "clone", "--bare", filepath.Join(root, "work"), filepath.Join(repos, "acme", "widgets.git"))
+
+	// Upstream answering each token with a fixed status, git-http-backend for 200
+	var mu sync.Mutex
+	statuses := map[string]int{"Bearer good": http.StatusOK, "Bearer forbidden": http.StatusForbidden, "Bearer gone": http.StatusNotFound}
+	var probes atomic.Int32
+	upstream := newGatedUpstream(t, repos, func(r *http.Request) int {
+		mu.Lock()
+		defer mu.Unlock()
+		if status, ok := statuses[r.Header.Get("Authorization")]; ok {
+			return status
+		}
+		return http.StatusUnauthorized
+	}, &probes)
+
+	srv, m := newTestServer(t, filepath.Join(root, "mirrors"))
+	srv.cfg.AuthMode = "pass-through"
+	srv.cfg.AllowedUpstreams = append(srv.cfg.AllowedUpstreams, "gitea.local")
+	srv.cfg.UpstreamTemplates = map[string]string{"gitea.local": upstream.URL + "/prefix/{owner}/{repo}.git"}
+	m.SetAuthCache(time.Hour, time.Hour)
+	repo, _ := mirror.ParseRepoRelPath("gitea.local/acme/widgets")
+	ensure := func(auth string) error {
+		_, _, err := m.EnsureRepo(context.Background(), repo, srv.upstreamURL(repo), auth)
+		return err
+	}
+
+	// The clone proves the token, later hits don't ask upstream again
+	if err := ensure("Bearer good"); err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	probesAfterClone := probes.Load()
+	if err := ensure("Bearer good"); err != nil || probes.Load() != probesAfterClone {
+		t.Fatalf("expected a cached allow, got %v after %d probes", err, probes.Load()-probesAfterClone)
+	}
+
+	// 403 and 404 deny access and are cached too
+	for _, auth := range []string{"Bearer forbidden", "Bearer gone", "Bearer forbidden", "Bearer gone"} {
+		if err := ensure(auth); !errors.Is(err, mirror.ErrAuthDenied) {
+			t.Fatalf("%s: expected access denied, got %v", auth, err)
+		}
+	}
+	if got := probes.Load() - probesAfterClone; got != 2 {
+		t.Fatalf("expected 2 upstream probes, got %d", got)
+	}
+
+	// Denied clients get a 401 rather than a gateway error
+	ts := newHTTPTestServer(t, srv)
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/gitea.local/acme/widgets.git/info/refs?service=git-upload-pack", nil)
+	req.Header.Set("Authorization", "Bearer forbidden")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("info/refs: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", res.StatusCode)
+	}
+
+	// A sync refused by upstream drops the cached allow
+	mu.Lock()
+	statuses["Bearer good"] = http.StatusForbidden
+	mu.Unlock()
+	m.SetLastSync(repo.String(), time.Time{})
+	if err := ensure("Bearer good"); !errors.Is(err, mirror.ErrAuthDenied) {
+		t.Fatalf("expected access denied after revocation, got %v", err)
+	}
+}
+
+func TestRequireClientAuth(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+
+	root := t.TempDir()
+	repos := filepath.Join(root, "upstream")
+	makeUpstreamRepo(t, filepath.Join(root, "work"))
+	for _, name := range []string{"private", "public"} {
+		mustRun(t, "", "git", "clone", "--bare", filepath.Join(root, "work"), filepath.Join(repos, "acme", name+".git"))
+	}
+
+	// The static token and members see the private repo, anyone sees the public one
+	var probes atomic.Int32
+	upstream := newGatedUpstream(t, repos, func(r *http.Request) int {
+		switch auth := r.Header.Get("Authorization"); {
+		case auth == "Bearer rate-limited":
+			return http.StatusTooManyRequests
+		case strings.Contains(r.URL.Path, "/public.git/"), auth == "Bearer static", auth == "Bearer member":
+			return http.StatusOK
+		case auth == "":
+			return http.StatusUnauthorized
+		}
+		return http.StatusNotFound
+	}, &probes)
+
+	srv, m := newTestServer(t, filepath.Join(root, "mirrors"))
+	srv.cfg.AuthMode = "static"
+	srv.cfg.StaticToken = "static"
+	srv.cfg.RequireClientAuth = true
+	srv.cfg.AllowedUpstreams = append(srv.cfg.AllowedUpstreams, "gitea.local")
+	srv.cfg.UpstreamTemplates = map[string]string{"gitea.local": upstream.URL + "/prefix/{owner}/{repo}.git"}
+	m.SetAuthCache(time.Hour, time.Hour)
+	ts := newHTTPTestServer(t, srv)
+
+	infoRefs := func(repo, auth string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/gitea.local/acme/"+repo+".git/info/refs?service=git-upload-pack", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("info/refs: %v", err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// Cloned with the static token, but not served to clients without access
+	for _, auth := range []string{"", "Bearer outsider"} {
+		if got := infoRefs("private", auth); got != http.StatusUnauthorized {
+			t.Fatalf("private repo with %q: expected 401, got %d", auth, got)
+		}
+	}
+	before := probes.Load()
+	if got := infoRefs("private", ""); got != http.StatusUnauthorized || probes.Load() != before {
+		t.Fatalf("expected a cached denial, got %d after %d probes", got, probes.Load()-before)
+	}
+	if got := infoRefs("private", "Bearer member"); got != http.StatusOK {
+		t.Fatalf("private repo with member credential: expected 200, got %d", got)
+	}
+	if got := infoRefs("public", ""); got != http.StatusOK {
+		t.Fatalf("public repo without credential: expected 200, got %d", got)
+	}
+	// Upstream not answering is no reason to serve a private repo
+	if got := infoRefs("private", "Bearer rate-limited"); got == http.StatusOK {
+		t.Fatalf("private repo with an unchecked credential: expected an error, got %d", got)
+	}
+}
+
+func TestJoinedCloneChecksOwnCredential(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+
+	root := t.TempDir()
+	repos := filepath.Join(root, "upstream")
+	makeUpstreamRepo(t, filepath.Join(root, "work"))
+	mustRun(t, "", "git", "clone", "--bare", filepath.Join(root, "work"), filepath.Join(repos, "acme", "widgets.git"))
+
+	// The member's clone is held upstream until an outsider has joined it
+	started, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	var probes atomic.Int32
+	upstream := newGatedUpstream(t, repos, func(r *http.Request) int {
+		if r.Header.Get("Authorization") != "Bearer member" {
+			return http.StatusNotFound
+		}
+		once.Do(func() {
+			close(started)
+			<-release
+		})
+		return http.StatusOK
+	}, &probes)
+
+	srv, m := newTestServer(t, filepath.Join(root, "mirrors"))
+	srv.cfg.AuthMode = "pass-through"
+	srv.cfg.AllowedUpstreams = append(srv.cfg.AllowedUpstreams, "gitea.local")
+	srv.cfg.UpstreamTemplates = map[string]string{"gitea.local": upstream.URL + "/prefix/{owner}/{repo}.git"}
+	repo, _ := mirror.ParseRepoRelPath("gitea.local/acme/widgets")
+	ensure := func(auth string, errs chan<- error) {
+		_, _, err := m.EnsureRepo(context.Background(), repo, srv.upstreamURL(repo), auth)
+		errs <- err
+	}
+
+	member, outsider := make(chan error, 1), make(chan error, 1)
+	go ensure("Bearer member", member)
+	<-started
+	go ensure("Bearer outsider", outsider)
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	if err := <-member; err != nil {
+		t.Fatalf("member clone: %v", err)
+	}
+	if err := <-outsider; !errors.Is(err, mirror.ErrAuthDenied) {
+		t.Fatalf("outsider joining the clone: expected access denied, got %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package gitproxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+// bundlePath is the URL suffix, after the repo path, serving its clone bundle.
+const bundlePath = "/info/bundle"
+
+// hasBundle reports whether a clone bundle can be advertised for repoRelPath.
+func (s *Server) hasBundle(repoRelPath *mirror.RepoRelPath) bool {
+	if s.cfg.BundleInterval <= 0 {
+		return false
+	}
+	_, _, ok := s.mirror.Bundle(repoRelPath)
+	return ok
+}
+
+// advertiseBundleURI adds the bundle-uri capability to a protocol v2
+// capability advertisement held in buf.
+func advertiseBundleURI(buf *bytes.Buffer) {
+	if !bytes.HasSuffix(buf.Bytes(), pktFlush) {
+		return
+	}
+	buf.Truncate(buf.Len() - len(pktFlush))
+	_ = writePktLine(buf, "bundle-uri\n")
+	buf.Write(pktFlush)
+}
+
+// peekCommand returns the protocol v2 command of a request, without consuming it.
+func peekCommand(br *bufio.Reader) string {
+	hdr, err := br.Peek(4)
+	if err != nil {
+		return ""
+	}
+	n, err := strconv.ParseUint(string(hdr), 16, 16)
+	if err != nil || n <= 4 {
+		return ""
+	}
+	line, err := br.Peek(int(n))
+	if err != nil {
+		return ""
+	}
+	command, _ := strings.CutPrefix(strings.TrimSuffix(string(line[4:]), "\n"), "command=")
+	return command
+}
+
+// serveBundleURIs answers a protocol v2 bundle-uri command with the clone
+// bundle of the mirror, if there is one.
+func (s *Server) serveBundleURIs(out io.Writer, r *http.Request, repoRelPath *mirror.RepoRelPath) error {
+	var buf bytes.Buffer
+	if s.hasBundle(repoRelPath) {
+		_ = writePktLine(&buf, "bundle.version=1\n")
+		_ = writePktLine(&buf, "bundle.mode=all\n")
+		_ = writePktLine(&buf, "bundle.mirror.uri="+externalBaseURL(r)+"/"+repoRelPath.String()+".git"+bundlePath+"\n")
+	}
+	buf.Write(pktFlush)
+	_, err := out.Write(buf.Bytes())
+	return err
+}
+
+// serveBundle serves the clone bundle of the mirror, with range support so
+// interrupted downloads can resume.
+func (s *Server) serveBundle(w http.ResponseWriter, r *http.Request, repoRelPath *mirror.RepoRelPath) error {
+	path, modTime, ok := s.mirror.Bundle(repoRelPath)
+	if !ok {
+		http.NotFound(w, r)
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "bundle unavailable", http.StatusInternalServerError)
+		return err
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/x-git-bundle")
+	http.ServeContent(w, r, "", modTime, f)
+	return nil
+}
@@ -0,0 +1,172 @@
+package gitproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+func TestBundleURI(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+
+	root := t.TempDir()
+	upstream := filepath.Join(root, "upstream")
+	makeUpstreamRepo(t, upstream)
+
+	srv, m := newTestServer(t, filepath.Join(root, "mirrors"))
+	srv.cfg.BundleInterval = time.Hour
+	m.SetBundleInterval(time.Hour)
+	seedMirror(t, m, upstream, "github.com/acme/widgets")
+	if err := m.MaintainRepo(context.Background(), "github.com/acme/widgets", false); err != nil {
+		t.Fatalf("maintain: %v", err)
+	}
+	ts := newHTTPTestServer(t, srv)
+	repoURL := ts.URL + "/github.com/acme/widgets.git"
+
+	// Capability is advertised to protocol v2 clients
+	req, _ := http.NewRequest(http.MethodGet, repoURL+"/info/refs?service=git-upload-pack", nil)
+	req.Header.Set("Git-Protocol", "version=2")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("info/refs: %v", err)
+	}
+	caps, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if !bytes.Contains(caps, []byte("bundle-uri\n")) {
+		t.Fatalf("bundle-uri not advertised:\n%s", caps)
+	}
+
+	// bundle-uri command lists the bundle
+	var body bytes.Buffer
+	body.Write(pktLine("command=bundle-uri\n"))
+	body.Write(pktLine("object-format=sha1\n"))
+	body.Write([]byte("0001"))
+	body.Write(pktFlush)
+	req, _ = http.NewRequest(http.MethodPost, repoURL+"/git-upload-pack", &body)
+	req.Header.Set("Git-Protocol", "version=2")
+	req.Header.Set("Content-Type", uploadPackRequest)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("bundle-uri: %v", err)
+	}
+	list, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	bundleURL := repoURL + bundlePath
+	if !bytes.Contains(list, []byte("bundle.mirror.uri="+bundleURL+"\n")) {
+		t.Fatalf("unexpected bundle list:\n%s", list)
+	}
+
+	// Bundle download supports ranges
+	req, _ = http.NewRequest(http.MethodGet, bundleURL, nil)
+	req.Header.Set("Range", "bytes=0-15")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("get bundle: %v", err)
+	}
+	head, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent || !strings.HasPrefix(string(head), "# v2 git bundle") {
+		t.Fatalf("unexpected bundle range response %d: %q", res.StatusCode, head)
+	}
+
+	// Clients can bootstrap a clone from it
+	cloneDir := filepath.Join(root, "clone")
+	cmd := exec.Command("git", "clone", "--bundle-uri="+bundleURL, repoURL, cloneDir)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_SYSTEM=/dev/null")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("clone with bundle failed: %v\n%s", err, out)
+	}
+}
+
+func TestBundleRefreshedAfterSync(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+
+	root := t.TempDir()
+	upstream := filepath.Join(root, "upstream")
+	makeUpstreamRepo(t, upstream)
+
+	_, m := newTestServer(t, filepath.Join(root, "mirrors"))
+	m.SetBundleInterval(time.Hour)
+	seedMirror(t, m, upstream, "github.com/acme/widgets")
+	if err := m.MaintainRepo(context.Background(), "github.com/acme/widgets", false); err != nil {
+		t.Fatalf("maintain: %v", err)
+	}
+	repoRelPath, _ := mirror.ParseRepoRelPath("github.com/acme/widgets")
+	path, _, ok := m.Bundle(repoRelPath)
+	if !ok {
+		t.Fatal("expected a bundle after maintenance")
+	}
+	modTime := func() time.Time {
+		t.Helper()
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("stat bundle: %v", err)
+		}
+		return info.ModTime()
+	}
+	refresh := func() {
+		t.Helper()
+		if err := m.Refresh(context.Background(), repoRelPath, upstream, "", time.Now()); err != nil {
+			t.Fatalf("refresh: %v", err)
+		}
+		m.Wait()
+	}
+
+	// A bundle younger than the interval is kept
+	fresh := modTime()
+	refresh()
+	if !modTime().Equal(fresh) {
+		t.Fatal("bundle rewritten before the interval")
+	}
+
+	// An older one is rewritten after the sync, without maintenance
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(path, old, old)
+	refresh()
+	if !modTime().After(old.Add(time.Hour)) {
+		t.Fatal("stale bundle not refreshed after a sync")
+	}
+}
+
+func TestBundleRefreshedPeriodically(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+
+	root := t.TempDir()
+	upstream := filepath.Join(root, "upstream")
+	makeUpstreamRepo(t, upstream)
+
+	_, m := newTestServer(t, filepath.Join(root, "mirrors"))
+	seedMirror(t, m, upstream, "github.com/acme/widgets")
+	m.SetBundleInterval(200 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	m.StartBundleRefresh(ctx)
+
+	// Neither a sync nor maintenance writes this one
+	repoRelPath, _ := mirror.ParseRepoRelPath("github.com/acme/widgets")
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, _, ok := m.Bundle(repoRelPath); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("bundle not written by the periodic refresh")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
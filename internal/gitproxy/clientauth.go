@@ -0,0 +1,72 @@
+package gitproxy
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/crohr/smart-git-proxy/internal/clientauth"
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+// SetClientAuth requires HTTP clients to authenticate to the proxy with a
+// Proxy-Authorization credential accepted by auth.
+func (s *Server) SetClientAuth(auth clientauth.Authenticator) {
+	s.clientAuth = auth
+}
+
+// authenticateClient returns the identity of the client of r, nil if client
+// authentication is disabled. Without a valid proxy credential it answers
+// 407 and returns ok=false. Requests intercepted from a CONNECT tunnel carry
+// the identity the tunnel was opened with.
+func (s *Server) authenticateClient(w http.ResponseWriter, r *http.Request) (id *clientauth.Identity, ok bool) {
+	if s.clientAuth == nil {
+		return nil, true
+	}
+	if id, ok := clientauth.FromContext(r.Context()); ok {
+		return id, true
+	}
+	token, err := clientauth.Token(r)
+	if err == nil {
+		id, err = s.clientAuth.Authenticate(r.Context(), token)
+	}
+	if err != nil {
+		result := "invalid"
+		if errors.Is(err, clientauth.ErrNoCredentials) {
+			result = "missing"
+		}
+		s.metrics.ClientAuth.WithLabelValues("", result).Inc()
+		s.log.Warn("client authentication failed", "err", err, "remote", r.RemoteAddr, "method", r.Method, "path", r.URL.Path)
+		w.Header().Set("Proxy-Authenticate", `Basic realm="smart-git-proxy"`)
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		return nil, false
+	}
+	s.metrics.ClientAuth.WithLabelValues(id.Method, "ok").Inc()
+	s.log.Debug("client authenticated", "auth_method", id.Method, "subject", id.Subject, "remote", r.RemoteAddr)
+	return id, true
+}
+
+// authorizeClient restricts token clients to the repos of the owner named by
+// their CLIENT_OWNER_CLAIM claim, e.g. repository_owner for GitHub Actions.
+// API keys are not restricted. On refusal it answers 403 and returns false.
+func (s *Server) authorizeClient(w http.ResponseWriter, id *clientauth.Identity, repoRelPath *mirror.RepoRelPath) bool {
+	if id == nil || id.Claims == nil || s.cfg.ClientOwnerClaim == "" {
+		return true
+	}
+	if owner := id.Claim(s.cfg.ClientOwnerClaim); owner != "" && strings.EqualFold(owner, repoRelPath.Owner) {
+		return true
+	}
+	s.metrics.ClientAuth.WithLabelValues(id.Method, "forbidden").Inc()
+	s.log.Warn("client not allowed on repo", "auth_method", id.Method, "subject", id.Subject, "repo", repoRelPath.String(), "claim", s.cfg.ClientOwnerClaim, "value", id.Claim(s.cfg.ClientOwnerClaim))
+	http.Error(w, "forbidden: "+s.cfg.ClientOwnerClaim+" does not match "+repoRelPath.Owner, http.StatusForbidden)
+	return false
+}
+
+// clientSubject describes the authenticated client of r for logs, "" if
+// client authentication is disabled.
+func clientSubject(r *http.Request) string {
+	if id, ok := clientauth.FromContext(r.Context()); ok {
+		return id.Method + ":" + id.Subject
+	}
+	return ""
+}
@@ -0,0 +1,80 @@
+package gitproxy
+
+import (
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/clientauth"
+)
+
+func TestClientAuth(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+
+	root := t.TempDir()
+	upstream := filepath.Join(root, "upstream")
+	makeUpstreamRepo(t, upstream)
+	keysFile := filepath.Join(root, "keys")
+	if err := os.WriteFile(keysFile, []byte("runners k3y\n"), 0o600); err != nil {
+		t.Fatalf("write keys: %v", err)
+	}
+	keys, err := clientauth.LoadAPIKeys(keysFile)
+	if err != nil {
+		t.Fatalf("load keys: %v", err)
+	}
+	signer := clientauth.NewHMAC([]byte("s3cret"), time.Hour)
+
+	srv, m := newTestServer(t, filepath.Join(root, "mirrors"))
+	srv.cfg.ClientOwnerClaim = "repository_owner"
+	srv.SetClientAuth(clientauth.Chain{keys, signer})
+	seedMirror(t, m, upstream, "github.com/acme/widgets")
+	ts := newHTTPTestServer(t, srv)
+	proxyURL := ts.URL + "/github.com/acme/widgets.git"
+
+	infoRefs := func(proxyAuth string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, proxyURL+"/info/refs?service=git-upload-pack", nil)
+		if proxyAuth != "" {
+			req.Header.Set("Proxy-Authorization", proxyAuth)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("info/refs: %v", err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	mint := func(owner string) string {
+		token, err := signer.Mint("deploy", time.Minute, map[string]any{"repository_owner": owner})
+		if err != nil {
+			t.Fatalf("mint: %v", err)
+		}
+		return "Bearer " + token
+	}
+
+	for auth, want := range map[string]int{
+		"":             http.StatusProxyAuthRequired,
+		"Bearer wrong": http.StatusProxyAuthRequired,
+		"Bearer k3y":   http.StatusOK,
+		mint("ACME"):   http.StatusOK,
+		mint("other"):  http.StatusForbidden,
+	} {
+		if got := infoRefs(auth); got != want {
+			t.Errorf("%q: expected %d, got %d", auth, want, got)
+		}
+	}
+
+	// git sends the key with an extra header
+	cmd := exec.Command("git", "-c", "http.extraHeader=Proxy-Authorization: Bearer k3y", "ls-remote", proxyURL)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_SYSTEM=/dev/null")
+	out, err := cmd.CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "refs/heads/dev") {
+		t.Fatalf("ls-remote failed: %v\n%s", err, out)
+	}
+}
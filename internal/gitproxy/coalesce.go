@@ -0,0 +1,183 @@
+package gitproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+// sharedRun is an upload-pack run whose output is spooled to a file so that
+// every client sending the same request can stream it, each at its own pace.
+type sharedRun struct {
+	path    string
+	file    *os.File
+	cancel  context.CancelFunc
+	clients int // guarded by Server.inflightMu
+
+	mu     sync.Mutex
+	size   int64
+	done   bool
+	err    error
+	notify chan struct{} // closed and replaced whenever size or done change
+}
+
+// Write appends upload-pack output to the spool and wakes up readers.
+func (run *sharedRun) Write(p []byte) (int, error) {
+	n, err := run.file.Write(p)
+	run.mu.Lock()
+	run.size += int64(n)
+	close(run.notify)
+	run.notify = make(chan struct{})
+	run.mu.Unlock()
+	return n, err
+}
+
+func (run *sharedRun) finish(err error) {
+	run.mu.Lock()
+	run.done = true
+	run.err = err
+	close(run.notify)
+	run.notify = make(chan struct{})
+	run.mu.Unlock()
+}
+
+// stream copies the spool from f to out as it grows, until the run is done.
+func (run *sharedRun) stream(ctx context.Context, f *os.File, out io.Writer) error {
+	buf := make([]byte, 32*1024)
+	var off int64
+	for {
+		run.mu.Lock()
+		size, done, runErr, notify := run.size, run.done, run.err, run.notify
+		run.mu.Unlock()
+
+		for off < size {
+			n, err := f.ReadAt(buf[:min(int64(len(buf)), size-off)], off)
+			if n > 0 {
+				if _, err := out.Write(buf[:n]); err != nil {
+					return err
+				}
+				off += int64(n)
+			}
+			if err != nil && err != io.EOF {
+				return err
+			}
+		}
+		if done {
+			return runErr
+		}
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// serveCoalesced serves an upload-pack request through a shared run, starting
+// one if no identical request is in flight for the repo. The run outlives the
+// client that started it and is only cancelled once every client is gone.
+func (s *Server) serveCoalesced(ctx context.Context, out io.Writer, repoRelPath *mirror.RepoRelPath, repoPath, gitProtocol string, request, key []byte, entry *mirror.PackCacheEntry) error {
+	repoKey := repoRelPath.String()
+	runKey := repoKey + "\x00" + string(key)
+
+	s.inflightMu.Lock()
+	run, joined := s.inflight[runKey]
+	if !joined {
+		var err error
+		if run, err = s.startSharedRun(ctx, runKey, repoRelPath, repoPath, gitProtocol, request, entry); err != nil {
+			s.inflightMu.Unlock()
+			s.log.Warn("upload-pack spool failed", "repo", repoKey, "err", err)
+			return s.runUploadPackLocked(ctx, repoRelPath, repoPath, gitProtocol, bytes.NewReader(request), out, entry)
+		}
+		s.inflight[runKey] = run
+	}
+	// Open the spool while holding the lock: the run only removes it after
+	// leaving the inflight map.
+	f, err := os.Open(run.path)
+	if err != nil {
+		if !joined {
+			s.releaseSharedRun(runKey, run)
+		}
+		s.inflightMu.Unlock()
+		return err
+	}
+	run.clients++
+	s.inflightMu.Unlock()
+	defer f.Close()
+
+	role := "leader"
+	if joined {
+		role = "follower"
+		s.log.Debug("joined in-flight upload-pack", "repo", repoKey)
+	}
+	s.metrics.UploadPackCoalesced.WithLabelValues(repoKey, role).Inc()
+
+	err = run.stream(ctx, f, out)
+
+	s.inflightMu.Lock()
+	run.clients--
+	if run.clients == 0 {
+		s.releaseSharedRun(runKey, run)
+	}
+	s.inflightMu.Unlock()
+	return err
+}
+
+// startSharedRun starts upload-pack for request in the background, spooling
+// its output. The caller must hold inflightMu.
+func (s *Server) startSharedRun(ctx context.Context, runKey string, repoRelPath *mirror.RepoRelPath, repoPath, gitProtocol string, request []byte, entry *mirror.PackCacheEntry) (*sharedRun, error) {
+	spool, err := s.mirror.CreatePackCacheTemp()
+	if err != nil {
+		return nil, err
+	}
+	runCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	run := &sharedRun{
+		path:   spool.Name(),
+		file:   spool,
+		cancel: cancel,
+		notify: make(chan struct{}),
+	}
+
+	repoKey := repoRelPath.String()
+	if entry != nil {
+		s.metrics.PackCacheTotal.WithLabelValues(repoKey, "miss").Inc()
+	}
+	go func() {
+		defer cancel()
+		err := s.runUploadPackLocked(runCtx, repoRelPath, repoPath, gitProtocol, bytes.NewReader(request), run, nil)
+		closeErr := spool.Close()
+
+		s.inflightMu.Lock()
+		if s.inflight[runKey] == run {
+			delete(s.inflight, runKey)
+		}
+		s.inflightMu.Unlock()
+		run.finish(err)
+
+		// Clients still streaming hold their own descriptor on the spool,
+		// so it can be moved or removed right away.
+		if err == nil && closeErr == nil && entry != nil {
+			if err := s.mirror.CommitPackCache(entry, run.path); err != nil {
+				s.log.Warn("pack cache commit failed", "repo", repoKey, "err", err)
+			} else {
+				s.metrics.PackCacheTotal.WithLabelValues(repoKey, "store").Inc()
+				return
+			}
+		}
+		os.Remove(run.path)
+	}()
+	return run, nil
+}
+
+// releaseSharedRun stops sharing run and cancels it: no client is left to read
+// its output. The caller must hold inflightMu.
+func (s *Server) releaseSharedRun(runKey string, run *sharedRun) {
+	if s.inflight[runKey] == run {
+		delete(s.inflight, runKey)
+	}
+	run.cancel()
+}
@@ -0,0 +1,116 @@
+package gitproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSharedRunStream(t *testing.T) {
+	spool, err := os.CreateTemp(t.TempDir(), "spool-*")
+	if err != nil {
+		t.Fatalf("create spool: %v", err)
+	}
+	run := &sharedRun{path: spool.Name(), file: spool, notify: make(chan struct{})}
+
+	const readers = 3
+	outs := make([]bytes.Buffer, readers)
+	var wg sync.WaitGroup
+	for i := range outs {
+		f, err := os.Open(run.path)
+		if err != nil {
+			t.Fatalf("open spool: %v", err)
+		}
+		defer f.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := run.stream(context.Background(), f, &outs[i]); err != nil {
+				t.Errorf("stream: %v", err)
+			}
+		}()
+	}
+
+	var want bytes.Buffer
+	for i := 0; i < 100; i++ {
+		chunk := bytes.Repeat([]byte{byte('a' + i%26)}, 1000+i)
+		want.Write(chunk)
+		run.Write(chunk)
+	}
+	spool.Close()
+	run.finish(nil)
+	wg.Wait()
+
+	for i := range outs {
+		if !bytes.Equal(outs[i].Bytes(), want.Bytes()) {
+			t.Fatalf("reader %d got %d bytes, want %d", i, outs[i].Len(), want.Len())
+		}
+	}
+}
+
+func TestCoalescedUploadPack(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+
+	root := t.TempDir()
+	upstream := filepath.Join(root, "upstream")
+	makeUpstreamRepo(t, upstream)
+
+	srv, m := newTestServer(t, filepath.Join(root, "mirrors"))
+	srv.cfg.CoalesceUploadPack = true
+	seedMirror(t, m, upstream, "github.com/acme/widgets")
+	ts := newHTTPTestServer(t, srv)
+
+	out, err := exec.Command("git", "-C", upstream, "rev-parse", "dev").Output()
+	if err != nil {
+		t.Fatalf("rev-parse: %v", err)
+	}
+	sha := strings.TrimSpace(string(out))
+
+	var body bytes.Buffer
+	body.Write(pktLine("want " + sha + " ofs-delta\n"))
+	body.Write(pktFlush)
+	body.Write(pktLine("done\n"))
+
+	const clients = 8
+	results := make([][]byte, clients)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodPost, ts.URL+"/github.com/acme/widgets.git/git-upload-pack", bytes.NewReader(body.Bytes()))
+			req.Header.Set("Content-Type", uploadPackRequest)
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Errorf("post: %v", err)
+				return
+			}
+			defer res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("expected 200, got %d", res.StatusCode)
+			}
+			results[i], _ = io.ReadAll(res.Body)
+		}()
+	}
+	wg.Wait()
+
+	for i, data := range results {
+		if !bytes.Contains(data, []byte("PACK")) {
+			t.Fatalf("client %d: response does not contain a pack: %q", i, data)
+		}
+	}
+	srv.inflightMu.Lock()
+	defer srv.inflightMu.Unlock()
+	if len(srv.inflight) != 0 {
+		t.Fatalf("expected no run left in flight, got %d", len(srv.inflight))
+	}
+}
@@ -0,0 +1,226 @@
+package gitproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/clientauth"
+	"github.com/crohr/smart-git-proxy/internal/tlsconfig"
+)
+
+// connectDialTimeout bounds how long tunnels take to reach their target.
+const connectDialTimeout = 10 * time.Second
+
+// SetConnectCA enables CONNECT (https_proxy) support: tunnels to allowed
+// upstreams are intercepted with certificates minted by minter.
+func (s *Server) SetConnectCA(minter *tlsconfig.Minter) {
+	s.connectCA = minter
+}
+
+// WithConnect handles CONNECT requests if SetConnectCA was called, and passes
+// everything else to next.
+func (s *Server) WithConnect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if s.connectCA == nil {
+			http.Error(w, "CONNECT not enabled", http.StatusMethodNotAllowed)
+			return
+		}
+		// Tunnels are authenticated once, when they are opened
+		id, ok := s.authenticateClient(w, r)
+		if !ok {
+			return
+		}
+		s.handleConnect(w, r, id)
+	})
+}
+
+// handleConnect terminates TLS for allowed upstreams on port 443 so git
+// requests can be served from the mirrors, and blindly tunnels everything
+// else, including other ports of allowed upstreams (e.g. SSH on port 22), as
+// long as the port is in CONNECT_ALLOWED_PORTS.
+func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request, id *clientauth.Identity) {
+	target := r.Host
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		host, port, target = target, "443", net.JoinHostPort(target, "443")
+	}
+	intercept := port == "443" && slices.Contains(s.cfg.AllowedUpstreams, host)
+
+	if !intercept && !slices.Contains(s.cfg.ConnectAllowedPorts, port) {
+		s.log.Warn("connect port not allowed", "target", target, "remote", r.RemoteAddr)
+		http.Error(w, "forbidden: port "+port+" not allowed", http.StatusForbidden)
+		return
+	}
+
+	var upstream net.Conn
+	if !intercept {
+		if upstream, err = net.DialTimeout("tcp", target, connectDialTimeout); err != nil {
+			s.log.Warn("connect dial failed", "target", target, "err", err)
+			http.Error(w, "connect failed", http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		s.log.Error("connect hijack failed", "target", target, "err", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+	client := &bufferedConn{Conn: conn, r: brw.Reader}
+	s.log.Debug("connect", "target", target, "intercept", intercept, "remote", r.RemoteAddr)
+
+	if !intercept {
+		tunnel(client, upstream)
+		return
+	}
+	s.serveIntercepted(client, host, target, id)
+}
+
+// serveIntercepted serves HTTP on a client connection after terminating TLS
+// for host. Upload-pack requests go to the mirror handler, anything else is
+// forwarded to target as is. id is the client that opened the tunnel.
+func (s *Server) serveIntercepted(conn net.Conn, host, target string, id *clientauth.Identity) {
+	tlsConn := tls.Server(conn, &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return s.connectCA.Certificate(host)
+		},
+	})
+
+	forward := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = "https"
+			pr.Out.URL.Host = target
+			pr.Out.Host = pr.In.Host
+		},
+		Transport: s.upstream.Transport,
+		ErrorLog:  log.New(io.Discard, "", 0),
+	}
+	mirrors := s.Handler()
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isUploadPackRequest(r) {
+				r.URL.Path = "/" + host + r.URL.Path
+				r.URL.RawPath = ""
+				mirrors.ServeHTTP(w, r)
+				return
+			}
+			forward.ServeHTTP(w, r)
+		}),
+		ReadHeaderTimeout: 30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		ErrorLog:          log.New(io.Discard, "", 0),
+	}
+	if id != nil {
+		srv.BaseContext = func(net.Listener) context.Context {
+			return clientauth.WithIdentity(context.Background(), id)
+		}
+	}
+	_ = srv.Serve(newConnListener(tlsConn))
+}
+
+// isUploadPackRequest reports whether r is a smart HTTP fetch request that
+// the mirrors can answer.
+func isUploadPackRequest(r *http.Request) bool {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/info/refs"):
+		return r.URL.Query().Get("service") == "git-upload-pack"
+	case strings.HasSuffix(r.URL.Path, "/git-upload-pack"):
+		return r.Method == http.MethodPost
+	}
+	return false
+}
+
+// tunnel copies data both ways between a and b until either side is done.
+func tunnel(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	cp := func(dst, src net.Conn) {
+		_, _ = io.Copy(dst, src)
+		if c, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = c.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	<-done
+	<-done
+}
+
+// bufferedConn reads through the bufio.Reader left over by Hijack, which may
+// already hold the start of the client's TLS handshake.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// connListener is a net.Listener returning a single connection, then
+// blocking until that connection is closed, so http.Server.Serve returns
+// once the client is done.
+type connListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	l := &connListener{closed: make(chan struct{})}
+	l.conn = &closeNotifyConn{Conn: conn, closed: l.closed}
+	return l
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() { conn = l.conn })
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *connListener) Close() error   { return nil }
+func (l *connListener) Addr() net.Addr { return l.conn.LocalAddr() }
+
+type closeNotifyConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *closeNotifyConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { close(c.closed) })
+	return err
+}
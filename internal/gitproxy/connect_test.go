@@ -0,0 +1,155 @@
+package gitproxy
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/tlsconfig"
+)
+
+// writeTestCA writes a self-signed CA certificate and key to dir.
+func writeTestCA(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test interception ca"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create CA: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certFile, keyFile = filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+func newConnectTestServer(t *testing.T, root string) (*Server, *httptest.Server, string) {
+	t.Helper()
+	srv, m := newTestServer(t, filepath.Join(root, "mirrors"))
+	upstream := filepath.Join(root, "upstream")
+	makeUpstreamRepo(t, upstream)
+	seedMirror(t, m, upstream, "github.com/acme/widgets")
+
+	caFile, keyFile := writeTestCA(t, root)
+	minter, err := tlsconfig.NewMinter(caFile, keyFile)
+	if err != nil {
+		t.Fatalf("new minter: %v", err)
+	}
+	srv.SetConnectCA(minter)
+	ts := httptest.NewServer(srv.WithConnect(srv.Handler()))
+	t.Cleanup(ts.Close)
+	return srv, ts, caFile
+}
+
+func TestConnectInterceptsAllowedUpstream(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	root := t.TempDir()
+	_, ts, caFile := newConnectTestServer(t, root)
+	// GIT_SSL_CAINFO takes precedence over http.sslCAInfo
+	t.Setenv("GIT_SSL_CAINFO", "")
+	os.Unsetenv("GIT_SSL_CAINFO")
+
+	// github.com is never reached: the fetch is answered from the seeded mirror
+	clientDir := filepath.Join(root, "client")
+	mustRun(t, "", "git", "init", clientDir)
+	cmd := exec.Command("git", "-c", "http.proxy="+ts.URL, "-c", "http.sslCAInfo="+caFile,
+		"fetch", "https://github.com/acme/widgets.git", "dev")
+	cmd.Dir = clientDir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_SYSTEM=/dev/null")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("fetch through CONNECT failed: %v\n%s", err, out)
+	}
+	mustRun(t, clientDir, "git", "cat-file", "-e", "FETCH_HEAD")
+}
+
+func TestConnectTunnelsOtherHosts(t *testing.T) {
+	root := t.TempDir()
+	srv, ts, _ := newConnectTestServer(t, root)
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	connect := func() (*bufio.Reader, net.Conn, int) {
+		t.Helper()
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("dial proxy: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		io.WriteString(conn, "CONNECT "+echo.Addr().String()+" HTTP/1.1\r\nHost: "+echo.Addr().String()+"\r\n\r\n")
+		br := bufio.NewReader(conn)
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("read CONNECT response: %v", err)
+		}
+		return br, conn, res.StatusCode
+	}
+	ping := func() {
+		t.Helper()
+		br, conn, status := connect()
+		if status != http.StatusOK {
+			t.Fatalf("expected 200, got %d", status)
+		}
+		io.WriteString(conn, "ping")
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("tunnel echo: %q, %v", buf, err)
+		}
+	}
+	// The echo server's port is not one of the allowed ones
+	if _, _, status := connect(); status != http.StatusForbidden {
+		t.Fatalf("expected 403 for a port not allowed, got %d", status)
+	}
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	srv.cfg.ConnectAllowedPorts = append(srv.cfg.ConnectAllowedPorts, port)
+	ping()
+
+	// Only port 443 of an allowed upstream is intercepted, other ports such
+	// as SSH are tunneled as is
+	srv.cfg.AllowedUpstreams = append(srv.cfg.AllowedUpstreams, "127.0.0.1")
+	ping()
+}
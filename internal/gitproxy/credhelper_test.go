@@ -0,0 +1,96 @@
+package gitproxy
+
+import (
+	"encoding/base64"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/credhelper"
+)
+
+func TestCredentialHelperErasesRefusedCredential(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+
+	root := t.TempDir()
+	repos := filepath.Join(root, "upstream")
+	makeUpstreamRepo(t, filepath.Join(root, "work"))
+	mustRun(t, "", "git", "clone", "--bare", filepath.Join(root, "work"), filepath.Join(repos, "acme", "widgets.git"))
+
+	good := "Basic " + base64.StdEncoding.EncodeToString([]byte("bot:good"))
+	var probes atomic.Int32
+	upstream := newGatedUpstream(t, repos, func(r *http.Request) int {
+		if strings.Contains(r.URL.Path, "/missing.git/") {
+			return http.StatusNotFound
+		}
+		if r.Header.Get("Authorization") == good {
+			return http.StatusOK
+		}
+		return http.StatusUnauthorized
+	}, &probes)
+
+	// The helper hands out whatever password is in a file, as a secrets
+	// manager would after a rotation
+	secret, calls := filepath.Join(root, "secret"), filepath.Join(root, "calls")
+	script := filepath.Join(root, "git-credential-test")
+	body := "#!/bin/sh\necho \"$1\" >> " + calls + "\ncat > /dev/null\n" +
+		"[ \"$1\" = get ] && printf 'username=bot\\npassword=%s\\n' \"$(cat " + secret + ")\"\nexit 0\n"
+	if err := os.WriteFile(script, []byte(body), 0o755); err != nil {
+		t.Fatalf("write helper: %v", err)
+	}
+	if err := os.WriteFile(secret, []byte("stale"), 0o600); err != nil {
+		t.Fatalf("write secret: %v", err)
+	}
+
+	srv, m := newTestServer(t, filepath.Join(root, "mirrors"))
+	srv.cfg.AuthMode = "credential-helper"
+	srv.cfg.AllowedUpstreams = append(srv.cfg.AllowedUpstreams, "gitea.local")
+	srv.cfg.UpstreamTemplates = map[string]string{"gitea.local": upstream.URL + "/prefix/{owner}/{repo}.git"}
+	helper := credhelper.New(script, time.Hour, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	srv.SetCredentialHelper(helper)
+	m.SetCredentialHook(helper.Report)
+	ts := newHTTPTestServer(t, srv)
+
+	infoRefs := func(repo string) int {
+		t.Helper()
+		res, err := http.Get(ts.URL + "/gitea.local/acme/" + repo + ".git/info/refs?service=git-upload-pack")
+		if err != nil {
+			t.Fatalf("info/refs: %v", err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if code := infoRefs("widgets"); code == http.StatusOK {
+		t.Fatal("expected the stale credential to fail")
+	}
+	if err := os.WriteFile(secret, []byte("good"), 0o600); err != nil {
+		t.Fatalf("write secret: %v", err)
+	}
+	if code := infoRefs("widgets"); code != http.StatusOK {
+		t.Fatalf("expected the rotated credential to work, got %d", code)
+	}
+	data, _ := os.ReadFile(calls)
+	if got := strings.Fields(string(data)); strings.Join(got, " ") != "get erase get store" {
+		t.Fatalf("unexpected helper calls %v", got)
+	}
+
+	// Anyone can ask for a repo that doesn't exist, that must not erase the
+	// credential from the helper
+	if code := infoRefs("missing"); code == http.StatusOK {
+		t.Fatal("expected the missing repo to fail")
+	}
+	data, _ = os.ReadFile(calls)
+	if got := strings.Fields(string(data)); strings.Join(got, " ") != "get erase get store" {
+		t.Fatalf("a 404 changed the helper calls: %v", got)
+	}
+}
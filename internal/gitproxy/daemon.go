@@ -0,0 +1,121 @@
+package gitproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// daemonRequestTimeout bounds how long a git:// client may take to send its
+// request line.
+const daemonRequestTimeout = 30 * time.Second
+
+// ServeGitDaemon serves upload-pack over the git:// protocol on ln, from the
+// same mirrors as the HTTP handler. It returns when ln is closed.
+func (s *Server) ServeGitDaemon(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.handleDaemonConn(conn)
+	}
+}
+
+func (s *Server) handleDaemonConn(conn net.Conn) {
+	defer conn.Close()
+	start := time.Now()
+	remote := conn.RemoteAddr().String()
+
+	_ = conn.SetReadDeadline(time.Now().Add(daemonRequestTimeout))
+	service, repoArg, gitProtocol, err := readDaemonRequest(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		s.log.Debug("invalid git daemon request", "remote", remote, "err", err)
+		return
+	}
+	if service != "git-upload-pack" {
+		_ = writePktLine(conn, "ERR service not enabled: "+service)
+		return
+	}
+	repoRelPath, err := s.parseRepo(repoArg)
+	if err != nil {
+		s.log.Error("resolve target failed", "err", err, "path", repoArg, "transport", "git")
+		_ = writePktLine(conn, "ERR "+err.Error())
+		return
+	}
+
+	repoKey := repoRelPath.String()
+	kind := KindUploadPack
+	s.metrics.RequestsTotal.WithLabelValues(repoKey, string(kind), remote).Inc()
+	if d := s.checkPolicy(repoRelPath); !d.Allowed {
+		_ = writePktLine(conn, "ERR forbidden: "+d.Reason)
+		return
+	}
+
+	// git:// is unauthenticated, there is no client token to pass through
+	// (nor to check private repos against with REQUIRE_CLIENT_AUTH)
+	ctx := context.Background()
+	authHeader := s.upstreamAuth(ctx, repoRelPath, "")
+	repoPath, status, err := s.mirror.EnsureRepoAs(ctx, repoRelPath, s.upstreamURL(repoRelPath), authHeader, s.accessAuth(authHeader, ""))
+	if err != nil {
+		s.metrics.ErrorsTotal.WithLabelValues(repoKey, string(kind)).Inc()
+		s.log.Error("request failed", "err", err, "repo", repoKey, "kind", kind, "transport", "git")
+		_ = writePktLine(conn, "ERR "+err.Error())
+		return
+	}
+	s.log.Info("request", "repo", repoKey, "kind", kind, "status", status, "transport", "git")
+
+	if err := s.runUploadPackDuplex(ctx, repoPath, repoKey, gitProtocol, conn); err != nil {
+		s.metrics.ErrorsTotal.WithLabelValues(repoKey, string(kind)).Inc()
+		s.log.Error("serve failed", "err", err, "repo", repoKey, "kind", kind, "transport", "git", "duration_ms", time.Since(start).Milliseconds())
+		return
+	}
+	s.metrics.UpstreamLatency.WithLabelValues(repoKey, string(kind)).Observe(time.Since(start).Seconds())
+	s.log.Debug("request complete", "repo", repoKey, "kind", kind, "transport", "git", "total_duration_ms", time.Since(start).Milliseconds())
+}
+
+// readDaemonRequest reads the initial git:// request pkt-line:
+//
+//	git-upload-pack /path\0host=example.com\0\0version=2\0
+//
+// and returns the service, the repo path, and the extra parameters joined the
+// way GIT_PROTOCOL expects them.
+func readDaemonRequest(r io.Reader) (service, repoPath, gitProtocol string, err error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", "", "", err
+	}
+	n, err := strconv.ParseUint(string(hdr[:]), 16, 16)
+	if err != nil || n <= 4 {
+		return "", "", "", fmt.Errorf("invalid pkt-line length %q", hdr[:])
+	}
+	payload := make([]byte, n-4)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return "", "", "", err
+	}
+
+	command, params, _ := strings.Cut(strings.TrimSuffix(string(payload), "\n"), "\x00")
+	service, repoPath, ok := strings.Cut(command, " ")
+	if !ok || repoPath == "" {
+		return "", "", "", fmt.Errorf("invalid request %q", command)
+	}
+
+	// The host parameter comes first, extra parameters follow an empty one
+	_, extra, _ := strings.Cut(params, "\x00")
+	var extraParams []string
+	for _, p := range strings.Split(extra, "\x00") {
+		if p != "" {
+			extraParams = append(extraParams, p)
+		}
+	}
+	return service, repoPath, strings.Join(extraParams, ":"), nil
+}
@@ -0,0 +1,77 @@
+package gitproxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadDaemonRequest(t *testing.T) {
+	tests := []struct {
+		payload, service, path, protocol string
+	}{
+		{payload: "git-upload-pack /github.com/acme/widgets.git\x00host=proxy:9418\x00", service: "git-upload-pack", path: "/github.com/acme/widgets.git"},
+		{payload: "git-upload-pack /github.com/acme/widgets.git\x00host=proxy\x00\x00version=2\x00", service: "git-upload-pack", path: "/github.com/acme/widgets.git", protocol: "version=2"},
+		{payload: "git-receive-pack /github.com/acme/widgets.git\x00", service: "git-receive-pack", path: "/github.com/acme/widgets.git"},
+	}
+	for _, tt := range tests {
+		service, path, protocol, err := readDaemonRequest(bytes.NewReader(pktLine(tt.payload)))
+		if err != nil || service != tt.service || path != tt.path || protocol != tt.protocol {
+			t.Errorf("%q: got (%q, %q, %q, %v)", tt.payload, service, path, protocol, err)
+		}
+	}
+	if _, _, _, err := readDaemonRequest(bytes.NewReader(pktLine("git-upload-pack\x00"))); err == nil {
+		t.Errorf("expected error for request without path")
+	}
+}
+
+func TestGitDaemonUploadPack(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+
+	root := t.TempDir()
+	upstream := filepath.Join(root, "upstream")
+	makeUpstreamRepo(t, upstream)
+
+	srv, m := newTestServer(t, filepath.Join(root, "mirrors"))
+	seedMirror(t, m, upstream, "github.com/acme/widgets")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go srv.ServeGitDaemon(ln)
+
+	baseURL := fmt.Sprintf("git://%s", ln.Addr())
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_SYSTEM=/dev/null")
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+
+	for _, version := range []string{"0", "2"} {
+		out, err := git("-c", "protocol.version="+version, "ls-remote", baseURL+"/github.com/acme/widgets.git")
+		if err != nil {
+			t.Fatalf("ls-remote v%s failed: %v\n%s", version, err, out)
+		}
+		if !strings.Contains(out, "refs/heads/dev") {
+			t.Fatalf("ls-remote v%s output missing refs/heads/dev:\n%s", version, out)
+		}
+	}
+	if out, err := git("clone", baseURL+"/github.com/acme/widgets.git", filepath.Join(root, "clone")); err != nil {
+		t.Fatalf("clone failed: %v\n%s", err, out)
+	}
+
+	out, err := git("ls-remote", baseURL+"/example.com/acme/widgets.git")
+	if err == nil || !strings.Contains(out, "not in allowed list") {
+		t.Fatalf("expected disallowed host to be refused, got %v:\n%s", err, out)
+	}
+}
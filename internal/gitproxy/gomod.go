@@ -0,0 +1,140 @@
+package gitproxy
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+// goModPrefix starts Go module proxy URLs, so clients can use
+// GOPROXY=https://<proxy>/gomod.
+const goModPrefix = "/gomod/"
+
+// goModInfo is the answer to .info and @latest requests.
+type goModInfo struct {
+	Version string
+	Time    time.Time
+}
+
+// parseGoModPath splits the part of a module proxy URL after goModPrefix into
+// the module, its repo path (the first three elements of the module path),
+// and the requested file: "list", "@latest", or "<version>.info|.mod|.zip".
+func parseGoModPath(rest string) (mod mirror.GoModule, repoPath, file string, ok bool) {
+	escaped, file, ok := strings.Cut(rest, "/@v/")
+	if !ok {
+		if escaped, ok = strings.CutSuffix(rest, "/@latest"); !ok {
+			return mirror.GoModule{}, "", "", false
+		}
+		file = "@latest"
+	}
+	modPath, err := module.UnescapePath(escaped)
+	if err != nil || file == "" {
+		return mirror.GoModule{}, "", "", false
+	}
+	prefix, pathMajor, ok := module.SplitPathVersion(modPath)
+	parts := strings.SplitN(prefix, "/", 4)
+	if !ok || len(parts) < 3 {
+		return mirror.GoModule{}, "", "", false
+	}
+	mod = mirror.GoModule{Path: modPath, PathMajor: pathMajor}
+	if len(parts) == 4 {
+		mod.Dir = parts[3]
+	}
+	return mod, strings.Join(parts[:3], "/"), file, true
+}
+
+// serveGoMod implements the GOPROXY protocol for modules stored in the mirror:
+//
+//	GET /gomod/<module>/@v/list               versions, from semver tags
+//	GET /gomod/<module>/@v/<version>.info     version and commit time
+//	GET /gomod/<module>/@v/<version>.mod      go.mod file
+//	GET /gomod/<module>/@v/<version>.zip      module zip
+//	GET /gomod/<module>/@latest               latest version info
+//
+// Unknown modules and versions answer 404, so the go command falls back to
+// the next entry of GOPROXY.
+func (s *Server) serveGoMod(w http.ResponseWriter, r *http.Request, repoRelPath *mirror.RepoRelPath, repoPath string, received time.Time) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+	mod, _, file, _ := parseGoModPath(strings.TrimPrefix(r.URL.Path, goModPrefix))
+
+	if file == "list" {
+		versions, err := s.mirror.GoVersions(r.Context(), repoPath, mod)
+		if err != nil {
+			http.Error(w, "version list failed", http.StatusInternalServerError)
+			return err
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, v := range versions {
+			_, _ = w.Write([]byte(v + "\n"))
+		}
+		return nil
+	}
+
+	query, ext := "latest", ".info"
+	if file != "@latest" {
+		for _, suffix := range []string{".info", ".mod", ".zip"} {
+			if v, ok := strings.CutSuffix(file, suffix); ok {
+				query, ext = v, suffix
+				break
+			}
+		}
+		v, err := module.UnescapeVersion(query)
+		if err != nil || query == file {
+			http.Error(w, "not found", http.StatusNotFound)
+			return nil
+		}
+		query = v
+	}
+
+	version, commit, t, err := s.mirror.GoResolve(r.Context(), repoPath, mod, query)
+	if errors.Is(err, mirror.ErrUnknownRevision) && query != "latest" && s.cfg.SyncMissingWants {
+		// The tag may have been pushed since the last sync
+		s.syncForWants(r, repoRelPath, "missing", received)
+		version, commit, t, err = s.mirror.GoResolve(r.Context(), repoPath, mod, query)
+	}
+	if errors.Is(err, mirror.ErrUnknownRevision) {
+		http.Error(w, "not found: "+mod.Path+"@"+query, http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		http.Error(w, "version lookup failed", http.StatusInternalServerError)
+		return err
+	}
+
+	switch ext {
+	case ".info":
+		writeJSON(w, http.StatusOK, goModInfo{Version: version, Time: t})
+	case ".mod":
+		data, err := s.mirror.GoMod(r.Context(), repoPath, mod, commit)
+		if err != nil {
+			http.Error(w, "go.mod unavailable", http.StatusInternalServerError)
+			return err
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write(data)
+	case ".zip":
+		path, err := s.mirror.GoZip(r.Context(), repoPath, mod, version, commit)
+		if err != nil {
+			http.Error(w, "module zip failed", http.StatusInternalServerError)
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			http.Error(w, "module zip unavailable", http.StatusInternalServerError)
+			return err
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/zip")
+		http.ServeContent(w, r, "", t, f)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package gitproxy
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestGoModuleProxy(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+
+	root := t.TempDir()
+	upstream := filepath.Join(root, "upstream")
+	makeUpstreamRepo(t, upstream)
+	mustRun(t, upstream, "sh", "-c", "printf 'module github.com/acme/widgets\\n\\ngo 1.21\\n' > go.mod && printf 'package widgets\\n' > widgets.go")
+	mustRun(t, upstream, "sh", "-c", "mkdir tools && printf 'module github.com/acme/widgets/tools\\n' > tools/go.mod && printf 'package tools\\n' > tools/tools.go")
+	mustRun(t, upstream, "git", "add", ".")
+	mustRun(t, upstream, "git", "commit", "-m", "modules")
+	mustRun(t, upstream, "git", "tag", "v1.0.0")
+	mustRun(t, upstream, "git", "tag", "tools/v0.1.0")
+	mustRun(t, upstream, "git", "tag", "v1.1.0-rc.1")
+	mustRun(t, upstream, "git", "tag", "not-a-version")
+
+	srv, m := newTestServer(t, filepath.Join(root, "mirrors"))
+	srv.cfg.EnableGoProxy = true
+	seedMirror(t, m, upstream, "github.com/acme/widgets")
+	ts := newHTTPTestServer(t, srv)
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		res, err := http.Get(ts.URL + "/gomod/" + path)
+		if err != nil {
+			t.Fatalf("get %s: %v", path, err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	if _, body := get("github.com/acme/widgets/@v/list"); body != "v1.0.0\nv1.1.0-rc.1\n" {
+		t.Fatalf("unexpected version list %q", body)
+	}
+	if _, body := get("github.com/acme/widgets/tools/@v/list"); body != "v0.1.0\n" {
+		t.Fatalf("unexpected tools version list %q", body)
+	}
+	var info goModInfo
+	_, body := get("github.com/acme/widgets/@latest")
+	if err := json.Unmarshal([]byte(body), &info); err != nil || info.Version != "v1.0.0" || info.Time.IsZero() {
+		t.Fatalf("unexpected latest info %q (%v)", body, err)
+	}
+	if _, body := get("github.com/acme/widgets/@v/v1.0.0.mod"); body != "module github.com/acme/widgets\n\ngo 1.21\n" {
+		t.Fatalf("unexpected go.mod %q", body)
+	}
+	if status, _ := get("github.com/acme/widgets/@v/v9.0.0.info"); status != http.StatusNotFound {
+		t.Fatalf("unknown version: expected 404, got %d", status)
+	}
+	if status, _ := get("example.com/acme/widgets/@v/list"); status != http.StatusNotFound {
+		t.Fatalf("disallowed host: expected 404, got %d", status)
+	}
+
+	// The go command itself verifies the zip layout
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go not found in PATH")
+	}
+	cmd := exec.Command("go", "mod", "download", "-json", "github.com/acme/widgets@v1.0.0", "github.com/acme/widgets/tools@v0.1.0")
+	cmd.Dir = root
+	cmd.Env = append(os.Environ(),
+		"GOPROXY="+ts.URL+"/gomod",
+		"GOSUMDB=off",
+		"GOFLAGS=-mod=mod -modcacherw",
+		"GOTOOLCHAIN=local",
+		"GOPATH="+filepath.Join(root, "gopath"),
+		"GOMODCACHE="+filepath.Join(root, "gopath", "pkg", "mod"),
+	)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("go mod download: %v\n%s", err, out)
+	}
+	dec := json.NewDecoder(bytes.NewReader(out))
+	files := map[string][]string{}
+	for dec.More() {
+		var dl struct{ Path, Zip, Error string }
+		if err := dec.Decode(&dl); err != nil || dl.Error != "" {
+			t.Fatalf("go mod download: %v %s", err, dl.Error)
+		}
+		zr, err := zip.OpenReader(dl.Zip)
+		if err != nil {
+			t.Fatalf("open %s: %v", dl.Zip, err)
+		}
+		for _, f := range zr.File {
+			files[dl.Path] = append(files[dl.Path], f.Name)
+		}
+		zr.Close()
+	}
+	if got := files["github.com/acme/widgets"]; len(got) != 3 {
+		t.Fatalf("unexpected root module files %v", got)
+	}
+	if got := files["github.com/acme/widgets/tools"]; len(got) != 2 {
+		t.Fatalf("unexpected tools module files %v", got)
+	}
+}
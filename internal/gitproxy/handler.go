@@ -1,22 +1,28 @@
 package gitproxy
 
 import (
-	"bytes"
+	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"net/http"
-	"net/http/cgi"
 	"net/url"
-	"os/exec"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"log/slog"
 
+	"github.com/crohr/smart-git-proxy/internal/clientauth"
 	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/credhelper"
+	"github.com/crohr/smart-git-proxy/internal/githubapp"
 	"github.com/crohr/smart-git-proxy/internal/metrics"
 	"github.com/crohr/smart-git-proxy/internal/mirror"
+	"github.com/crohr/smart-git-proxy/internal/policy"
+	"github.com/crohr/smart-git-proxy/internal/tlsconfig"
 )
 
 // Kind represents the type of git request.
@@ -26,18 +32,63 @@ const (
 	KindInfo        Kind = "info"
 	KindUploadPack  Kind = "upload-pack"
 	KindReceivePack Kind = "receive-pack"
+	KindLFSBatch    Kind = "lfs-batch"
+	KindLFSObject   Kind = "lfs-object"
+	KindBundle      Kind = "bundle"
+	KindArchive     Kind = "archive"
+	KindRaw         Kind = "raw"
+	KindAPI         Kind = "api"
+	KindGoMod       Kind = "gomod"
 	KindUnknown     Kind = "unknwon"
 )
 
 type Server struct {
-	cfg     *config.Config
-	mirror  *mirror.Mirror
-	log     *slog.Logger
-	metrics *metrics.Metrics
+	cfg      *config.Config
+	mirror   *mirror.Mirror
+	log      *slog.Logger
+	metrics  *metrics.Metrics
+	upstream *http.Client
+
+	connectCA  *tlsconfig.Minter  // Set when CONNECT tunnels to allowed upstreams are intercepted
+	githubApp  *githubapp.Client  // Mints upstream tokens with AUTH_MODE=github-app
+	credHelper *credhelper.Helper // Gets upstream credentials with AUTH_MODE=credential-helper
+
+	clientAuth clientauth.Authenticator // Set when clients must authenticate to the proxy
+	policy     *policy.Policy           // Set when POLICY_FILE restricts the repos served
+
+	lfsTickets sync.Map // map[ticket]*lfsTicket
+	wantSyncs  sync.Map // map[repoKey]time.Time, start of the last sync forced by missing wants
+
+	inflightMu sync.Mutex
+	inflight   map[string]*sharedRun // keyed by repo and normalized request
 }
 
 func New(cfg *config.Config, m *mirror.Mirror, log *slog.Logger, metrics *metrics.Metrics) *Server {
-	return &Server{cfg: cfg, mirror: m, log: log, metrics: metrics}
+	return &Server{
+		cfg:      cfg,
+		mirror:   m,
+		log:      log,
+		metrics:  metrics,
+		upstream: &http.Client{},
+		inflight: make(map[string]*sharedRun),
+	}
+}
+
+// SetUpstreamTransport sends the requests the proxy forwards itself (pushes
+// and LFS) through rt, e.g. to verify upstreams against UPSTREAM_CA_FILES.
+func (s *Server) SetUpstreamTransport(rt http.RoundTripper) {
+	s.upstream = &http.Client{Transport: rt}
+}
+
+// SetGitHubApp mints upstream tokens with app, for AUTH_MODE=github-app.
+func (s *Server) SetGitHubApp(app *githubapp.Client) {
+	s.githubApp = app
+}
+
+// SetCredentialHelper gets upstream credentials from helper, for
+// AUTH_MODE=credential-helper.
+func (s *Server) SetCredentialHelper(helper *credhelper.Helper) {
+	s.credHelper = helper
 }
 
 func (s *Server) Handler() http.Handler {
@@ -45,79 +96,218 @@ func (s *Server) Handler() http.Handler {
 		start := time.Now()
 		s.log.Debug("incoming request", "method", r.Method, "path", r.URL.Path, "query", r.URL.RawQuery)
 
+		id, ok := s.authenticateClient(w, r)
+		if !ok {
+			return
+		}
+		if id != nil {
+			r = r.WithContext(clientauth.WithIdentity(r.Context(), id))
+		}
+
 		repoRelPath, kind, err := s.resolveTarget(r)
 		if err != nil {
 			s.log.Error("resolve target failed", "err", err, "path", r.URL.Path)
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			status := http.StatusBadRequest
+			if strings.HasPrefix(r.URL.Path, goModPrefix) {
+				// The go command only falls back to the next GOPROXY entry on 404 and 410
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
 			return
 		}
 
-		repoKey := repoRelPath.String()
 		s.log.Debug("resolved target", "repo", repoRelPath.Describe(), "kind", kind)
-		s.metrics.RequestsTotal.WithLabelValues(repoKey, string(kind), r.RemoteAddr).Inc()
+		if d := s.checkPolicy(repoRelPath); !d.Allowed {
+			http.Error(w, "forbidden: "+d.Reason, http.StatusForbidden)
+			return
+		}
+		if !s.authorizeClient(w, id, repoRelPath) {
+			return
+		}
+		s.metrics.RequestsTotal.WithLabelValues(repoRelPath.String(), string(kind), r.RemoteAddr).Inc()
 
 		switch kind {
 		case KindReceivePack:
-			http.Error(w, "write operation is not supported", http.StatusBadRequest)
+			if !s.cfg.EnablePush {
+				http.Error(w, "write operation is not supported", http.StatusBadRequest)
+				return
+			}
+			s.proxyReceivePack(w, r, repoRelPath, start)
+		case KindLFSBatch, KindLFSObject:
+			if !s.cfg.EnableLFS {
+				http.Error(w, "git lfs is not supported", http.StatusNotFound)
+				return
+			}
+			if kind == KindLFSBatch {
+				s.handleLFSBatch(w, r, repoRelPath, start)
+			} else {
+				s.handleLFSObject(w, r, repoRelPath, start)
+			}
+		case KindUnknown:
+			http.Error(w, "only smart HTTP upload-pack is supported", http.StatusNotFound)
+		case KindArchive:
+			if !s.cfg.EnableArchive {
+				http.Error(w, "archives are not enabled", http.StatusNotFound)
+				return
+			}
+			s.handle(w, r, repoRelPath, kind, start)
+		case KindRaw:
+			if !s.cfg.EnableRaw {
+				http.Error(w, "raw files are not enabled", http.StatusNotFound)
+				return
+			}
+			s.handle(w, r, repoRelPath, kind, start)
+		case KindAPI:
+			if !s.cfg.EnableAPI {
+				http.Error(w, "api is not enabled", http.StatusNotFound)
+				return
+			}
+			s.handle(w, r, repoRelPath, kind, start)
+		case KindGoMod:
+			if !s.cfg.EnableGoProxy {
+				http.Error(w, "go module proxy is not enabled", http.StatusNotFound)
+				return
+			}
+			s.handle(w, r, repoRelPath, kind, start)
+		case KindBundle:
+			if s.cfg.BundleInterval <= 0 {
+				http.Error(w, "bundles are not enabled", http.StatusNotFound)
+				return
+			}
+			s.handle(w, r, repoRelPath, kind, start)
 		default:
-			s.handle(w, r, repoRelPath, repoKey, start)
+			s.handle(w, r, repoRelPath, kind, start)
 		}
 	})
 }
 
-func (s *Server) handle(w http.ResponseWriter, r *http.Request, repoRelPath *mirror.RepoRelPath, repoKey string, start time.Time) {
-	// Build upstream URL for cloning/syncing
-	upstreamURL := fmt.Sprintf("https://%s.git", repoRelPath)
+func (s *Server) handle(w http.ResponseWriter, r *http.Request, repoRelPath *mirror.RepoRelPath, kind Kind, start time.Time) {
+	repoKey := repoRelPath.String()
 
-	// Determine auth for upstream sync
-	authHeader := ""
-	switch s.cfg.AuthMode {
-	case "static":
-		// Use configured static token
-		authHeader = "Bearer " + s.cfg.StaticToken
-	case "pass-through":
-		// Use auth from client request
-		authHeader = r.Header.Get("Authorization")
+	// Dumb HTTP clients send info/refs without a service, and only upload-pack is served
+	if kind == KindInfo && r.URL.Query().Get("service") != "git-upload-pack" {
+		http.Error(w, "only smart HTTP upload-pack is supported", http.StatusForbidden)
+		return
+	}
+
+	repoPath, ok := s.ensureRepo(w, r, repoRelPath, kind)
+	if !ok {
+		return
 	}
+
+	// Serve from local mirror
+	serveStart := time.Now()
+	var err error
+	switch kind {
+	case KindInfo:
+		err = s.serveInfoRefs(w, r, repoRelPath, repoPath)
+	case KindUploadPack:
+		err = s.serveUploadPack(w, r, repoRelPath, repoPath)
+	case KindBundle:
+		err = s.serveBundle(w, r, repoRelPath)
+	case KindArchive:
+		err = s.serveArchive(w, r, repoRelPath, repoPath, start)
+	case KindRaw:
+		err = s.serveRaw(w, r, repoRelPath, repoPath, start)
+	case KindAPI:
+		err = s.serveAPI(w, r, repoRelPath, repoPath, start)
+	case KindGoMod:
+		err = s.serveGoMod(w, r, repoRelPath, repoPath, start)
+	}
+	if err != nil {
+		s.metrics.ErrorsTotal.WithLabelValues(repoKey, string(kind)).Inc()
+		s.metrics.ResponsesTotal.WithLabelValues(repoKey, string(kind), "500").Inc()
+		s.log.Error("serve failed", "err", err, "repo", repoKey, "kind", kind, "duration_ms", time.Since(serveStart).Milliseconds())
+		return
+	}
+	s.log.Debug("serve done", "repo", repoKey, "kind", kind, "duration_ms", time.Since(serveStart).Milliseconds())
+
+	s.metrics.ResponsesTotal.WithLabelValues(repoKey, string(kind), "200").Inc()
+	s.metrics.UpstreamLatency.WithLabelValues(repoKey, string(kind)).Observe(time.Since(start).Seconds())
+	s.log.Debug("request complete", "repo", repoKey, "kind", kind, "total_duration_ms", time.Since(start).Milliseconds())
+}
+
+// ensureRepo makes sure the mirror for repoRelPath exists and is fresh.
+// On failure it writes the error response and returns ok=false.
+func (s *Server) ensureRepo(w http.ResponseWriter, r *http.Request, repoRelPath *mirror.RepoRelPath, kind Kind) (repoPath string, ok bool) {
+	repoKey := repoRelPath.String()
+
+	upstreamURL := s.upstreamURL(repoRelPath)
+	authHeader := s.upstreamAuth(r.Context(), repoRelPath, r.Header.Get("Authorization"))
 	s.log.Debug("auth check", "mode", s.cfg.AuthMode, "hasAuth", authHeader != "", "repo", repoKey)
 
 	// Ensure mirror is synced
 	ensureStart := time.Now()
-	repoPath, status, err := s.mirror.EnsureRepo(r.Context(), repoRelPath, upstreamURL, authHeader)
-	if err != nil && authHeader != "" {
-		s.fail(w, repoKey, KindInfo, err)
-		return
+	repoPath, status, err := s.mirror.EnsureRepoAs(r.Context(), repoRelPath, upstreamURL, authHeader, s.accessAuth(authHeader, r.Header.Get("Authorization")))
+	if err != nil && authHeader != "" && !errors.Is(err, mirror.ErrAuthDenied) {
+		s.fail(w, repoKey, kind, err)
+		return "", false
 	} else if err != nil {
 		w.Header().Set("www-authenticate", "Basic realm=\"smart-git-proxy\"")
 		w.WriteHeader(http.StatusUnauthorized)
-		return
+		return "", false
 	}
 	s.log.Debug("ensure repo done", "repo", repoKey, "status", status, "duration_ms", time.Since(ensureStart).Milliseconds())
-	s.log.Info("request", "repo", repoKey, "status", status)
+	s.log.Info("request", "repo", repoKey, "kind", kind, "status", status, "client", clientSubject(r))
+	return repoPath, true
+}
 
-	// Serve refs from local mirror
-	serveStart := time.Now()
-	if path, err := exec.LookPath("git"); err != nil {
-		s.log.Error("setup serve failed", "Failed to find git executable", time.Since(serveStart).Milliseconds())
-	} else {
-		buf := new(bytes.Buffer)
-		handler := &cgi.Handler{
-			Path:   path,
-			Dir:    repoPath,
-			Env:    []string{"GIT_HTTP_EXPORT_ALL=1", fmt.Sprintf("GIT_PROJECT_ROOT=%s", s.mirror.Root())},
-			Args:   []string{"http-backend"},
-			Stderr: buf,
-		}
-		handler.ServeHTTP(w, r)
-		if buf.Len() != 0 {
-			s.log.Info("git http-backend", "stderr", buf.String(), "duration_ms", time.Since(serveStart).Milliseconds())
-		}
-		s.log.Debug("serve done", "repo", repoKey, "duration_ms", time.Since(serveStart).Milliseconds())
-	}
-
-	s.metrics.ResponsesTotal.WithLabelValues(repoKey, string(KindInfo), "200").Inc()
-	s.metrics.UpstreamLatency.WithLabelValues(repoKey, string(KindInfo)).Observe(time.Since(start).Seconds())
-	s.log.Debug("info/refs complete", "repo", repoKey, "total_duration_ms", time.Since(start).Milliseconds())
+// upstreamURL returns the URL used to clone and sync the mirror of repoRelPath,
+// following the UPSTREAM_TEMPLATES entry of its host if there is one.
+func (s *Server) upstreamURL(repoRelPath *mirror.RepoRelPath) string {
+	return s.cfg.UpstreamURL(repoRelPath.Host, repoRelPath.Owner, strings.Join(repoRelPath.Repo, "/"))
+}
+
+// upstreamAuth returns the Authorization header used for upstream syncs of
+// repoRelPath, given the one sent by the client (if any). ctx bounds minting
+// or fetching the proxy's own credential.
+func (s *Server) upstreamAuth(ctx context.Context, repoRelPath *mirror.RepoRelPath, clientAuth string) string {
+	switch s.cfg.AuthMode {
+	case "static":
+		// With a credentials file only listed hosts get a credential: a fallback
+		// to other hosts takes an explicit "*" entry
+		if s.cfg.CredentialsFile != "" || len(s.cfg.Credentials) > 0 {
+			header, _ := s.cfg.UpstreamCredential(repoRelPath.Host, repoRelPath.Owner)
+			return header
+		}
+		if s.cfg.StaticToken == "" {
+			return ""
+		}
+		return "Bearer " + s.cfg.StaticToken
+	case "github-app":
+		// Installation tokens only go to the GitHub they were minted by
+		if !strings.EqualFold(repoRelPath.Host, s.cfg.GitHubAppHost) {
+			return ""
+		}
+		// Installation tokens are sent the way GitHub documents for git over HTTPS
+		token, err := s.githubApp.Token(ctx, repoRelPath.Owner, strings.Join(repoRelPath.Repo, "/"))
+		if err != nil {
+			s.log.Error("github app token failed", "repo", repoRelPath.String(), "err", err)
+			return ""
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte("x-access-token:"+token))
+	case "credential-helper":
+		header, err := s.credHelper.AuthHeader(ctx, s.upstreamURL(repoRelPath))
+		if err != nil {
+			s.log.Error("credential helper failed", "repo", repoRelPath.String(), "err", err)
+			return ""
+		}
+		return header
+	case "pass-through":
+		// Use auth from client request
+		return clientAuth
+	}
+	return ""
+}
+
+// accessAuth returns the credential access to private mirrors is checked
+// with: the client's own with REQUIRE_CLIENT_AUTH, so the proxy's upstream
+// credential doesn't open private repos to every client, else upstreamAuth.
+func (s *Server) accessAuth(upstreamAuth, clientAuth string) string {
+	if s.cfg.RequireClientAuth {
+		return clientAuth
+	}
+	return upstreamAuth
 }
 
 func (s *Server) resolveTarget(r *http.Request) (repoRelPath *mirror.RepoRelPath, kind Kind, err error) {
@@ -133,28 +323,90 @@ func (s *Server) resolveTarget(r *http.Request) (repoRelPath *mirror.RepoRelPath
 		return nil, "", fmt.Errorf("invalid path: %w", err)
 	}
 
+	// Raw files are addressed by prefix, their path may end like anything
+	if rest, ok := strings.CutPrefix(u.Path, rawPrefix); ok {
+		repoPath, _, ok := s.splitRawPath(rest)
+		if !ok {
+			return nil, "", errors.New("invalid raw file path")
+		}
+		repoRelPath, err = s.parseRepo(repoPath)
+		if err != nil {
+			return nil, "", err
+		}
+		return repoRelPath, KindRaw, nil
+	}
+
+	if rest, ok := strings.CutPrefix(u.Path, apiPrefix); ok {
+		repoPath, _, ok := s.splitAPIPath(rest)
+		if !ok {
+			return nil, "", errors.New("invalid api path")
+		}
+		repoRelPath, err = s.parseRepo(repoPath)
+		if err != nil {
+			return nil, "", err
+		}
+		return repoRelPath, KindAPI, nil
+	}
+
+	if rest, ok := strings.CutPrefix(u.Path, goModPrefix); ok {
+		_, repoPath, _, ok := parseGoModPath(rest)
+		if !ok {
+			return nil, "", errors.New("invalid go module path")
+		}
+		repoRelPath, err = s.parseRepo(repoPath)
+		if err != nil {
+			return nil, "", err
+		}
+		return repoRelPath, KindGoMod, nil
+	}
+
 	// Determine kind from suffix
 	switch {
+	case archivePathRe.MatchString(u.Path):
+		kind = KindArchive
+	case strings.HasSuffix(u.Path, "/info/refs") && r.URL.Query().Get("service") == "git-receive-pack":
+		kind = KindReceivePack
 	case strings.HasSuffix(u.Path, "/info/refs"):
 		kind = KindInfo
 	case strings.HasSuffix(u.Path, "/git-upload-pack"):
 		kind = KindUploadPack
 	case strings.HasSuffix(u.Path, "/git-receive-pack"):
 		kind = KindReceivePack
+	case strings.HasSuffix(u.Path, "/info/lfs/objects/batch"):
+		kind = KindLFSBatch
+	case lfsObjectPathRe.MatchString(u.Path):
+		kind = KindLFSObject
+	case strings.HasSuffix(u.Path, bundlePath):
+		kind = KindBundle
 	default:
 		kind = KindUnknown
 	}
 
 	// Remove git endpoint suffix to get repo path
-	re := regexp.MustCompile(`/(HEAD|info/refs|objects/(info/[^/]+|[0-9a-f]{2}/[0-9a-f]{38}|pack/pack-[0-9a-f]{40}\.(pack|idx))|git-(upload|receive)-pack)?$`)
+	re := regexp.MustCompile(`/(HEAD|info/refs|info/bundle|info/lfs/objects/(batch|[0-9a-f]{64})|objects/(info/[^/]+|[0-9a-f]{2}/[0-9a-f]{38}|pack/pack-[0-9a-f]{40}\.(pack|idx))|git-(upload|receive)-pack)?$`)
 	repoPath := strings.TrimPrefix(u.Path, "/")
 	repoPath = re.ReplaceAllLiteralString(repoPath, "")
 	repoPath = strings.TrimSuffix(repoPath, ".git")
+	if kind == KindArchive {
+		repoPath, _, _, _ = parseArchivePath(u.Path)
+	}
 
-	repoRelPath, err = mirror.ParseRepoRelPath(repoPath)
+	repoRelPath, err = s.parseRepo(repoPath)
 	if err != nil {
 		return nil, "", err
 	}
+	return repoRelPath, kind, nil
+}
+
+// parseRepo parses a repo path (host/owner/repo, optionally with a leading
+// slash or a .git suffix) and validates it against the allowed upstreams.
+// Route aliases and the default upstream host are applied first.
+func (s *Server) parseRepo(repoPath string) (*mirror.RepoRelPath, error) {
+	repoPath = strings.TrimSuffix(strings.TrimPrefix(repoPath, "/"), ".git")
+	repoRelPath, err := mirror.ParseRepoRelPath(s.resolveRoute(repoPath))
+	if err != nil {
+		return nil, err
+	}
 
 	// Validate against allowed upstreams
 	allowed := false
@@ -165,10 +417,22 @@ func (s *Server) resolveTarget(r *http.Request) (repoRelPath *mirror.RepoRelPath
 		}
 	}
 	if !allowed {
-		return nil, "", fmt.Errorf("upstream %q not in allowed list", repoRelPath.Host)
+		return nil, fmt.Errorf("upstream %q not in allowed list", repoRelPath.Host)
 	}
+	return repoRelPath, nil
+}
 
-	return repoRelPath, kind, nil
+// resolveRoute rewrites a repo path starting with a route alias, or with no
+// allowed host at all if DEFAULT_UPSTREAM_HOST is set, to its host/owner/repo form.
+func (s *Server) resolveRoute(repoPath string) string {
+	first, rest, _ := strings.Cut(repoPath, "/")
+	if host, ok := s.cfg.RouteAliases[first]; ok {
+		return host + "/" + rest
+	}
+	if s.cfg.DefaultUpstreamHost != "" && !slices.Contains(s.cfg.AllowedUpstreams, first) {
+		return s.cfg.DefaultUpstreamHost + "/" + repoPath
+	}
+	return repoPath
 }
 
 func (s *Server) fail(w http.ResponseWriter, repo string, kind Kind, err error) {
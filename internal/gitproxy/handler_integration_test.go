@@ -1,12 +1,22 @@
 package gitproxy
 
 import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/logging"
+	"github.com/crohr/smart-git-proxy/internal/metrics"
+	"github.com/crohr/smart-git-proxy/internal/mirror"
 )
 
 func makeUpstreamRepo(t *testing.T, path string) {
@@ -57,9 +67,167 @@ func mustRun(t *testing.T, dir string, name string, args ...string) {
 		"GIT_TERMINAL_PROMPT=0",
 		"GIT_CONFIG_GLOBAL=/dev/null",
 		"GIT_CONFIG_SYSTEM=/dev/null",
+		"GIT_AUTHOR_NAME=test",
+		"GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test",
+		"GIT_COMMITTER_EMAIL=test@example.com",
 	)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		t.Fatalf("cmd %s %s failed: %v\n%s", name, strings.Join(args, " "), err, string(out))
 	}
 }
+
+func newTestServer(t *testing.T, mirrorDir string) (*Server, *mirror.Mirror) {
+	t.Helper()
+	cfg := &config.Config{
+		AllowedUpstreams: []string{"github.com"},
+		MirrorDir:        mirrorDir,
+		SyncStaleAfter:   time.Hour,
+		AuthMode:         "none",
+		LogLevel:         "debug",
+	}
+	logger, err := logging.New(cfg.LogLevel)
+	if err != nil {
+		t.Fatalf("logger init: %v", err)
+	}
+	m, err := mirror.New(cfg.MirrorDir, cfg.SyncStaleAfter, config.SizeSpec{}, 0, false, logger)
+	if err != nil {
+		t.Fatalf("mirror init: %v", err)
+	}
+	// Maintenance and sync hooks still writing to the mirror would break the
+	// removal of the test's temp dir
+	t.Cleanup(m.Wait)
+	return New(cfg, m, logger, metrics.NewUnregistered()), m
+}
+
+func newHTTPTestServer(t *testing.T, srv *Server) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(srv.Handler())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// seedMirror creates a fresh mirror of upstream for repoKey, so no upstream sync is attempted.
+func seedMirror(t *testing.T, m *mirror.Mirror, upstream, repoKey string) {
+	t.Helper()
+	mustRun(t, "", "git", "clone", "--mirror", upstream, filepath.Join(m.Root(), repoKey+".git"))
+	m.SetLastSync(repoKey, time.Now())
+}
+
+func TestUploadPackFromLocalMirror(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+
+	root := t.TempDir()
+	upstream := filepath.Join(root, "upstream")
+	makeUpstreamRepo(t, upstream)
+
+	srv, m := newTestServer(t, filepath.Join(root, "mirrors"))
+	seedMirror(t, m, upstream, "github.com/acme/widgets")
+
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+	proxyURL := ts.URL + "/github.com/acme/widgets.git"
+
+	// Protocol v2 fetch
+	doFetch(t, filepath.Join(root, "client"), proxyURL, "dev")
+
+	// Protocol v0 ref advertisement
+	cmd := exec.Command("git", "-c", "protocol.version=0", "ls-remote", proxyURL)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_SYSTEM=/dev/null")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("ls-remote failed: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "refs/heads/dev") {
+		t.Fatalf("ls-remote output missing refs/heads/dev:\n%s", out)
+	}
+}
+
+func TestDumbProtocolRejected(t *testing.T) {
+	srv, _ := newTestServer(t, t.TempDir())
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/github.com/acme/widgets.git/info/refs")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for dumb info/refs, got %d", res.StatusCode)
+	}
+}
+
+func TestUploadPackGzipRequest(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+
+	root := t.TempDir()
+	upstream := filepath.Join(root, "upstream")
+	makeUpstreamRepo(t, upstream)
+
+	srv, m := newTestServer(t, filepath.Join(root, "mirrors"))
+	seedMirror(t, m, upstream, "github.com/acme/widgets")
+
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	out, err := exec.Command("git", "-C", upstream, "rev-parse", "dev").Output()
+	if err != nil {
+		t.Fatalf("rev-parse: %v", err)
+	}
+	sha := strings.TrimSpace(string(out))
+
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	zw.Write(pktLine("want " + sha + " ofs-delta\n"))
+	zw.Write(pktFlush)
+	zw.Write(pktLine("done\n"))
+	zw.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/github.com/acme/widgets.git/git-upload-pack", &body)
+	req.Header.Set("Content-Type", uploadPackRequest)
+	req.Header.Set("Content-Encoding", "gzip")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	defer res.Body.Close()
+	data, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", res.StatusCode, data)
+	}
+	if !bytes.HasPrefix(data, []byte("0008NAK\n")) || !bytes.Contains(data, []byte("PACK")) {
+		t.Fatalf("unexpected upload-pack response: %q", data[:min(len(data), 64)])
+	}
+}
+
+func TestRouteAliases(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+
+	root := t.TempDir()
+	upstream := filepath.Join(root, "upstream")
+	makeUpstreamRepo(t, upstream)
+
+	srv, m := newTestServer(t, filepath.Join(root, "mirrors"))
+	srv.cfg.RouteAliases = map[string]string{"gh": "github.com"}
+	srv.cfg.DefaultUpstreamHost = "github.com"
+	seedMirror(t, m, upstream, "github.com/acme/widgets")
+	ts := newHTTPTestServer(t, srv)
+
+	for _, path := range []string{"/github.com/acme/widgets.git", "/gh/acme/widgets.git", "/acme/widgets"} {
+		doFetch(t, filepath.Join(root, "client"), ts.URL+path, "dev")
+	}
+
+	// Paths starting with an allowed host are left alone
+	srv.cfg.AllowedUpstreams = append(srv.cfg.AllowedUpstreams, "gitlab.com")
+	if got := srv.resolveRoute("gitlab.com/acme/widgets"); got != "gitlab.com/acme/widgets" {
+		t.Fatalf("unexpected route %s", got)
+	}
+}
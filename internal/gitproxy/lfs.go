@@ -0,0 +1,260 @@
+package gitproxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+const (
+	lfsMediaType    = "application/vnd.git-lfs+json"
+	lfsTicketHeader = "X-Smart-Git-Proxy-Lfs-Ticket"
+	// lfsTicketTTL bounds how long a rewritten download action stays valid
+	lfsTicketTTL = time.Hour
+)
+
+var lfsObjectPathRe = regexp.MustCompile(`/info/lfs/objects/[0-9a-f]{64}$`)
+
+type lfsBatchResponse struct {
+	Transfer string          `json:"transfer,omitempty"`
+	Objects  []lfsObject     `json:"objects"`
+	HashAlgo string          `json:"hash_algo,omitempty"`
+	Message  json.RawMessage `json:"message,omitempty"`
+}
+
+type lfsObject struct {
+	OID           string                `json:"oid"`
+	Size          int64                 `json:"size"`
+	Authenticated bool                  `json:"authenticated,omitempty"`
+	Actions       map[string]*lfsAction `json:"actions,omitempty"`
+	Error         json.RawMessage       `json:"error,omitempty"`
+}
+
+type lfsAction struct {
+	Href      string            `json:"href"`
+	Header    map[string]string `json:"header,omitempty"`
+	ExpiresIn int64             `json:"expires_in,omitempty"`
+	ExpiresAt string            `json:"expires_at,omitempty"`
+}
+
+// lfsTicket remembers the upstream download action an LFS client was authorized for.
+type lfsTicket struct {
+	repoKey string
+	oid     string
+	size    int64
+	action  *lfsAction
+	expires time.Time
+}
+
+// handleLFSBatch forwards a batch request upstream (which authorizes the client),
+// then rewrites download actions so objects are fetched through the proxy.
+// Upload and verify actions are left pointing at the upstream.
+func (s *Server) handleLFSBatch(w http.ResponseWriter, r *http.Request, repoRelPath *mirror.RepoRelPath, start time.Time) {
+	repoKey := repoRelPath.String()
+
+	reqBody, err := io.ReadAll(io.LimitReader(r.Body, 10<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var batchReq struct {
+		Operation string `json:"operation"`
+	}
+	if err := json.Unmarshal(reqBody, &batchReq); err != nil {
+		http.Error(w, "invalid batch request", http.StatusBadRequest)
+		return
+	}
+
+	target, err := url.Parse(s.upstreamURL(repoRelPath))
+	if err != nil {
+		s.fail(w, repoKey, KindLFSBatch, fmt.Errorf("invalid upstream url: %w", err))
+		return
+	}
+	target = target.JoinPath("info", "lfs", "objects", "batch")
+
+	outReq, err := http.NewRequestWithContext(r.Context(), http.MethodPost, target.String(), bytes.NewReader(reqBody))
+	if err != nil {
+		s.fail(w, repoKey, KindLFSBatch, err)
+		return
+	}
+	outReq.Header.Set("Accept", lfsMediaType)
+	outReq.Header.Set("Content-Type", lfsMediaType)
+	// The batch answer authorizes downloads, so it is asked with the client's
+	// credential when private repos require one
+	clientAuth := r.Header.Get("Authorization")
+	if authHeader := s.accessAuth(s.upstreamAuth(r.Context(), repoRelPath, clientAuth), clientAuth); authHeader != "" {
+		outReq.Header.Set("Authorization", authHeader)
+	}
+
+	res, err := s.upstream.Do(outReq)
+	if err != nil {
+		s.fail(w, repoKey, KindLFSBatch, fmt.Errorf("upstream lfs batch: %w", err))
+		return
+	}
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		s.fail(w, repoKey, KindLFSBatch, fmt.Errorf("read upstream lfs batch: %w", err))
+		return
+	}
+
+	// Errors, uploads and anything we don't understand are passed through untouched
+	if res.StatusCode == http.StatusOK && batchReq.Operation == "download" {
+		if rewritten, err := s.rewriteLFSDownloads(r, repoRelPath, resBody); err != nil {
+			s.log.Warn("lfs batch rewrite failed, passing through", "repo", repoKey, "err", err)
+		} else {
+			resBody = rewritten
+		}
+	}
+
+	for _, h := range []string{"Content-Type", "Lfs-Authenticate", "Www-Authenticate"} {
+		if v := res.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(resBody)))
+	w.WriteHeader(res.StatusCode)
+	_, _ = w.Write(resBody)
+
+	s.metrics.ResponsesTotal.WithLabelValues(repoKey, string(KindLFSBatch), strconv.Itoa(res.StatusCode)).Inc()
+	s.metrics.UpstreamLatency.WithLabelValues(repoKey, string(KindLFSBatch)).Observe(time.Since(start).Seconds())
+	s.log.Info("request", "repo", repoKey, "kind", KindLFSBatch, "operation", batchReq.Operation, "upstream_status", res.StatusCode, "total_duration_ms", time.Since(start).Milliseconds())
+}
+
+// rewriteLFSDownloads points download actions at the proxy, keeping the
+// upstream actions behind a ticket handed to the client as an action header.
+func (s *Server) rewriteLFSDownloads(r *http.Request, repoRelPath *mirror.RepoRelPath, body []byte) ([]byte, error) {
+	var batch lfsBatchResponse
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return nil, err
+	}
+	if batch.Transfer != "" && batch.Transfer != "basic" {
+		return nil, fmt.Errorf("unsupported transfer %q", batch.Transfer)
+	}
+
+	repoKey := repoRelPath.String()
+	base := externalBaseURL(r) + "/" + repoKey + ".git/info/lfs/objects/"
+	now := time.Now()
+	s.pruneLFSTickets(now)
+
+	for i := range batch.Objects {
+		obj := &batch.Objects[i]
+		download := obj.Actions["download"]
+		if download == nil || !mirror.ValidLFSOID(obj.OID) {
+			continue
+		}
+		ticket, err := newLFSTicketID()
+		if err != nil {
+			return nil, err
+		}
+		expires := now.Add(lfsTicketTTL)
+		if download.ExpiresIn > 0 && now.Add(time.Duration(download.ExpiresIn)*time.Second).Before(expires) {
+			expires = now.Add(time.Duration(download.ExpiresIn) * time.Second)
+		}
+		s.lfsTickets.Store(ticket, &lfsTicket{repoKey: repoKey, oid: obj.OID, size: obj.Size, action: download, expires: expires})
+
+		obj.Actions["download"] = &lfsAction{
+			Href:      base + obj.OID,
+			Header:    map[string]string{lfsTicketHeader: ticket},
+			ExpiresIn: int64(time.Until(expires).Seconds()),
+		}
+	}
+	return json.Marshal(batch)
+}
+
+// handleLFSObject serves an LFS object from the local store, fetching it from
+// the upstream download action on first use.
+func (s *Server) handleLFSObject(w http.ResponseWriter, r *http.Request, repoRelPath *mirror.RepoRelPath, start time.Time) {
+	repoKey := repoRelPath.String()
+	oid := path.Base(r.URL.Path)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	v, ok := s.lfsTickets.Load(r.Header.Get(lfsTicketHeader))
+	ticket, _ := v.(*lfsTicket)
+	if !ok || ticket.repoKey != repoKey || ticket.oid != oid || time.Now().After(ticket.expires) {
+		http.Error(w, "missing or expired lfs ticket, retry the batch request", http.StatusUnauthorized)
+		return
+	}
+
+	result := "hit"
+	if _, err := os.Stat(s.mirror.LFSObjectPath(oid)); err != nil {
+		result = "miss"
+	}
+	objPath, err := s.mirror.LFSObject(r.Context(), oid, ticket.size, ticket.action.Href, ticket.action.Header)
+	if err != nil {
+		s.fail(w, repoKey, KindLFSObject, err)
+		return
+	}
+	s.metrics.LFSObjectsTotal.WithLabelValues(repoKey, result).Inc()
+
+	f, err := os.Open(objPath)
+	if err != nil {
+		s.fail(w, repoKey, KindLFSObject, err)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		s.fail(w, repoKey, KindLFSObject, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", `"`+oid+`"`)
+	http.ServeContent(w, r, "", info.ModTime(), f)
+
+	s.metrics.ResponsesTotal.WithLabelValues(repoKey, string(KindLFSObject), "200").Inc()
+	s.metrics.UpstreamLatency.WithLabelValues(repoKey, string(KindLFSObject)).Observe(time.Since(start).Seconds())
+	s.log.Info("request", "repo", repoKey, "kind", KindLFSObject, "oid", oid, "status", result, "total_duration_ms", time.Since(start).Milliseconds())
+}
+
+// pruneLFSTickets drops expired tickets.
+func (s *Server) pruneLFSTickets(now time.Time) {
+	s.lfsTickets.Range(func(k, v any) bool {
+		if now.After(v.(*lfsTicket).expires) {
+			s.lfsTickets.Delete(k)
+		}
+		return true
+	})
+}
+
+func newLFSTicketID() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// externalBaseURL returns the scheme and host clients use to reach the proxy.
+func externalBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+	}
+	host := r.Host
+	if fwd := r.Header.Get("X-Forwarded-Host"); fwd != "" {
+		host = strings.TrimSpace(strings.Split(fwd, ",")[0])
+	}
+	return scheme + "://" + host
+}
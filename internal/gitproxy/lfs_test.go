@@ -0,0 +1,133 @@
+package gitproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// rewriteTransport sends every request to target through base, keeping the
+// original path.
+type rewriteTransport struct {
+	target *url.URL
+	base   http.RoundTripper
+}
+
+func (t rewriteTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme = t.target.Scheme
+	r.URL.Host = t.target.Host
+	r.Host = t.target.Host
+	return t.base.RoundTrip(r)
+}
+
+func TestLFSBatchRewriteAndObjectCache(t *testing.T) {
+	content := []byte("large binary content")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	var downloads atomic.Int32
+	var upstream *httptest.Server
+	// Upstream has a certificate only its own transport trusts, as a private CA
+	upstream = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/acme/widgets.git/info/lfs/objects/batch":
+			if r.Header.Get("Authorization") != "Basic secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", lfsMediaType)
+			json.NewEncoder(w).Encode(lfsBatchResponse{
+				Transfer: "basic",
+				Objects: []lfsObject{{
+					OID:  oid,
+					Size: int64(len(content)),
+					Actions: map[string]*lfsAction{
+						"download": {Href: upstream.URL + "/media/" + oid, Header: map[string]string{"X-Media-Token": "abc"}},
+					},
+				}},
+			})
+		case r.URL.Path == "/media/"+oid && r.Header.Get("X-Media-Token") == "abc":
+			downloads.Add(1)
+			w.Write(content)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	srv, m := newTestServer(t, t.TempDir())
+	srv.cfg.AuthMode = "pass-through"
+	srv.cfg.EnableLFS = true
+	target, _ := url.Parse(upstream.URL)
+	srv.SetUpstreamTransport(rewriteTransport{target: target, base: upstream.Client().Transport})
+	m.SetUpstreamTransport(upstream.Client().Transport)
+
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	batchBody := `{"operation":"download","transfers":["basic"],"objects":[{"oid":"` + oid + `","size":20}]}`
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/github.com/acme/widgets.git/info/lfs/objects/batch", strings.NewReader(batchBody))
+	req.Header.Set("Content-Type", lfsMediaType)
+	req.Header.Set("Authorization", "Basic secret")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("batch: %v", err)
+	}
+	var batch lfsBatchResponse
+	if err := json.NewDecoder(res.Body).Decode(&batch); err != nil {
+		t.Fatalf("decode batch: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || len(batch.Objects) != 1 {
+		t.Fatalf("unexpected batch response: %d %+v", res.StatusCode, batch)
+	}
+	download := batch.Objects[0].Actions["download"]
+	if want := ts.URL + "/github.com/acme/widgets.git/info/lfs/objects/" + oid; download.Href != want {
+		t.Fatalf("download href not rewritten: %s", download.Href)
+	}
+	if download.Header[lfsTicketHeader] == "" {
+		t.Fatalf("download action has no ticket header: %+v", download.Header)
+	}
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, download.Href, nil)
+		for k, v := range download.Header {
+			req.Header.Set(k, v)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("get object: %v", err)
+		}
+		data, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || !bytes.Equal(data, content) {
+			t.Fatalf("unexpected object response %d: %q", res.StatusCode, data)
+		}
+	}
+	if n := downloads.Load(); n != 1 {
+		t.Fatalf("expected a single upstream download, got %d", n)
+	}
+	if _, err := os.Stat(m.LFSObjectPath(oid)); err != nil {
+		t.Fatalf("object not stored: %v", err)
+	}
+
+	// Without a ticket, objects are not served
+	res, err = http.Get(download.Href)
+	if err != nil {
+		t.Fatalf("get object: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without ticket, got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,145 @@
+package gitproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+// maxCacheableRequest bounds the size of upload-pack requests considered for the
+// pack cache; larger negotiations are streamed to upload-pack as they come.
+const maxCacheableRequest = 1 << 20
+
+// normalizePackRequest returns a canonical form of an upload-pack request to key
+// the pack cache with, and whether the request asks for a pack at all.
+// Client-specific tokens (agent, session-id) are dropped and lines are sorted
+// within each section, so identical fetches from different clients match.
+func normalizePackRequest(gitProtocol string, body []byte) ([]byte, bool) {
+	pkts, err := parsePktLines(body)
+	if err != nil {
+		return nil, false
+	}
+
+	var out bytes.Buffer
+	if isProtocolV2(gitProtocol) {
+		out.WriteString("v2\n")
+	} else {
+		out.WriteString("v0\n")
+	}
+
+	done := false
+	var section []string
+	endSection := func(marker string) {
+		slices.Sort(section)
+		for _, line := range section {
+			out.WriteString(line)
+			out.WriteByte('\n')
+		}
+		out.WriteString(marker)
+		section = section[:0]
+	}
+	for _, p := range pkts {
+		switch p.typ {
+		case pktTypeFlush:
+			endSection("0000\n")
+		case pktTypeDelim:
+			endSection("0001\n")
+		case pktTypeResponseEnd:
+			endSection("0002\n")
+		default:
+			fields := strings.Fields(string(p.payload))
+			fields = slices.DeleteFunc(fields, func(f string) bool {
+				return strings.HasPrefix(f, "agent=") || strings.HasPrefix(f, "session-id=")
+			})
+			if len(fields) == 0 {
+				continue
+			}
+			line := strings.Join(fields, " ")
+			if line == "done" {
+				done = true
+			}
+			section = append(section, line)
+		}
+	}
+	endSection("")
+
+	return out.Bytes(), done
+}
+
+// readPackRequest reads enough of an upload-pack request to normalize it.
+// It returns the reader to feed upload-pack with, the raw request (nil if it
+// is too large to be buffered) and its normalized key; key is nil if the
+// request can't be cached or shared.
+func readPackRequest(body io.Reader, gitProtocol string) (stdin io.Reader, request, key []byte, err error) {
+	request, err = io.ReadAll(io.LimitReader(body, maxCacheableRequest+1))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stdin = io.MultiReader(bytes.NewReader(request), body)
+	if len(request) > maxCacheableRequest {
+		return stdin, nil, nil, nil
+	}
+	if key, ok := normalizePackRequest(gitProtocol, request); ok {
+		return stdin, request, key, nil
+	}
+	return stdin, request, nil, nil
+}
+
+// packCacheLookup returns the pack cache entry for a normalized request, to be
+// served (hit) or filled (miss). The entry is nil if the lookup failed.
+func (s *Server) packCacheLookup(ctx context.Context, repoRelPath *mirror.RepoRelPath, key []byte) (*mirror.PackCacheEntry, bool) {
+	entry, hit, err := s.mirror.PackCacheEntry(ctx, repoRelPath, key)
+	if err != nil {
+		s.log.Warn("pack cache lookup failed", "repo", repoRelPath.String(), "err", err)
+		return nil, false
+	}
+	return entry, hit
+}
+
+// servePackCache copies a cached upload-pack response to the client.
+func (s *Server) servePackCache(out io.Writer, entry *mirror.PackCacheEntry, repoKey string) error {
+	f, err := os.Open(entry.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := io.Copy(out, f)
+	s.metrics.PackCacheTotal.WithLabelValues(repoKey, "hit").Inc()
+	s.metrics.UploadPackBytes.WithLabelValues(repoKey, string(KindUploadPack)).Add(float64(n))
+	s.log.Debug("served from pack cache", "repo", repoKey, "bytes", n)
+	return err
+}
+
+// runUploadPackCached runs upload-pack, teeing its output into the pack cache.
+// The entry is only committed if upload-pack completed successfully.
+func (s *Server) runUploadPackCached(ctx context.Context, repoPath, repoKey, gitProtocol string, stdin io.Reader, out io.Writer, entry *mirror.PackCacheEntry) error {
+	s.metrics.PackCacheTotal.WithLabelValues(repoKey, "miss").Inc()
+
+	tmp, err := s.mirror.CreatePackCacheTemp()
+	if err != nil {
+		s.log.Warn("pack cache temp file failed", "repo", repoKey, "err", err)
+		return s.runUploadPack(ctx, repoPath, repoKey, KindUploadPack, gitProtocol, stdin, out, "--stateless-rpc")
+	}
+	defer os.Remove(tmp.Name())
+
+	runErr := s.runUploadPack(ctx, repoPath, repoKey, KindUploadPack, gitProtocol, stdin, io.MultiWriter(tmp, out), "--stateless-rpc")
+	closeErr := tmp.Close()
+	if runErr != nil {
+		return runErr
+	}
+	if closeErr != nil {
+		s.log.Warn("pack cache write failed", "repo", repoKey, "err", closeErr)
+		return nil
+	}
+	if err := s.mirror.CommitPackCache(entry, tmp.Name()); err != nil {
+		s.log.Warn("pack cache commit failed", "repo", repoKey, "err", err)
+		return nil
+	}
+	s.metrics.PackCacheTotal.WithLabelValues(repoKey, "store").Inc()
+	return nil
+}
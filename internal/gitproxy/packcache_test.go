@@ -0,0 +1,90 @@
+package gitproxy
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+func TestNormalizePackRequest(t *testing.T) {
+	build := func(lines ...string) []byte {
+		var b bytes.Buffer
+		for _, l := range lines {
+			if l == "" {
+				b.Write(pktFlush)
+				continue
+			}
+			b.Write(pktLine(l + "\n"))
+		}
+		return b.Bytes()
+	}
+
+	a := build("want aaaa multi_ack side-band-64k agent=git/2.39.0", "want bbbb", "", "have cccc", "done")
+	b := build("want bbbb", "want aaaa multi_ack side-band-64k agent=git/2.43.0 session-id=xyz", "", "have cccc", "done")
+	keyA, okA := normalizePackRequest("", a)
+	keyB, okB := normalizePackRequest("", b)
+	if !okA || !okB {
+		t.Fatalf("expected requests with done to be cacheable")
+	}
+	if !bytes.Equal(keyA, keyB) {
+		t.Fatalf("expected equal keys:\n%s\n%s", keyA, keyB)
+	}
+
+	if keyV2, _ := normalizePackRequest("version=2", a); bytes.Equal(keyA, keyV2) {
+		t.Fatalf("expected protocol version to be part of the key")
+	}
+	if _, ok := normalizePackRequest("", build("want aaaa", "", "have cccc")); ok {
+		t.Fatalf("expected negotiation without done to not be cacheable")
+	}
+}
+
+func TestPackCacheServesAndInvalidates(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+
+	root := t.TempDir()
+	upstream := filepath.Join(root, "upstream")
+	makeUpstreamRepo(t, upstream)
+
+	srv, m := newTestServer(t, filepath.Join(root, "mirrors"))
+	srv.cfg.EnablePackCache = true
+	seedMirror(t, m, upstream, "github.com/acme/widgets")
+
+	ts := newHTTPTestServer(t, srv)
+	proxyURL := ts.URL + "/github.com/acme/widgets.git"
+
+	cacheDir := filepath.Join(m.Root(), ".packcache", "github.com", "acme", "widgets")
+	doFetch(t, filepath.Join(root, "client1"), proxyURL, "dev")
+	// The entry is committed once upload-pack exits, which the client may
+	// not wait for
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if entries, _ := os.ReadDir(cacheDir); len(entries) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected pack cache entries in %s", cacheDir)
+		}
+	}
+
+	// Identical fetch is served from the cache
+	doFetch(t, filepath.Join(root, "client2"), proxyURL, "dev")
+
+	// New upstream commit: sync changes refs and drops cached packs
+	mustRun(t, upstream, "sh", "-c", "echo third >> file.txt")
+	mustRun(t, upstream, "git", "commit", "-am", "third")
+	relPath, _ := mirror.ParseRepoRelPath("github.com/acme/widgets")
+	if err := m.Refresh(context.Background(), relPath, upstream, "", time.Now()); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if _, err := os.Stat(cacheDir); !os.IsNotExist(err) {
+		t.Fatalf("expected pack cache to be invalidated, got %v", err)
+	}
+	doFetch(t, filepath.Join(root, "client3"), proxyURL, "dev")
+}
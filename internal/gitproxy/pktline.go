@@ -0,0 +1,69 @@
+package gitproxy
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// pktFlush is the pkt-line flush packet ("0000").
+var pktFlush = []byte("0000")
+
+// pktLine encodes payload as a single pkt-line.
+func pktLine(payload string) []byte {
+	return []byte(fmt.Sprintf("%04x%s", len(payload)+4, payload))
+}
+
+// writePktLine writes payload as a pkt-line to w.
+func writePktLine(w io.Writer, payload string) error {
+	_, err := w.Write(pktLine(payload))
+	return err
+}
+
+// pktType distinguishes data packets from the special v2 packets.
+type pktType int
+
+const (
+	pktTypeData pktType = iota
+	pktTypeFlush
+	pktTypeDelim
+	pktTypeResponseEnd
+)
+
+type pkt struct {
+	typ     pktType
+	payload []byte
+}
+
+// parsePktLines splits data into pkt-lines.
+func parsePktLines(data []byte) ([]pkt, error) {
+	var pkts []pkt
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("truncated pkt-line header")
+		}
+		n, err := strconv.ParseUint(string(data[:4]), 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pkt-line length %q", data[:4])
+		}
+		switch n {
+		case 0:
+			pkts = append(pkts, pkt{typ: pktTypeFlush})
+		case 1:
+			pkts = append(pkts, pkt{typ: pktTypeDelim})
+		case 2:
+			pkts = append(pkts, pkt{typ: pktTypeResponseEnd})
+		case 3:
+			return nil, fmt.Errorf("invalid pkt-line length %d", n)
+		default:
+			if int(n) > len(data) {
+				return nil, fmt.Errorf("truncated pkt-line")
+			}
+			pkts = append(pkts, pkt{typ: pktTypeData, payload: data[4:n]})
+			data = data[n:]
+			continue
+		}
+		data = data[4:]
+	}
+	return pkts, nil
+}
@@ -0,0 +1,27 @@
+package gitproxy
+
+import (
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+	"github.com/crohr/smart-git-proxy/internal/policy"
+)
+
+// SetPolicy restricts the repos served, and mirrored, to those allowed by p.
+func (s *Server) SetPolicy(p *policy.Policy) {
+	s.policy = p
+}
+
+// checkPolicy returns the POLICY_FILE decision for repoRelPath. It runs
+// before the mirror is touched, so denied repos are never cloned.
+func (s *Server) checkPolicy(repoRelPath *mirror.RepoRelPath) policy.Decision {
+	if s.policy == nil {
+		return policy.Decision{Allowed: true}
+	}
+	d := s.policy.Evaluate(repoRelPath.String())
+	action := "allow"
+	if !d.Allowed {
+		action = "deny"
+		s.log.Warn("repo denied by policy", "repo", repoRelPath.String(), "rule", d.Rule, "reason", d.Reason)
+	}
+	s.metrics.PolicyDecisions.WithLabelValues(d.Rule, action).Inc()
+	return d
+}
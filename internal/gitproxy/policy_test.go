@@ -0,0 +1,41 @@
+package gitproxy
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/crohr/smart-git-proxy/internal/policy"
+)
+
+func TestPolicyDeniesBeforeClone(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "policy.json")
+	rules := `[{"action": "allow", "match": "github.com/our-org/*"}, {"action": "deny", "regex": ".*", "reason": "only our-org is mirrored"}]`
+	if err := os.WriteFile(file, []byte(rules), 0o600); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+	srv, m := newTestServer(t, filepath.Join(root, "mirrors"))
+	p, err := policy.Load(file, srv.log)
+	if err != nil {
+		t.Fatalf("load policy: %v", err)
+	}
+	srv.SetPolicy(p)
+	ts := newHTTPTestServer(t, srv)
+
+	res, err := http.Get(ts.URL + "/github.com/acme/widgets.git/info/refs?service=git-upload-pack")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden || !strings.Contains(string(body), "only our-org is mirrored") {
+		t.Fatalf("expected 403 with the rule reason, got %d: %s", res.StatusCode, body)
+	}
+	if _, err := os.Stat(filepath.Join(m.Root(), "github.com", "acme")); !os.IsNotExist(err) {
+		t.Fatalf("denied repo was cloned: %v", err)
+	}
+}
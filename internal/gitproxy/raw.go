@@ -0,0 +1,88 @@
+package gitproxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+// rawPrefix starts raw file URLs: /raw/<host>/<owner>/<repo>/<ref>/<path>.
+const rawPrefix = "/raw/"
+
+// splitRawPath splits the part of a raw file URL after rawPrefix into the
+// repo path and "<ref>/<path>", applying route aliases first.
+func (s *Server) splitRawPath(rest string) (repoPath, refPath string, ok bool) {
+	parts := strings.SplitN(s.resolveRoute(rest), "/", 4)
+	if len(parts) < 4 || parts[3] == "" {
+		return "", "", false
+	}
+	return strings.Join(parts[:3], "/"), parts[3], true
+}
+
+// serveRaw serves a single file of the mirror, like raw.githubusercontent.com.
+func (s *Server) serveRaw(w http.ResponseWriter, r *http.Request, repoRelPath *mirror.RepoRelPath, repoPath string, received time.Time) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+	_, refPath, _ := s.splitRawPath(strings.TrimPrefix(r.URL.Path, rawPrefix))
+
+	oid, size, err := s.mirror.ResolveBlob(r.Context(), repoPath, refPath)
+	if errors.Is(err, mirror.ErrNotFound) && s.cfg.SyncMissingWants {
+		// The ref or commit may have been pushed since the last sync
+		s.syncForWants(r, repoRelPath, "missing", received)
+		oid, size, err = s.mirror.ResolveBlob(r.Context(), repoPath, refPath)
+	}
+	if errors.Is(err, mirror.ErrNotFound) {
+		http.Error(w, "404: Not Found", http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		http.Error(w, "raw file lookup failed", http.StatusInternalServerError)
+		return err
+	}
+
+	// Never let browsers render repo content as HTML, same as GitHub
+	etag := `"` + oid + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "max-age=300")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	if r.Method == http.MethodHead {
+		return nil
+	}
+
+	blob, err := s.mirror.BlobReader(r.Context(), repoPath, oid)
+	if err != nil {
+		w.Header().Del("Content-Length")
+		http.Error(w, "raw file unavailable", http.StatusInternalServerError)
+		return err
+	}
+	_, copyErr := io.Copy(w, blob)
+	if err := blob.Close(); copyErr == nil {
+		copyErr = err
+	}
+	return copyErr
+}
+
+// etagMatches reports whether an If-None-Match header matches etag, using
+// the weak comparison HTTP requires for it.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package gitproxy
+
+import (
+	"io"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestRawFileFromMirror(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+
+	root := t.TempDir()
+	upstream := filepath.Join(root, "upstream")
+	makeUpstreamRepo(t, upstream)
+	mustRun(t, upstream, "git", "checkout", "-b", "feature/x")
+	mustRun(t, upstream, "sh", "-c", "mkdir -p docs && echo hello > docs/readme.md")
+	mustRun(t, upstream, "git", "add", "docs")
+	mustRun(t, upstream, "git", "commit", "-m", "docs")
+
+	srv, m := newTestServer(t, filepath.Join(root, "mirrors"))
+	srv.cfg.EnableRaw = true
+	seedMirror(t, m, upstream, "github.com/acme/widgets")
+	ts := newHTTPTestServer(t, srv)
+
+	get := func(path, ifNoneMatch string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("get %s: %v", path, err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res, string(body)
+	}
+
+	res, body := get("/raw/github.com/acme/widgets/dev/file.txt", "")
+	if res.StatusCode != http.StatusOK || body != "first\nsecond\n" {
+		t.Fatalf("unexpected response %d %q", res.StatusCode, body)
+	}
+	if res.ContentLength != int64(len(body)) {
+		t.Fatalf("unexpected content length %d", res.ContentLength)
+	}
+	etag := res.Header.Get("ETag")
+	if len(etag) != 42 {
+		t.Fatalf("expected blob id as etag, got %q", etag)
+	}
+	if res, _ := get("/raw/github.com/acme/widgets/dev/file.txt", etag); res.StatusCode != http.StatusNotModified {
+		t.Fatalf("expected 304 for matching etag, got %d", res.StatusCode)
+	}
+
+	if res, body := get("/raw/github.com/acme/widgets/feature/x/docs/readme.md", ""); res.StatusCode != http.StatusOK || body != "hello\n" {
+		t.Fatalf("ref with slash: unexpected response %d %q", res.StatusCode, body)
+	}
+	if res, _ := get("/raw/github.com/acme/widgets/dev/missing.txt", ""); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("missing file: expected 404, got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,143 @@
+package gitproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+// forwardedRequestHeaders are the client headers relevant to a smart-HTTP push.
+var forwardedRequestHeaders = []string{
+	"Authorization",
+	"Accept",
+	"Content-Type",
+	"Content-Encoding",
+	"Git-Protocol",
+	"User-Agent",
+}
+
+// hopByHopHeaders must not be copied from the upstream response.
+var hopByHopHeaders = map[string]bool{
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Transfer-Encoding": true,
+	"Content-Length":    true,
+	"Trailer":           true,
+	"Upgrade":           true,
+}
+
+// proxyReceivePack forwards a push to the upstream using the client's own
+// credentials. Once the upstream accepted a push, the local mirror is refreshed
+// before the response is returned, so the client's next fetch through the
+// proxy sees the new commits.
+func (s *Server) proxyReceivePack(w http.ResponseWriter, r *http.Request, repoRelPath *mirror.RepoRelPath, start time.Time) {
+	repoKey := repoRelPath.String()
+	upstreamURL := s.upstreamURL(repoRelPath)
+
+	target, err := url.Parse(upstreamURL)
+	if err != nil {
+		s.fail(w, repoKey, KindReceivePack, fmt.Errorf("invalid upstream url: %w", err))
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/info/refs") {
+		target = target.JoinPath("info", "refs")
+	} else {
+		target = target.JoinPath("git-receive-pack")
+	}
+	target.RawQuery = r.URL.RawQuery
+
+	outReq, err := http.NewRequestWithContext(r.Context(), r.Method, target.String(), r.Body)
+	if err != nil {
+		s.fail(w, repoKey, KindReceivePack, err)
+		return
+	}
+	outReq.ContentLength = r.ContentLength
+	for _, h := range forwardedRequestHeaders {
+		if v := r.Header.Get(h); v != "" {
+			outReq.Header.Set(h, v)
+		}
+	}
+	s.log.Debug("forwarding receive-pack", "repo", repoKey, "method", r.Method, "upstream", target.Redacted(), "hasAuth", r.Header.Get("Authorization") != "")
+
+	res, err := s.upstream.Do(outReq)
+	if err != nil {
+		s.fail(w, repoKey, KindReceivePack, fmt.Errorf("upstream receive-pack: %w", err))
+		return
+	}
+	defer res.Body.Close()
+
+	// The response only carries ref updates status and progress, so buffer it:
+	// the client considers the push done as soon as it reads it.
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		s.fail(w, repoKey, KindReceivePack, fmt.Errorf("read upstream response: %w", err))
+		return
+	}
+
+	if r.Method == http.MethodPost && res.StatusCode == http.StatusOK && pushUpdatedRefs(body) {
+		refreshStart := time.Now()
+		if err := s.mirror.Refresh(r.Context(), repoRelPath, upstreamURL, s.upstreamAuth(r.Context(), repoRelPath, r.Header.Get("Authorization")), refreshStart); err != nil {
+			s.log.Warn("mirror refresh after push failed", "repo", repoKey, "err", err, "duration_ms", time.Since(refreshStart).Milliseconds())
+		} else {
+			s.log.Info("mirror refreshed after push", "repo", repoKey, "duration_ms", time.Since(refreshStart).Milliseconds())
+		}
+	}
+
+	for k, vs := range res.Header {
+		if hopByHopHeaders[k] {
+			continue
+		}
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(res.StatusCode)
+	_, _ = w.Write(body)
+
+	s.metrics.ResponsesTotal.WithLabelValues(repoKey, string(KindReceivePack), strconv.Itoa(res.StatusCode)).Inc()
+	s.metrics.UpstreamLatency.WithLabelValues(repoKey, string(KindReceivePack)).Observe(time.Since(start).Seconds())
+	s.log.Info("request", "repo", repoKey, "kind", KindReceivePack, "method", r.Method, "upstream_status", res.StatusCode, "total_duration_ms", time.Since(start).Milliseconds())
+}
+
+// pushUpdatedRefs reports whether the report-status of a receive-pack
+// response says the pack was unpacked and at least one ref was updated. The
+// report comes in band 1 when side-band-64k was negotiated, next to progress
+// messages.
+func pushUpdatedRefs(body []byte) bool {
+	pkts, err := parsePktLines(body)
+	if err != nil {
+		return false
+	}
+	var banded []byte
+	for _, p := range pkts {
+		if p.typ == pktTypeData && len(p.payload) > 0 && p.payload[0] == 1 {
+			banded = append(banded, p.payload[1:]...)
+		}
+	}
+	if len(banded) > 0 {
+		if pkts, err = parsePktLines(banded); err != nil {
+			return false
+		}
+	}
+
+	var lines []string
+	for _, p := range pkts {
+		if p.typ == pktTypeData {
+			lines = append(lines, strings.TrimSuffix(string(p.payload), "\n"))
+		}
+	}
+	if len(lines) == 0 || lines[0] != "unpack ok" {
+		return false
+	}
+	return slices.ContainsFunc(lines[1:], func(line string) bool {
+		return strings.HasPrefix(line, "ok ")
+	})
+}
@@ -0,0 +1,160 @@
+package gitproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReceivePackForwardsPushes(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+
+	root := t.TempDir()
+	repos := filepath.Join(root, "upstream")
+	makeUpstreamRepo(t, filepath.Join(root, "work"))
+	bare := filepath.Join(repos, "acme", "widgets.git")
+	mustRun(t, "", "git", "clone", "--bare", filepath.Join(root, "work"), bare)
+	mustRun(t, bare, "git", "config", "http.receivepack", "true")
+
+	var (
+		mu      sync.Mutex
+		pushed  http.Header
+		fetches atomic.Int32
+	)
+	backend := newGitHTTPBackend(t, repos)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Query().Get("service") == "git-upload-pack":
+			fetches.Add(1)
+		case strings.HasSuffix(r.URL.Path, "/git-receive-pack"):
+			mu.Lock()
+			pushed = r.Header.Clone()
+			mu.Unlock()
+			if r.Header.Get("Authorization") == "Bearer readonly" {
+				http.Error(w, "write access denied", http.StatusForbidden)
+				return
+			}
+		}
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("X-Upstream", "yes")
+		backend.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+
+	srv, m := newTestServer(t, filepath.Join(root, "mirrors"))
+	srv.cfg.AllowedUpstreams = append(srv.cfg.AllowedUpstreams, "gitea.local")
+	srv.cfg.UpstreamTemplates = map[string]string{"gitea.local": upstream.URL + "/prefix/{owner}/{repo}.git"}
+	ts := newHTTPTestServer(t, srv)
+	proxyURL := ts.URL + "/gitea.local/acme/widgets.git"
+
+	client := filepath.Join(root, "client")
+	mustRun(t, "", "git", "clone", "--branch", "dev", proxyURL, client)
+	mustRun(t, client, "sh", "-c", "echo third >> file.txt")
+	mustRun(t, client, "git", "commit", "-am", "third")
+	push := func(auth string) error {
+		t.Helper()
+		cmd := exec.Command("git", "-c", "http.extraHeader=Authorization: "+auth, "-c", "http.extraHeader=X-Secret: s3cret", "push", "origin", "dev")
+		cmd.Dir = client
+		cmd.Env = append(cmd.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_SYSTEM=/dev/null")
+		return cmd.Run()
+	}
+	revParse := func(dir string) string {
+		t.Helper()
+		out, err := exec.Command("git", "-C", dir, "rev-parse", "refs/heads/dev").Output()
+		if err != nil {
+			t.Fatalf("rev-parse in %s: %v", dir, err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	// Pushes are refused unless enabled
+	if err := push("Bearer writer"); err == nil {
+		t.Fatal("expected the push to be refused with push disabled")
+	}
+	srv.cfg.EnablePush = true
+
+	// A push upstream refuses doesn't sync the mirror
+	before := fetches.Load()
+	if err := push("Bearer readonly"); err == nil {
+		t.Fatal("expected upstream to refuse the push")
+	}
+	if fetches.Load() != before {
+		t.Fatal("mirror synced after a refused push")
+	}
+
+	if err := push("Bearer writer"); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	head := revParse(client)
+	if got := revParse(bare); got != head {
+		t.Fatalf("upstream has %s, want the pushed %s", got, head)
+	}
+	if got := revParse(filepath.Join(m.Root(), "gitea.local", "acme", "widgets.git")); got != head {
+		t.Fatalf("mirror has %s after the push, want %s", got, head)
+	}
+	mu.Lock()
+	if pushed.Get("Authorization") != "Bearer writer" || pushed.Get("X-Secret") != "" {
+		t.Fatalf("unexpected forwarded headers %v", pushed)
+	}
+	mu.Unlock()
+
+	// A push upstream unpacks but whose ref updates it all rejects doesn't
+	// sync the mirror either
+	mustRun(t, bare, "git", "config", "receive.denyNonFastForwards", "true")
+	before = fetches.Load()
+	cmd := exec.Command("git", "-c", "http.extraHeader=Authorization: Bearer writer", "push", "--force", "origin", "HEAD~1:dev")
+	cmd.Dir = client
+	cmd.Env = append(cmd.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_SYSTEM=/dev/null")
+	if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "non-fast-forward") {
+		t.Fatalf("expected upstream to reject the ref update: %v\n%s", err, out)
+	}
+	if fetches.Load() != before {
+		t.Fatal("mirror synced after a push with no ref updated")
+	}
+
+	res, err := http.Get(proxyURL + "/info/refs?service=git-receive-pack")
+	if err != nil {
+		t.Fatalf("info/refs: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("X-Upstream") != "yes" || res.Header.Get("Keep-Alive") != "" {
+		t.Fatalf("unexpected response %d with headers %v", res.StatusCode, res.Header)
+	}
+}
+
+func TestPushUpdatedRefs(t *testing.T) {
+	report := func(lines ...string) string {
+		var b strings.Builder
+		for _, line := range lines {
+			b.Write(pktLine(line + "\n"))
+		}
+		return b.String() + "0000"
+	}
+	banded := func(report string) []byte {
+		return []byte(string(pktLine("\x02Resolving deltas\n")) + string(pktLine("\x01"+report)) + "0000")
+	}
+
+	for _, tc := range []struct {
+		name string
+		body []byte
+		want bool
+	}{
+		{"updated", []byte(report("unpack ok", "ok refs/heads/dev")), true},
+		{"updated in band 1", banded(report("unpack ok", "ng refs/heads/main hook declined", "ok refs/heads/dev")), true},
+		{"all rejected", banded(report("unpack ok", "ng refs/heads/dev non-fast-forward")), false},
+		{"unpack failed", []byte(report("unpack index-pack abnormal exit", "ng refs/heads/dev unpacker error")), false},
+		{"progress only", []byte(string(pktLine("\x02unpack ok\n")) + "0000"), false},
+		{"not pkt-lines", []byte("unpack ok\nok refs/heads/dev\n"), false},
+	} {
+		if got := pushUpdatedRefs(tc.body); got != tc.want {
+			t.Fatalf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
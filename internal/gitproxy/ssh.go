@@ -0,0 +1,251 @@
+package gitproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ServeSSH serves git-upload-pack exec requests over SSH on ln, from the same
+// mirrors as the HTTP handler. It returns when ln is closed.
+func (s *Server) ServeSSH(ln net.Listener) error {
+	hostKey, err := loadSSHHostKey(s.cfg.SSHHostKeyFile)
+	if err != nil {
+		return fmt.Errorf("ssh host key: %w", err)
+	}
+	sshCfg := &ssh.ServerConfig{PublicKeyCallback: s.sshAuthorize}
+	sshCfg.AddHostKey(hostKey)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.handleSSHConn(conn, sshCfg)
+	}
+}
+
+// sshAuthorize accepts client keys listed in the authorized_keys file. The file
+// is read on every attempt so keys can be rotated without a restart. Keys
+// carry no claims, so like API keys they are not restricted by
+// CLIENT_OWNER_CLAIM.
+func (s *Server) sshAuthorize(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	data, err := os.ReadFile(s.cfg.SSHAuthorizedKeys)
+	if err != nil {
+		s.log.Error("read authorized keys failed", "path", s.cfg.SSHAuthorizedKeys, "err", err)
+		return nil, err
+	}
+	for len(data) > 0 {
+		authorized, comment, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			break
+		}
+		if bytes.Equal(authorized.Marshal(), key.Marshal()) {
+			return &ssh.Permissions{Extensions: map[string]string{"comment": comment}}, nil
+		}
+		data = rest
+	}
+	return nil, fmt.Errorf("unknown public key for %q", meta.User())
+}
+
+func (s *Server) handleSSHConn(nConn net.Conn, sshCfg *ssh.ServerConfig) {
+	defer nConn.Close()
+	conn, chans, reqs, err := ssh.NewServerConn(nConn, sshCfg)
+	if err != nil {
+		s.log.Debug("ssh handshake failed", "remote", nConn.RemoteAddr().String(), "err", err)
+		return
+	}
+	defer conn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	// Runs are cancelled when the client goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			_ = newCh.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		ch, requests, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		go s.handleSSHSession(ctx, conn, ch, requests)
+	}
+}
+
+func (s *Server) handleSSHSession(ctx context.Context, conn *ssh.ServerConn, ch ssh.Channel, requests <-chan *ssh.Request) {
+	defer ch.Close()
+
+	var gitProtocol string
+	for req := range requests {
+		switch req.Type {
+		case "env":
+			var env struct{ Name, Value string }
+			if err := ssh.Unmarshal(req.Payload, &env); err == nil && env.Name == "GIT_PROTOCOL" {
+				gitProtocol = env.Value
+			}
+			_ = req.Reply(true, nil)
+		case "exec":
+			var exec struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &exec); err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			_ = req.Reply(true, nil)
+			go ssh.DiscardRequests(requests)
+
+			status := s.serveSSHCommand(ctx, conn, ch, exec.Command, gitProtocol)
+			_ = ch.CloseWrite()
+			_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			return
+		default:
+			// No shell, pty or subsystems
+			_ = req.Reply(false, nil)
+		}
+	}
+}
+
+// serveSSHCommand runs an exec request and returns its exit status. Errors are
+// reported on stderr, which git shows to the user.
+func (s *Server) serveSSHCommand(ctx context.Context, conn *ssh.ServerConn, ch ssh.Channel, command, gitProtocol string) uint32 {
+	start := time.Now()
+	service, repoArg, err := parseSSHCommand(command)
+	if err != nil {
+		fmt.Fprintf(ch.Stderr(), "smart-git-proxy: %v\n", err)
+		return 1
+	}
+	if service != "git-upload-pack" {
+		fmt.Fprintf(ch.Stderr(), "smart-git-proxy: %s is not supported over SSH\n", service)
+		return 1
+	}
+	repoRelPath, err := s.parseRepo(repoArg)
+	if err != nil {
+		s.log.Error("resolve target failed", "err", err, "path", repoArg, "transport", "ssh")
+		fmt.Fprintf(ch.Stderr(), "smart-git-proxy: %v\n", err)
+		return 1
+	}
+
+	repoKey := repoRelPath.String()
+	kind := KindUploadPack
+	s.metrics.RequestsTotal.WithLabelValues(repoKey, string(kind), conn.RemoteAddr().String()).Inc()
+	if d := s.checkPolicy(repoRelPath); !d.Allowed {
+		fmt.Fprintf(ch.Stderr(), "smart-git-proxy: forbidden: %s\n", d.Reason)
+		return 1
+	}
+
+	// There is no client token over SSH: pass-through syncs are anonymous,
+	// and only public repos are served with REQUIRE_CLIENT_AUTH
+	authHeader := s.upstreamAuth(ctx, repoRelPath, "")
+	repoPath, status, err := s.mirror.EnsureRepoAs(ctx, repoRelPath, s.upstreamURL(repoRelPath), authHeader, s.accessAuth(authHeader, ""))
+	if err != nil {
+		s.metrics.ErrorsTotal.WithLabelValues(repoKey, string(kind)).Inc()
+		s.log.Error("request failed", "err", err, "repo", repoKey, "kind", kind, "transport", "ssh")
+		fmt.Fprintf(ch.Stderr(), "smart-git-proxy: %v\n", err)
+		return 1
+	}
+	s.log.Info("request", "repo", repoKey, "kind", kind, "status", status, "transport", "ssh", "user", conn.User())
+
+	if err := s.runUploadPackDuplex(ctx, repoPath, repoKey, gitProtocol, ch); err != nil {
+		s.metrics.ErrorsTotal.WithLabelValues(repoKey, string(kind)).Inc()
+		s.log.Error("serve failed", "err", err, "repo", repoKey, "kind", kind, "transport", "ssh", "duration_ms", time.Since(start).Milliseconds())
+		return 1
+	}
+	s.metrics.UpstreamLatency.WithLabelValues(repoKey, string(kind)).Observe(time.Since(start).Seconds())
+	s.log.Debug("request complete", "repo", repoKey, "kind", kind, "transport", "ssh", "total_duration_ms", time.Since(start).Milliseconds())
+	return 0
+}
+
+// parseSSHCommand splits a git SSH command such as
+// "git-upload-pack 'github.com/owner/repo.git'" into the service name and the
+// unquoted repo path.
+func parseSSHCommand(command string) (service, repoPath string, err error) {
+	service, arg, ok := strings.Cut(strings.TrimSpace(command), " ")
+	if !ok {
+		return "", "", fmt.Errorf("invalid command %q", command)
+	}
+	if service == "git" {
+		// "git upload-pack <path>" form
+		sub, rest, ok := strings.Cut(strings.TrimSpace(arg), " ")
+		if !ok {
+			return "", "", fmt.Errorf("invalid command %q", command)
+		}
+		service, arg = "git-"+sub, rest
+	}
+	repoPath, err = unquoteShellArg(strings.TrimSpace(arg))
+	if err != nil {
+		return "", "", fmt.Errorf("invalid command %q: %w", command, err)
+	}
+	return service, repoPath, nil
+}
+
+// unquoteShellArg unquotes a single shell word as quoted by git: single-quoted,
+// with embedded quotes and ! escaped by a backslash outside of the quotes.
+func unquoteShellArg(arg string) (string, error) {
+	var b strings.Builder
+	inQuote := false
+	for i := 0; i < len(arg); i++ {
+		c := arg[i]
+		switch {
+		case c == '\'':
+			inQuote = !inQuote
+		case inQuote:
+			b.WriteByte(c)
+		case c == '\\' && i+1 < len(arg):
+			i++
+			b.WriteByte(arg[i])
+		case c == ' ' || c == '\t':
+			return "", errors.New("unexpected extra argument")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if inQuote {
+		return "", errors.New("unterminated quote")
+	}
+	return b.String(), nil
+}
+
+// loadSSHHostKey reads the host key at path, generating and storing a new
+// ed25519 key if the file doesn't exist. With an empty path the key is
+// ephemeral, and clients will see a new host key on every restart.
+func loadSSHHostKey(path string) (ssh.Signer, error) {
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			return ssh.ParsePrivateKey(data)
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if path != "" {
+		block, err := ssh.MarshalPrivateKey(key, "smart-git-proxy")
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+			return nil, err
+		}
+	}
+	return ssh.NewSignerFromKey(key)
+}
@@ -0,0 +1,125 @@
+package gitproxy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseSSHCommand(t *testing.T) {
+	tests := []struct {
+		command, service, path string
+		wantErr                bool
+	}{
+		{command: "git-upload-pack 'github.com/acme/widgets.git'", service: "git-upload-pack", path: "github.com/acme/widgets.git"},
+		{command: "git-upload-pack '/github.com/acme/widgets'", service: "git-upload-pack", path: "/github.com/acme/widgets"},
+		{command: "git upload-pack 'github.com/acme/it'\\''s'", service: "git-upload-pack", path: "github.com/acme/it's"},
+		{command: "git-receive-pack 'github.com/acme/widgets.git'", service: "git-receive-pack", path: "github.com/acme/widgets.git"},
+		{command: "git-upload-pack 'github.com/acme/widgets.git", wantErr: true},
+		{command: "git-upload-pack a b", wantErr: true},
+		{command: "ls", wantErr: true},
+	}
+	for _, tt := range tests {
+		service, path, err := parseSSHCommand(tt.command)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected error", tt.command)
+			}
+			continue
+		}
+		if err != nil || service != tt.service || path != tt.path {
+			t.Errorf("%q: got (%q, %q, %v), want (%q, %q)", tt.command, service, path, err, tt.service, tt.path)
+		}
+	}
+}
+
+func TestSSHUploadPack(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh not found in PATH")
+	}
+
+	root := t.TempDir()
+	upstream := filepath.Join(root, "upstream")
+	makeUpstreamRepo(t, upstream)
+
+	// Client key, listed in authorized_keys
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	keyPath := filepath.Join(root, "id_ed25519")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	sshPub, _ := ssh.NewPublicKey(pub)
+	authorizedKeys := filepath.Join(root, "authorized_keys")
+	if err := os.WriteFile(authorizedKeys, ssh.MarshalAuthorizedKey(sshPub), 0o600); err != nil {
+		t.Fatalf("write authorized keys: %v", err)
+	}
+
+	srv, m := newTestServer(t, filepath.Join(root, "mirrors"))
+	srv.cfg.SSHAuthorizedKeys = authorizedKeys
+	srv.cfg.SSHHostKeyFile = filepath.Join(root, "host_key")
+	seedMirror(t, m, upstream, "github.com/acme/widgets")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go srv.ServeSSH(ln)
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	gitSSH := func(keyPath string, args ...string) (string, error) {
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(),
+			"GIT_TERMINAL_PROMPT=0",
+			"GIT_CONFIG_GLOBAL=/dev/null",
+			"GIT_CONFIG_SYSTEM=/dev/null",
+			fmt.Sprintf("GIT_SSH_COMMAND=ssh -p %d -i %s -o IdentitiesOnly=yes -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o LogLevel=ERROR", port, keyPath),
+		)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+	proxyURL := "ssh://git@127.0.0.1/github.com/acme/widgets.git"
+
+	out, err := gitSSH(keyPath, "ls-remote", proxyURL)
+	if err != nil {
+		t.Fatalf("ls-remote over ssh failed: %v\n%s", err, out)
+	}
+	if !strings.Contains(out, "refs/heads/dev") {
+		t.Fatalf("ls-remote output missing refs/heads/dev:\n%s", out)
+	}
+	if out, err := gitSSH(keyPath, "clone", proxyURL, filepath.Join(root, "clone")); err != nil {
+		t.Fatalf("clone over ssh failed: %v\n%s", err, out)
+	}
+
+	// Disallowed hosts are refused
+	if out, err := gitSSH(keyPath, "ls-remote", "ssh://git@127.0.0.1/example.com/acme/widgets.git"); err == nil {
+		t.Fatalf("expected ls-remote of disallowed host to fail:\n%s", out)
+	}
+
+	// Unknown keys are refused
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	block, _ = ssh.MarshalPrivateKey(other, "")
+	otherPath := filepath.Join(root, "id_other")
+	if err := os.WriteFile(otherPath, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	if out, err := gitSSH(otherPath, "ls-remote", proxyURL); err == nil {
+		t.Fatalf("expected ls-remote with unknown key to fail:\n%s", out)
+	}
+}
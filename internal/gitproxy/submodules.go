@@ -0,0 +1,96 @@
+package gitproxy
+
+import (
+	"context"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+// prefetchDepthKey carries the submodule level of a prefetch in the context
+// of the EnsureRepo call it makes, so the sync hook it triggers stops at
+// SUBMODULE_PREFETCH_DEPTH.
+type prefetchDepthKey struct{}
+
+// PrefetchSubmodules is the mirror sync hook: once a repo is cloned or
+// synced, it reads its .gitmodules and ensures the mirrors of submodules on
+// allowed upstreams, one after the other, so CI doesn't pay a cold clone for
+// each of them on first use.
+func (s *Server) PrefetchSubmodules(ctx context.Context, repoRelPath *mirror.RepoRelPath, repoPath, authHeader string) {
+	depth, _ := ctx.Value(prefetchDepthKey{}).(int)
+	if depth >= s.cfg.SubmoduleDepth || s.submodulePrefetchExcluded(repoRelPath) {
+		return
+	}
+	urls, err := s.mirror.SubmoduleURLs(ctx, repoPath)
+	if err != nil {
+		s.log.Warn("read submodules failed", "repo", repoRelPath.String(), "err", err)
+		return
+	}
+
+	ctx = context.WithValue(ctx, prefetchDepthKey{}, depth+1)
+	for _, rawURL := range urls {
+		sub, ok := s.submoduleRepo(repoRelPath, rawURL)
+		if !ok || s.submodulePrefetchExcluded(sub) || !s.checkPolicy(sub).Allowed {
+			s.log.Debug("submodule not prefetched", "repo", repoRelPath.String(), "url", rawURL)
+			continue
+		}
+		// Never send the client's credentials for the superproject to another host
+		auth := s.upstreamAuth(ctx, sub, "")
+		if s.cfg.AuthMode == "pass-through" && sub.Host == repoRelPath.Host {
+			auth = authHeader
+		}
+		subKey := sub.String()
+		_, status, err := s.mirror.EnsureRepo(ctx, sub, s.upstreamURL(sub), auth)
+		if err != nil {
+			s.metrics.SubmodulePrefetches.WithLabelValues(subKey, "error").Inc()
+			s.log.Warn("submodule prefetch failed", "repo", repoRelPath.String(), "submodule", subKey, "err", err)
+			continue
+		}
+		s.metrics.SubmodulePrefetches.WithLabelValues(subKey, string(status)).Inc()
+		s.log.Info("submodule prefetched", "repo", repoRelPath.String(), "submodule", subKey, "status", status, "depth", depth+1)
+	}
+}
+
+// submodulePrefetchExcluded reports whether repoRelPath matches a
+// SUBMODULE_PREFETCH_EXCLUDE pattern.
+func (s *Server) submodulePrefetchExcluded(repoRelPath *mirror.RepoRelPath) bool {
+	for _, pattern := range s.cfg.SubmoduleExclude {
+		if ok, _ := path.Match(pattern, repoRelPath.String()); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// submoduleRepo maps the URL of a submodule of super to the mirror serving
+// it. URLs may be relative to the superproject (../lib.git), absolute
+// (https://github.com/acme/lib.git, ssh://git@github.com/acme/lib) or
+// scp-like (git@github.com:acme/lib.git); their host must be allowed.
+func (s *Server) submoduleRepo(super *mirror.RepoRelPath, rawURL string) (*mirror.RepoRelPath, bool) {
+	var repoPath string
+	switch {
+	case strings.HasPrefix(rawURL, "./") || strings.HasPrefix(rawURL, "../"):
+		repoPath = path.Join(super.String(), rawURL)
+	case strings.Contains(rawURL, "://"):
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, false
+		}
+		repoPath = u.Hostname() + u.Path
+	default:
+		userHost, p, ok := strings.Cut(rawURL, ":")
+		if !ok || strings.Contains(userHost, "/") {
+			return nil, false
+		}
+		repoPath = userHost[strings.LastIndex(userHost, "@")+1:] + "/" + p
+	}
+	// Not parseRepo: route aliases and the default host don't apply to URLs
+	repoRelPath, err := mirror.ParseRepoRelPath(strings.TrimSuffix(repoPath, ".git"))
+	if err != nil || !slices.Contains(s.cfg.AllowedUpstreams, repoRelPath.Host) {
+		return nil, false
+	}
+	return repoRelPath, true
+}
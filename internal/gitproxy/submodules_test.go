@@ -0,0 +1,107 @@
+package gitproxy
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+func TestSubmoduleRepo(t *testing.T) {
+	srv, _ := newTestServer(t, t.TempDir())
+	srv.cfg.DefaultUpstreamHost = "github.com"
+	super, _ := mirror.ParseRepoRelPath("github.com/acme/app")
+
+	for rawURL, want := range map[string]string{
+		"../lib.git":                         "github.com/acme/lib",
+		"../../other/lib":                    "github.com/other/lib",
+		"https://github.com/acme/lib.git":    "github.com/acme/lib",
+		"ssh://git@github.com:22/acme/lib":   "github.com/acme/lib",
+		"git@github.com:acme/lib.git":        "github.com/acme/lib",
+		"https://gitlab.com/acme/lib.git":    "",
+		"git@gitlab.com:acme/lib.git":        "",
+		"/srv/git/lib.git":                   "",
+		"https://git-proxy/github.com/a/lib": "",
+	} {
+		sub, ok := srv.submoduleRepo(super, rawURL)
+		if got := ""; ok {
+			got = sub.String()
+			if got != want {
+				t.Errorf("%s: got %s, want %s", rawURL, got, want)
+			}
+		} else if want != "" {
+			t.Errorf("%s: not resolved, want %s", rawURL, want)
+		}
+	}
+}
+
+func TestPrefetchSubmodules(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+
+	root := t.TempDir()
+	upstreams := filepath.Join(root, "upstream")
+	for _, name := range []string{"app", "lib", "deep", "skipped"} {
+		makeUpstreamRepo(t, filepath.Join(upstreams, "acme", name))
+	}
+	addSubmodules := func(name, gitmodules string) {
+		dir := filepath.Join(upstreams, "acme", name)
+		if err := os.WriteFile(filepath.Join(dir, ".gitmodules"), []byte(gitmodules), 0o644); err != nil {
+			t.Fatalf("write .gitmodules: %v", err)
+		}
+		mustRun(t, dir, "git", "add", ".gitmodules")
+		mustRun(t, dir, "git", "commit", "-m", "submodules")
+	}
+	addSubmodules("app", "[submodule \"lib\"]\n\tpath = lib\n\turl = ../lib.git\n"+
+		"[submodule \"skipped\"]\n\tpath = skipped\n\turl = git@github.com:acme/skipped.git\n"+
+		"[submodule \"elsewhere\"]\n\tpath = elsewhere\n\turl = https://gitlab.com/acme/lib.git\n")
+	addSubmodules("lib", "[submodule \"deep\"]\n\tpath = deep\n\turl = https://github.com/acme/deep\n")
+
+	mirrors := filepath.Join(root, "mirrors")
+	t.Cleanup(func() {
+		// Background maintenance of the new mirrors may still be writing to them
+		for i := 0; i < 50 && os.RemoveAll(mirrors) != nil; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+	})
+	srv, m := newTestServer(t, mirrors)
+	srv.cfg.UpstreamTemplates = map[string]string{"github.com": "file://" + upstreams + "/{owner}/{repo}"}
+	srv.cfg.SubmoduleDepth = 1
+	srv.cfg.SubmoduleExclude = []string{"github.com/acme/skip*"}
+	done := make(chan struct{})
+	m.SetSyncHook(func(ctx context.Context, repoRelPath *mirror.RepoRelPath, repoPath, authHeader string) {
+		srv.PrefetchSubmodules(ctx, repoRelPath, repoPath, authHeader)
+		if repoRelPath.String() == "github.com/acme/app" {
+			close(done)
+		}
+	})
+
+	app, _ := mirror.ParseRepoRelPath("github.com/acme/app")
+	if _, _, err := m.EnsureRepo(context.Background(), app, srv.upstreamURL(app), ""); err != nil {
+		t.Fatalf("ensure app: %v", err)
+	}
+
+	mirrored := func(name string) bool {
+		_, err := os.Stat(filepath.Join(m.Root(), "github.com", "acme", name+".git"))
+		return err == nil
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("submodule prefetch did not complete")
+	}
+	if !mirrored("lib") {
+		t.Fatalf("submodule lib was not prefetched")
+	}
+	if mirrored("deep") {
+		t.Fatalf("submodule beyond SUBMODULE_PREFETCH_DEPTH was prefetched")
+	}
+	if mirrored("skipped") {
+		t.Fatalf("excluded submodule was prefetched")
+	}
+}
@@ -0,0 +1,296 @@
+package gitproxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+const (
+	uploadPackAdvertisement = "application/x-git-upload-pack-advertisement"
+	uploadPackRequest       = "application/x-git-upload-pack-request"
+	uploadPackResult        = "application/x-git-upload-pack-result"
+)
+
+// serveInfoRefs writes the upload-pack ref advertisement from the local mirror.
+// The advertisement is small compared to pack data, so it is buffered to be able
+// to report a proper HTTP status if upload-pack fails.
+func (s *Server) serveInfoRefs(w http.ResponseWriter, r *http.Request, repoRelPath *mirror.RepoRelPath, repoPath string) error {
+	repoKey := repoRelPath.String()
+	gitProtocol := r.Header.Get("Git-Protocol")
+
+	buf := new(bytes.Buffer)
+	// Protocol v2 clients expect the capability advertisement right away,
+	// older ones expect the service announcement first (same as http-backend).
+	if !isProtocolV2(gitProtocol) {
+		_ = writePktLine(buf, "# service=git-upload-pack\n")
+		buf.Write(pktFlush)
+	}
+	if err := s.runUploadPack(r.Context(), repoPath, repoKey, KindInfo, gitProtocol, nil, buf, "--stateless-rpc", "--advertise-refs"); err != nil {
+		http.Error(w, "upload-pack failed", http.StatusInternalServerError)
+		return err
+	}
+	if isProtocolV2(gitProtocol) && s.hasBundle(repoRelPath) {
+		advertiseBundleURI(buf)
+	}
+
+	setNoCacheHeaders(w)
+	w.Header().Set("Content-Type", uploadPackAdvertisement)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// serveUploadPack runs a stateless upload-pack against the local mirror and
+// streams its output to the client as it is produced.
+func (s *Server) serveUploadPack(w http.ResponseWriter, r *http.Request, repoRelPath *mirror.RepoRelPath, repoPath string) error {
+	received := time.Now()
+	repoKey := repoRelPath.String()
+	if ct := r.Header.Get("Content-Type"); ct != uploadPackRequest {
+		http.Error(w, fmt.Sprintf("unsupported content type %q", ct), http.StatusUnsupportedMediaType)
+		return nil
+	}
+
+	rawBody, err := requestBody(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	defer rawBody.Close()
+	body := bufio.NewReader(rawBody)
+
+	gitProtocol := r.Header.Get("Git-Protocol")
+	setNoCacheHeaders(w)
+	w.Header().Set("Content-Type", uploadPackResult)
+	out := newFlushWriter(w)
+
+	// upload-pack doesn't know about our bundles, answer bundle-uri ourselves
+	if isProtocolV2(gitProtocol) && s.cfg.BundleInterval > 0 && peekCommand(body) == "bundle-uri" {
+		return s.serveBundleURIs(out, r, repoRelPath)
+	}
+
+	var stdin io.Reader = body
+	var request, key []byte
+	if s.cfg.EnablePackCache || s.cfg.CoalesceUploadPack || s.cfg.SyncMissingWants {
+		if stdin, request, key, err = readPackRequest(body, gitProtocol); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+	}
+
+	// Objects pushed right after the last sync are fetched before packing
+	if request != nil && s.cfg.SyncMissingWants {
+		s.syncMissingWants(r, repoRelPath, request, received)
+	}
+
+	var entry *mirror.PackCacheEntry
+	if key != nil && s.cfg.EnablePackCache {
+		var hit bool
+		if entry, hit = s.packCacheLookup(r.Context(), repoRelPath, key); hit {
+			return s.servePackCache(out, entry, repoKey)
+		}
+	}
+
+	// Hold back a "not our ref" error: the ref may have moved upstream since
+	// the client got the advertisement, so sync and retry once instead.
+	var pw io.Writer = out
+	var refErr *refErrorWriter
+	if request != nil && s.cfg.SyncMissingWants {
+		refErr = &refErrorWriter{w: out}
+		pw = refErr
+	}
+
+	if key != nil && s.cfg.CoalesceUploadPack {
+		err = s.serveCoalesced(r.Context(), pw, repoRelPath, repoPath, gitProtocol, request, key, entry)
+	} else {
+		err = s.runUploadPackLocked(r.Context(), repoRelPath, repoPath, gitProtocol, stdin, pw, entry)
+	}
+	if refErr != nil {
+		if err != nil && refErr.notOurRef {
+			err = s.retryUploadPack(r, repoRelPath, repoPath, gitProtocol, request, out, received)
+		} else if flushErr := refErr.flush(); err == nil {
+			err = flushErr
+		}
+	}
+	if err != nil && !out.written {
+		// Nothing sent yet, we can still report a proper error status
+		w.Header().Del("Content-Type")
+		http.Error(w, "upload-pack failed", http.StatusInternalServerError)
+	}
+	return err
+}
+
+// runUploadPackLocked runs a stateless upload-pack for a client request,
+// holding the per-repo lock if SERIALIZE_UPLOAD_PACK is set, and filling the
+// pack cache entry if one is given.
+func (s *Server) runUploadPackLocked(ctx context.Context, repoRelPath *mirror.RepoRelPath, repoPath, gitProtocol string, stdin io.Reader, out io.Writer, entry *mirror.PackCacheEntry) error {
+	repoKey := repoRelPath.String()
+	if s.cfg.SerializeUploadPack {
+		lock := s.mirror.GetRepoLock(repoRelPath)
+		lockStart := time.Now()
+		lock.Lock()
+		defer lock.Unlock()
+		s.log.Debug("upload-pack lock acquired", "repo", repoKey, "wait_ms", time.Since(lockStart).Milliseconds())
+	}
+
+	if entry != nil {
+		return s.runUploadPackCached(ctx, repoPath, repoKey, gitProtocol, stdin, out, entry)
+	}
+	return s.runUploadPack(ctx, repoPath, repoKey, KindUploadPack, gitProtocol, stdin, out, "--stateless-rpc")
+}
+
+// runUploadPack runs git upload-pack for repoPath with the given arguments,
+// recording bytes, duration and exit status metrics.
+func (s *Server) runUploadPack(ctx context.Context, repoPath, repoKey string, kind Kind, gitProtocol string, stdin io.Reader, stdout io.Writer, args ...string) error {
+	start := time.Now()
+
+	// Clients may want a commit of a ref that moved since the advertisement
+	gitArgs := []string{"-c", "uploadpack.allowReachableSHA1InWant=true"}
+	if s.cfg.UploadPackThreads > 0 {
+		gitArgs = append(gitArgs, "-c", fmt.Sprintf("pack.threads=%d", s.cfg.UploadPackThreads))
+	}
+	gitArgs = append(gitArgs, "upload-pack")
+	gitArgs = append(gitArgs, args...)
+	gitArgs = append(gitArgs, repoPath)
+
+	counter := &countingWriter{w: stdout}
+	stderr := new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, "git", gitArgs...)
+	cmd.Env = os.Environ()
+	if gitProtocol != "" {
+		cmd.Env = append(cmd.Env, "GIT_PROTOCOL="+gitProtocol)
+	}
+	cmd.Stdin = stdin
+	cmd.Stdout = counter
+	cmd.Stderr = stderr
+	err := cmd.Run()
+
+	code := exitCode(err)
+	s.metrics.UploadPackBytes.WithLabelValues(repoKey, string(kind)).Add(float64(counter.n))
+	s.metrics.UploadPackDuration.WithLabelValues(repoKey, string(kind)).Observe(time.Since(start).Seconds())
+	s.metrics.UploadPackExits.WithLabelValues(repoKey, string(kind), code).Inc()
+
+	if stderr.Len() != 0 {
+		s.log.Info("git upload-pack", "repo", repoKey, "kind", kind, "stderr", stderr.String())
+	}
+	s.log.Debug("upload-pack done", "repo", repoKey, "kind", kind, "bytes", counter.n, "exit", code, "duration_ms", time.Since(start).Milliseconds())
+
+	if err != nil {
+		return fmt.Errorf("git upload-pack failed: %w", err)
+	}
+	return nil
+}
+
+// runUploadPackDuplex runs a full-duplex upload-pack session (as spoken over
+// SSH and git://) on conn. Client input goes through a pipe so that the run
+// returns as soon as upload-pack exits, without waiting for the client to
+// close its side.
+func (s *Server) runUploadPackDuplex(ctx context.Context, repoPath, repoKey, gitProtocol string, conn io.ReadWriter) error {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer pr.Close()
+	go func() {
+		_, _ = io.Copy(pw, conn)
+		pw.Close()
+	}()
+	return s.runUploadPack(ctx, repoPath, repoKey, KindUploadPack, gitProtocol, pr, conn)
+}
+
+// requestBody returns the request body, transparently decompressing gzip
+// bodies (git sends gzip-encoded requests for large negotiations).
+func requestBody(r *http.Request) (io.ReadCloser, error) {
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+		return r.Body, nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %w", err)
+		}
+		return zr, nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", r.Header.Get("Content-Encoding"))
+	}
+}
+
+// isProtocolV2 reports whether the Git-Protocol header requests protocol v2.
+func isProtocolV2(gitProtocol string) bool {
+	for _, param := range strings.Split(gitProtocol, ":") {
+		if param == "version=2" {
+			return true
+		}
+	}
+	return false
+}
+
+func setNoCacheHeaders(w http.ResponseWriter) {
+	w.Header().Set("Expires", "Fri, 01 Jan 1980 00:00:00 GMT")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Cache-Control", "no-cache, max-age=0, must-revalidate")
+}
+
+// exitCode returns the exit status of a finished command as a metric label.
+func exitCode(err error) string {
+	if err == nil {
+		return "0"
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if code := exitErr.ExitCode(); code >= 0 {
+			return strconv.Itoa(code)
+		}
+		return "signal"
+	}
+	return "error"
+}
+
+// flushWriter flushes the response after every write so pack data and
+// progress messages reach the client without buffering.
+type flushWriter struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	written bool
+}
+
+func newFlushWriter(w http.ResponseWriter) *flushWriter {
+	return &flushWriter{w: w, rc: http.NewResponseController(w)}
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	f.written = true
+	n, err := f.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if err := f.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return n, err
+	}
+	return n, nil
+}
+
+// countingWriter counts bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
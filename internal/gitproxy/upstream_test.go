@@ -0,0 +1,161 @@
+package gitproxy
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/crohr/smart-git-proxy/internal/config"
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+// newGitHTTPBackend serves the repos under root over smart HTTP, below /prefix.
+func newGitHTTPBackend(t *testing.T, root string) http.Handler {
+	t.Helper()
+	execPath, err := exec.Command("git", "--exec-path").Output()
+	if err != nil {
+		t.Fatalf("git --exec-path: %v", err)
+	}
+	return http.StripPrefix("/prefix", &cgi.Handler{
+		Path: filepath.Join(strings.TrimSpace(string(execPath)), "git-http-backend"),
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	})
+}
+
+func TestUpstreamTemplates(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+
+	root := t.TempDir()
+	repos := filepath.Join(root, "upstream")
+	makeUpstreamRepo(t, filepath.Join(root, "work"))
+	mustRun(t, "", "git", "clone", "--bare", filepath.Join(root, "work"), filepath.Join(repos, "acme", "widgets.git"))
+
+	plain := httptest.NewServer(newGitHTTPBackend(t, repos))
+	defer plain.Close()
+	secure := httptest.NewTLSServer(newGitHTTPBackend(t, repos))
+	defer secure.Close()
+	caFile := filepath.Join(root, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: secure.Certificate().Raw}), 0o600); err != nil {
+		t.Fatalf("write CA: %v", err)
+	}
+
+	// GIT_SSL_CAINFO takes precedence over http.<url>.sslCAInfo
+	t.Setenv("GIT_SSL_CAINFO", "")
+	os.Unsetenv("GIT_SSL_CAINFO")
+
+	srv, m := newTestServer(t, filepath.Join(root, "mirrors"))
+	srv.cfg.UpstreamTemplates = map[string]string{
+		"gitea.local":     plain.URL + "/prefix/{owner}/{repo}",
+		"ghe.example.com": secure.URL + "/prefix/{owner}/{repo}.git",
+	}
+	srv.cfg.AllowedUpstreams = append(srv.cfg.AllowedUpstreams, "gitea.local", "ghe.example.com")
+	srv.cfg.UpstreamCAFiles = map[string]string{"ghe.example.com": caFile}
+	m.SetUpstreamCAs(srv.cfg.UpstreamCAURLs())
+	ts := newHTTPTestServer(t, srv)
+
+	for _, host := range []string{"gitea.local", "ghe.example.com"} {
+		doFetch(t, filepath.Join(root, "client-"+host), ts.URL+"/"+host+"/acme/widgets.git", "dev")
+		if _, err := os.Stat(filepath.Join(m.Root(), host, "acme", "widgets.git")); err != nil {
+			t.Fatalf("mirror of %s not created: %v", host, err)
+		}
+	}
+}
+
+func TestUpstreamAuthCredentials(t *testing.T) {
+	srv, _ := newTestServer(t, t.TempDir())
+	srv.cfg.AuthMode = "static"
+	srv.cfg.Credentials = []config.Credential{{Match: "github.com/acme", Token: "ghp_acme"}}
+	auth := func(repo string) string {
+		repoRelPath, _ := mirror.ParseRepoRelPath(repo)
+		return srv.upstreamAuth(context.Background(), repoRelPath, "Bearer client")
+	}
+
+	if got := auth("github.com/acme/widgets"); got != "Bearer ghp_acme" {
+		t.Fatalf("expected the acme credential, got %q", got)
+	}
+	// No match and no STATIC_TOKEN: anonymous rather than another host's token
+	if got := auth("gitea.local/acme/widgets"); got != "" {
+		t.Fatalf("expected no credential, got %q", got)
+	}
+	// STATIC_TOKEN is not a fallback for hosts missing from the file
+	srv.cfg.StaticToken = "ghp_static"
+	if got := auth("github.com/other/widgets"); got != "" {
+		t.Fatalf("expected no credential for an unlisted owner, got %q", got)
+	}
+	srv.cfg.Credentials = append(srv.cfg.Credentials, config.Credential{Match: "*", Token: "ghp_any"})
+	if got := auth("gitea.local/acme/widgets"); got != "Bearer ghp_any" {
+		t.Fatalf("expected the explicit fallback, got %q", got)
+	}
+	srv.cfg.Credentials = nil
+	if got := auth("gitea.local/acme/widgets"); got != "Bearer ghp_static" {
+		t.Fatalf("expected the static token without a credentials file, got %q", got)
+	}
+}
+
+func TestUpstreamAuthUnlistedHost(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+
+	root := t.TempDir()
+	repos := filepath.Join(root, "upstream")
+	makeUpstreamRepo(t, filepath.Join(root, "work"))
+	mustRun(t, "", "git", "clone", "--bare", filepath.Join(root, "work"), filepath.Join(repos, "acme", "widgets.git"))
+
+	var (
+		mu    sync.Mutex
+		auths []string
+	)
+	backend := newGitHTTPBackend(t, repos)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		auths = append(auths, r.Header.Get("Authorization"))
+		mu.Unlock()
+		backend.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+
+	srv, _ := newTestServer(t, filepath.Join(root, "mirrors"))
+	srv.cfg.AuthMode = "static"
+	srv.cfg.StaticToken = "ghp_static"
+	srv.cfg.CredentialsFile = filepath.Join(root, "credentials.json")
+	srv.cfg.Credentials = []config.Credential{{Match: "github.com", Token: "ghp_github"}}
+	srv.cfg.AllowedUpstreams = append(srv.cfg.AllowedUpstreams, "gitea.local")
+	srv.cfg.UpstreamTemplates = map[string]string{"gitea.local": upstream.URL + "/prefix/{owner}/{repo}.git"}
+	ts := newHTTPTestServer(t, srv)
+
+	doFetch(t, filepath.Join(root, "client"), ts.URL+"/gitea.local/acme/widgets.git", "dev")
+	mu.Lock()
+	defer mu.Unlock()
+	if len(auths) == 0 {
+		t.Fatal("expected the mirror to be synced from upstream")
+	}
+	for _, auth := range auths {
+		if auth != "" {
+			t.Fatalf("unlisted host got Authorization %q", auth)
+		}
+	}
+}
+
+func TestUpstreamAuthGitHubAppHost(t *testing.T) {
+	srv, _ := newTestServer(t, t.TempDir())
+	srv.cfg.AuthMode = "github-app"
+	srv.cfg.GitHubAppHost = "github.com"
+	// No app is set: minting a token for another host would panic
+	for _, repo := range []string{"gitlab.com/acme/widgets", "gitea.local/acme/widgets"} {
+		repoRelPath, _ := mirror.ParseRepoRelPath(repo)
+		if got := srv.upstreamAuth(context.Background(), repoRelPath, "Bearer client"); got != "" {
+			t.Fatalf("%s: expected no credential, got %q", repo, got)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package gitproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+// requestedWants returns the object ids (want) and refs (want-ref) wanted by
+// an upload-pack request, in either protocol version.
+func requestedWants(request []byte) (ids, refs []string) {
+	pkts, err := parsePktLines(request)
+	if err != nil {
+		return nil, nil
+	}
+	for _, p := range pkts {
+		if p.typ != pktTypeData {
+			continue
+		}
+		fields := strings.Fields(string(p.payload))
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "want":
+			ids = append(ids, fields[1])
+		case "want-ref":
+			refs = append(refs, fields[1])
+		}
+	}
+	return ids, refs
+}
+
+// syncMissingWants syncs the mirror right away, regardless of
+// SYNC_STALE_AFTER, if the request wants objects it doesn't have yet.
+func (s *Server) syncMissingWants(r *http.Request, repoRelPath *mirror.RepoRelPath, request []byte, received time.Time) {
+	ids, refs := requestedWants(request)
+	if len(ids) == 0 && len(refs) == 0 {
+		return
+	}
+	ok, err := s.mirror.HasObjects(r.Context(), s.mirror.RepoPath(repoRelPath), ids, refs)
+	if err != nil {
+		s.log.Warn("checking wants failed", "repo", repoRelPath.String(), "err", err)
+		return
+	}
+	if !ok {
+		s.syncForWants(r, repoRelPath, "missing", received)
+	}
+}
+
+// syncForWants refreshes the mirror unless it was already synced after the
+// request was received, which is enough to pick up anything the client saw.
+// Any client can name unknown objects, so forced syncs of a repo are at
+// least SYNC_MISSING_WANTS_INTERVAL apart.
+func (s *Server) syncForWants(r *http.Request, repoRelPath *mirror.RepoRelPath, reason string, received time.Time) {
+	repoKey := repoRelPath.String()
+	if s.mirror.LastSync(repoRelPath).After(received) {
+		return
+	}
+	start := time.Now()
+	if last, ok := s.wantSyncs.Load(repoKey); ok && start.Sub(last.(time.Time)) < s.cfg.MissingWantsInterval {
+		s.log.Debug("sync for wants throttled", "repo", repoKey, "reason", reason)
+		s.metrics.MissingWantSyncs.WithLabelValues(repoKey, reason, "throttled").Inc()
+		return
+	}
+	s.wantSyncs.Store(repoKey, start)
+	result := "ok"
+	if err := s.mirror.Refresh(r.Context(), repoRelPath, s.upstreamURL(repoRelPath), s.upstreamAuth(r.Context(), repoRelPath, r.Header.Get("Authorization")), received); err != nil {
+		result = "error"
+		s.log.Warn("sync for wants failed", "repo", repoKey, "reason", reason, "err", err, "duration_ms", time.Since(start).Milliseconds())
+	} else {
+		s.log.Info("synced for wants", "repo", repoKey, "reason", reason, "duration_ms", time.Since(start).Milliseconds())
+	}
+	s.metrics.MissingWantSyncs.WithLabelValues(repoKey, reason, result).Inc()
+}
+
+// retryUploadPack syncs the mirror and runs upload-pack once more for a
+// request that was rejected with "not our ref".
+func (s *Server) retryUploadPack(r *http.Request, repoRelPath *mirror.RepoRelPath, repoPath, gitProtocol string, request []byte, out io.Writer, received time.Time) error {
+	s.syncForWants(r, repoRelPath, "not-our-ref", received)
+	return s.runUploadPackLocked(context.WithoutCancel(r.Context()), repoRelPath, repoPath, gitProtocol, bytes.NewReader(request), out, nil)
+}
+
+// refErrorWriter holds back the first pkt-line of an upload-pack response. If
+// it reports a want upload-pack can't serve, it and the rest of the response
+// are discarded so the request can be retried after a sync; otherwise the
+// response is passed through.
+type refErrorWriter struct {
+	w         io.Writer
+	buf       []byte
+	decided   bool
+	notOurRef bool
+}
+
+func (e *refErrorWriter) Write(p []byte) (int, error) {
+	if e.notOurRef {
+		return len(p), nil
+	}
+	if e.decided {
+		return e.w.Write(p)
+	}
+	e.buf = append(e.buf, p...)
+	if len(e.buf) < 4 {
+		return len(p), nil
+	}
+	n, err := strconv.ParseUint(string(e.buf[:4]), 16, 16)
+	if err == nil && n > 4 {
+		if len(e.buf) < int(n) {
+			return len(p), nil
+		}
+		line := string(e.buf[4:n])
+		if strings.HasPrefix(line, "ERR upload-pack: not our ref") || strings.HasPrefix(line, "ERR unknown ref") {
+			e.notOurRef = true
+			e.buf = nil
+			return len(p), nil
+		}
+	}
+	if err := e.flush(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flush passes through whatever is still held back.
+func (e *refErrorWriter) flush() error {
+	e.decided = true
+	if e.notOurRef || len(e.buf) == 0 {
+		return nil
+	}
+	buf := e.buf
+	e.buf = nil
+	_, err := e.w.Write(buf)
+	return err
+}
@@ -0,0 +1,180 @@
+package gitproxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/crohr/smart-git-proxy/internal/mirror"
+)
+
+func TestRefErrorWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := &refErrorWriter{w: &out}
+	line := pktLine("ERR upload-pack: not our ref 0123456789012345678901234567890123456789")
+	w.Write(line[:6])
+	w.Write(line[6:])
+	w.Write([]byte("trailing"))
+	if !w.notOurRef || out.Len() != 0 {
+		t.Fatalf("expected error to be held back, got notOurRef=%v output %q", w.notOurRef, out.String())
+	}
+
+	out.Reset()
+	w = &refErrorWriter{w: &out}
+	w.Write([]byte("00"))
+	w.Write([]byte("08NAK\n0000"))
+	w.Write([]byte("more"))
+	if err := w.flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if w.notOurRef || out.String() != "0008NAK\n0000more" {
+		t.Fatalf("expected response to pass through, got %q", out.String())
+	}
+}
+
+func TestHasObjectsOnlyTakesIDsAndRefs(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+
+	root := t.TempDir()
+	upstream := filepath.Join(root, "upstream")
+	makeUpstreamRepo(t, upstream)
+	_, m := newTestServer(t, filepath.Join(root, "mirrors"))
+	seedMirror(t, m, upstream, "github.com/acme/widgets")
+	repoRelPath, _ := mirror.ParseRepoRelPath("github.com/acme/widgets")
+	repoPath := m.RepoPath(repoRelPath)
+	out, err := exec.Command("git", "-C", repoPath, "rev-parse", "refs/heads/dev").Output()
+	if err != nil {
+		t.Fatalf("rev-parse: %v", err)
+	}
+	sha := strings.TrimSpace(string(out))
+
+	if ok, err := m.HasObjects(context.Background(), repoPath, []string{sha}, []string{"refs/heads/dev"}); !ok || err != nil {
+		t.Fatalf("expected the dev commit and ref to be found (%v)", err)
+	}
+	// All of these resolve in cat-file, but aren't object ids or ref names
+	for _, tc := range []struct{ id, ref string }{
+		{id: ":/second"},
+		{id: "dev"},
+		{id: "HEAD~1"},
+		{id: sha[:12]},
+		{ref: "refs/heads/dev~1"},
+		{ref: "refs/heads/dev^{/second}"},
+		{ref: "refs/heads/dev:file.txt"},
+		{ref: "refs/heads/dev@{1}"},
+		{ref: "heads/dev"},
+	} {
+		var ids, refs []string
+		if tc.id != "" {
+			ids = []string{tc.id}
+		}
+		if tc.ref != "" {
+			refs = []string{tc.ref}
+		}
+		if ok, err := m.HasObjects(context.Background(), repoPath, ids, refs); ok || err != nil {
+			t.Fatalf("expected want %q / want-ref %q to be reported missing, got %v (%v)", tc.id, tc.ref, ok, err)
+		}
+	}
+}
+
+func TestFetchSyncsMissingWant(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+
+	root := t.TempDir()
+	upstream := filepath.Join(root, "upstream")
+	makeUpstreamRepo(t, upstream)
+
+	srv, m := newTestServer(t, filepath.Join(root, "mirrors"))
+	srv.cfg.SyncMissingWants = true
+	seedMirror(t, m, upstream, "github.com/acme/widgets")
+	ts := newHTTPTestServer(t, srv)
+	proxyURL := ts.URL + "/github.com/acme/widgets.git"
+
+	// Pushed upstream after the mirror was synced, well within SYNC_STALE_AFTER
+	mustRun(t, upstream, "git", "commit", "--allow-empty", "-m", "third")
+	out, err := exec.Command("git", "-C", upstream, "rev-parse", "dev").Output()
+	if err != nil {
+		t.Fatalf("rev-parse: %v", err)
+	}
+	sha := strings.TrimSpace(string(out))
+
+	for _, version := range []string{"0", "2"} {
+		clientDir := filepath.Join(root, "client-v"+version)
+		mustRun(t, "", "git", "init", clientDir)
+		cmd := exec.Command("git", "-c", "protocol.version="+version, "fetch", "--no-tags", proxyURL, sha)
+		cmd.Dir = clientDir
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_SYSTEM=/dev/null")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("protocol v%s fetch of %s failed: %v\n%s", version, sha, err, out)
+		}
+		mustRun(t, clientDir, "git", "cat-file", "-e", sha)
+	}
+}
+
+func TestForcedSyncsShareFetchesAndAreThrottled(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+
+	root := t.TempDir()
+	repos := filepath.Join(root, "upstream")
+	makeUpstreamRepo(t, filepath.Join(root, "work"))
+	mustRun(t, "", "git", "clone", "--bare", filepath.Join(root, "work"), filepath.Join(repos, "acme", "widgets.git"))
+
+	// Slow enough for concurrent refreshes to find the fetch in flight
+	var fetches atomic.Int32
+	upstream := newGatedUpstream(t, repos, func(r *http.Request) int {
+		if strings.HasSuffix(r.URL.Path, "/info/refs") {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return http.StatusOK
+	}, &fetches)
+
+	srv, m := newTestServer(t, filepath.Join(root, "mirrors"))
+	srv.cfg.AllowedUpstreams = append(srv.cfg.AllowedUpstreams, "gitea.local")
+	srv.cfg.UpstreamTemplates = map[string]string{"gitea.local": upstream.URL + "/prefix/{owner}/{repo}.git"}
+	srv.cfg.MissingWantsInterval = time.Hour
+	repo, _ := mirror.ParseRepoRelPath("gitea.local/acme/widgets")
+	if _, _, err := m.EnsureRepo(context.Background(), repo, srv.upstreamURL(repo), ""); err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+
+	// Refreshes asked for at the same time run a single fetch
+	before := fetches.Load()
+	notBefore := time.Now()
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := m.Refresh(context.Background(), repo, srv.upstreamURL(repo), "", notBefore); err != nil {
+				t.Errorf("refresh: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := fetches.Load() - before; got != 1 {
+		t.Fatalf("expected one fetch for concurrent refreshes, got %d", got)
+	}
+
+	// Unknown wants force a sync once per interval
+	before = fetches.Load()
+	for range 3 {
+		srv.syncForWants(httptest.NewRequest(http.MethodGet, "/", nil), repo, "missing", time.Now())
+	}
+	if got := fetches.Load() - before; got != 1 {
+		t.Fatalf("expected forced syncs to be throttled, got %d fetches", got)
+	}
+}
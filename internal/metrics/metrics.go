@@ -8,6 +8,19 @@ type Metrics struct {
 	ErrorsTotal     *prometheus.CounterVec
 	UpstreamLatency *prometheus.HistogramVec
 	SyncTotal       *prometheus.CounterVec
+
+	UploadPackBytes    *prometheus.CounterVec
+	UploadPackDuration *prometheus.HistogramVec
+	UploadPackExits    *prometheus.CounterVec
+
+	LFSObjectsTotal *prometheus.CounterVec
+	PackCacheTotal  *prometheus.CounterVec
+
+	UploadPackCoalesced *prometheus.CounterVec
+	MissingWantSyncs    *prometheus.CounterVec
+	SubmodulePrefetches *prometheus.CounterVec
+	ClientAuth          *prometheus.CounterVec
+	PolicyDecisions     *prometheus.CounterVec
 }
 
 // New creates metrics registered with the default prometheus registry.
@@ -45,6 +58,47 @@ func NewWithRegistry(reg prometheus.Registerer) *Metrics {
 			Name: "smart_git_proxy_sync_total",
 			Help: "mirror sync operations",
 		}, []string{"repo", "result"}),
+		UploadPackBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smart_git_proxy_upload_pack_bytes_total",
+			Help: "bytes streamed to clients by upload-pack",
+		}, []string{"repo", "kind"}),
+		UploadPackDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "smart_git_proxy_upload_pack_seconds",
+			Help:    "upload-pack process duration",
+			Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		}, []string{"repo", "kind"}),
+		UploadPackExits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smart_git_proxy_upload_pack_exits_total",
+			Help: "upload-pack process exits by exit code",
+		}, []string{"repo", "kind", "code"}),
+		LFSObjectsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smart_git_proxy_lfs_objects_total",
+			Help: "LFS object downloads by cache result",
+		}, []string{"repo", "result"}),
+		PackCacheTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smart_git_proxy_pack_cache_total",
+			Help: "pack cache lookups and stores by result",
+		}, []string{"repo", "result"}),
+		UploadPackCoalesced: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smart_git_proxy_upload_pack_coalesced_total",
+			Help: "upload-pack requests served by a shared run, by role (leader|follower)",
+		}, []string{"repo", "role"}),
+		MissingWantSyncs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smart_git_proxy_missing_want_syncs_total",
+			Help: "forced syncs for wants the mirror could not satisfy, by reason (missing|not-our-ref) and result (ok|error|throttled)",
+		}, []string{"repo", "reason", "result"}),
+		SubmodulePrefetches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smart_git_proxy_submodule_prefetches_total",
+			Help: "background ensures of submodule mirrors, by result (mirror-clone|mirror-sync|mirror-hit|error)",
+		}, []string{"repo", "result"}),
+		ClientAuth: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smart_git_proxy_client_auth_total",
+			Help: "client authentications to the proxy, by method (api-key|hmac|oidc) and result (ok|missing|invalid|forbidden)",
+		}, []string{"method", "result"}),
+		PolicyDecisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smart_git_proxy_policy_decisions_total",
+			Help: "repository policy decisions, by matching rule and action (allow|deny)",
+		}, []string{"rule", "action"}),
 	}
 
 	if reg != nil {
@@ -54,6 +108,16 @@ func NewWithRegistry(reg prometheus.Registerer) *Metrics {
 			m.ErrorsTotal,
 			m.UpstreamLatency,
 			m.SyncTotal,
+			m.UploadPackBytes,
+			m.UploadPackDuration,
+			m.UploadPackExits,
+			m.LFSObjectsTotal,
+			m.PackCacheTotal,
+			m.UploadPackCoalesced,
+			m.MissingWantSyncs,
+			m.SubmodulePrefetches,
+			m.ClientAuth,
+			m.PolicyDecisions,
 		)
 	}
 	return m
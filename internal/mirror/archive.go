@@ -0,0 +1,96 @@
+package mirror
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// archiveDir holds generated source archives, relative to the mirror root.
+// Archives are keyed by commit: git archive stores the commit's time and id in
+// them, so commits sharing a tree don't share archives.
+const archiveDir = ".archives"
+
+// ErrUnknownRevision is returned by Archive when the revision doesn't resolve
+// to a commit of the mirror.
+var ErrUnknownRevision = errors.New("unknown revision")
+
+// Archive returns the path of an archive of rev (a ref or commit) in format
+// ("tar.gz" or "zip", as passed to git archive),
+// with every file under prefix/, generating and caching it on first use. It
+// also returns the commit rev resolved to. Concurrent requests for the same
+// archive share a single git archive run.
+func (m *Mirror) Archive(ctx context.Context, repoPath, rev, format, prefix string) (path, commit string, err error) {
+	if strings.HasPrefix(rev, "-") {
+		return "", "", fmt.Errorf("invalid revision %q", rev)
+	}
+	out, err := exec.CommandContext(ctx, "git", "-C", repoPath, "rev-parse", "--verify", "--quiet", rev+"^{commit}").Output()
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %s", ErrUnknownRevision, rev)
+	}
+	commit = strings.TrimSpace(string(out))
+
+	sum := sha256.Sum256([]byte(prefix))
+	key := filepath.Join(archiveDir, commit[:2], commit+"-"+hex.EncodeToString(sum[:8])+"."+format)
+	path = filepath.Join(m.root, key)
+	if _, err := os.Stat(path); err == nil {
+		m.cache.Touch(key)
+		return path, commit, nil
+	}
+
+	_, err, _ = m.group.Do("archive:"+key, func() (interface{}, error) {
+		if _, err := os.Stat(path); err == nil {
+			return nil, nil
+		}
+		// Detach from the client request: other clients may be waiting on this archive
+		archiveCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Minute)
+		defer cancel()
+		if err := m.writeArchive(archiveCtx, repoPath, commit, format, prefix, path); err != nil {
+			return nil, err
+		}
+		m.background.Go(m.cache.MaybeEvict)
+		return nil, nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+	m.cache.Touch(key)
+	return path, commit, nil
+}
+
+// writeArchive runs git archive for commit, replacing path atomically.
+func (m *Mirror) writeArchive(ctx context.Context, repoPath, commit, format, prefix, path string) error {
+	start := time.Now()
+	tmpDir := filepath.Join(m.root, archiveDir, "tmp")
+	if err := os.MkdirAll(tmpDir, 0o755); err != nil {
+		return fmt.Errorf("create archive tmp dir: %w", err)
+	}
+	tmp, err := os.CreateTemp(tmpDir, "archive-*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "archive",
+		"--format="+format, "--prefix="+prefix+"/", "--output="+tmp.Name(), commit)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git archive failed: %w\noutput: %s", err, output)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("create archive dir: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	m.log.Debug("git archive complete", "path", repoPath, "commit", commit, "format", format, "duration_ms", time.Since(start).Milliseconds())
+	return nil
+}
@@ -0,0 +1,159 @@
+package mirror
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrAuthDenied is returned by EnsureRepo when upstream refuses the
+// credentials of a client for a repo that was mirrored with authentication.
+var ErrAuthDenied = errors.New("authentication required")
+
+// authCache remembers upstream authorization decisions per repo and token,
+// so cache hits on private repos don't each cost an upstream round-trip.
+type authCache struct {
+	allowTTL time.Duration
+	denyTTL  time.Duration
+
+	mu        sync.Mutex
+	decisions map[string]map[string]authDecision // repo key -> token hash -> decision
+}
+
+type authDecision struct {
+	allowed   bool
+	expiresAt time.Time
+}
+
+// SetAuthCache caches the outcome of upstream authorization checks for
+// allowTTL when access was granted and denyTTL when it was refused. A zero
+// TTL disables caching of that outcome.
+func (m *Mirror) SetAuthCache(allowTTL, denyTTL time.Duration) {
+	m.auth = &authCache{
+		allowTTL:  allowTTL,
+		denyTTL:   denyTTL,
+		decisions: make(map[string]map[string]authDecision),
+	}
+}
+
+// tokenHash keys decisions by a hash of the Authorization header, so tokens
+// are not kept in memory longer than the request needs them.
+func tokenHash(authHeader string) string {
+	sum := sha256.Sum256([]byte(authHeader))
+	return hex.EncodeToString(sum[:])
+}
+
+// get returns the cached decision for authHeader on key, if still valid.
+func (c *authCache) get(key, authHeader string) (allowed, ok bool) {
+	if c == nil {
+		return false, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.decisions[key][tokenHash(authHeader)]
+	if !ok || time.Now().After(d.expiresAt) {
+		return false, false
+	}
+	return d.allowed, true
+}
+
+// put records a decision for authHeader on key.
+func (c *authCache) put(key, authHeader string, allowed bool) {
+	if c == nil {
+		return
+	}
+	ttl := c.denyTTL
+	if allowed {
+		ttl = c.allowTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	repo := c.decisions[key]
+	if repo == nil {
+		repo = make(map[string]authDecision)
+		c.decisions[key] = repo
+	}
+	// Drop expired entries so tokens rotating through a repo don't pile up
+	for h, d := range repo {
+		if now.After(d.expiresAt) {
+			delete(repo, h)
+		}
+	}
+	repo[tokenHash(authHeader)] = authDecision{allowed: allowed, expiresAt: now.Add(ttl)}
+}
+
+// invalidate forgets every decision on key.
+func (c *authCache) invalidate(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.decisions, key)
+}
+
+// CredentialHook is told whether upstream accepted authHeader for
+// upstreamURL, after each git clone or fetch made with it.
+type CredentialHook func(ctx context.Context, upstreamURL, authHeader string, accepted bool)
+
+// SetCredentialHook installs hook, e.g. to report helper credentials back.
+func (m *Mirror) SetCredentialHook(hook CredentialHook) {
+	m.credentialHook = hook
+}
+
+// reportCredential runs the credential hook with the outcome err of a git
+// command, unless it failed for reasons other than upstream refusing the
+// credential itself.
+func (m *Mirror) reportCredential(ctx context.Context, upstreamURL, authHeader string, err error) {
+	if m.credentialHook == nil || authHeader == "" || (err != nil && !isCredentialRefused(err)) {
+		return
+	}
+	m.credentialHook(ctx, upstreamURL, authHeader, err == nil)
+}
+
+// isAuthFailure reports whether a failed git clone or fetch was refused by
+// upstream rather than e.g. unreachable.
+func isAuthFailure(err error) bool {
+	msg := err.Error()
+	for _, s := range []string{
+		"Authentication failed",
+		"could not read Username",
+		"terminal prompts disabled",
+		"Repository not found",
+		"returned error: 401",
+		"returned error: 403",
+		"returned error: 404",
+	} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// isCredentialRefused reports whether upstream answered a git clone or fetch
+// with a 401, i.e. rejected the credential itself. Like git, which only
+// rejects credentials on a 401, a 403 or 404 is not taken as a bad
+// credential: it is what any missing or forbidden repo answers.
+func isCredentialRefused(err error) bool {
+	msg := err.Error()
+	for _, s := range []string{
+		"Authentication failed",
+		"could not read Username", // git asks for credentials on a 401 only
+		"terminal prompts disabled",
+		"returned error: 401",
+	} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
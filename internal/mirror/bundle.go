@@ -0,0 +1,160 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// bundleDir holds pre-generated clone bundles, relative to the mirror root.
+// Each mirror has a single bundle at <repo key>.bundle.
+const (
+	bundleDir = ".bundles"
+	bundleExt = ".bundle"
+)
+
+// SetBundleInterval enables clone bundles, regenerated after syncs, by
+// optimizeRepo and by StartBundleRefresh once they are older than interval.
+// Zero disables bundle generation.
+func (m *Mirror) SetBundleInterval(interval time.Duration) {
+	m.bundleInterval = interval
+}
+
+// Bundle returns the path and modification time of the clone bundle for
+// repoRelPath, and whether one exists.
+func (m *Mirror) Bundle(repoRelPath *RepoRelPath) (string, time.Time, bool) {
+	key := filepath.Join(bundleDir, repoRelPath.String()+bundleExt)
+	path := filepath.Join(m.root, key)
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	m.cache.Touch(key)
+	return path, info.ModTime(), true
+}
+
+// refreshBundle regenerates the clone bundle of the repo at repoPath if it is
+// missing or older than the bundle interval.
+func (m *Mirror) refreshBundle(ctx context.Context, repoPath string) {
+	if m.bundleInterval <= 0 {
+		return
+	}
+	rel, err := filepath.Rel(m.root, repoPath)
+	if err != nil {
+		return
+	}
+	key := filepath.Join(bundleDir, strings.TrimSuffix(rel, ".git")+bundleExt)
+	bundlePath := filepath.Join(m.root, key)
+	fresh := func() bool {
+		info, err := os.Stat(bundlePath)
+		return err == nil && time.Since(info.ModTime()) < m.bundleInterval
+	}
+	if fresh() {
+		return
+	}
+
+	_, _, _ = m.maintGroup.Do("bundle:"+repoPath, func() (interface{}, error) {
+		// A refresh that just ended may have written it
+		if fresh() {
+			return nil, nil
+		}
+		start := time.Now()
+		if err := m.writeBundle(ctx, repoPath, bundlePath); err != nil {
+			m.log.Warn("git bundle create failed", "path", repoPath, "err", err)
+			return nil, nil
+		}
+		m.cache.Touch(key)
+		m.background.Go(m.cache.MaybeEvict)
+		m.log.Debug("git bundle complete", "path", repoPath, "bundle", bundlePath, "duration_ms", time.Since(start).Milliseconds())
+		return nil, nil
+	})
+}
+
+// StartBundleRefresh regenerates stale clone bundles of every mirror in the
+// background until ctx is done, checking four times per bundle interval, so
+// mirrors that aren't synced still get their bundle refreshed. It does
+// nothing if bundles are disabled.
+func (m *Mirror) StartBundleRefresh(ctx context.Context) {
+	if m.bundleInterval <= 0 {
+		return
+	}
+	m.background.Go(func() {
+		ticker := time.NewTicker(m.bundleInterval / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.refreshBundles(ctx)
+			}
+		}
+	})
+}
+
+// refreshBundles runs refreshBundle on every mirror under the root.
+func (m *Mirror) refreshBundles(ctx context.Context) {
+	_ = filepath.WalkDir(m.root, func(p string, d os.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// Mirrors removed by eviction while walking are skipped
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		// Bundles, archives and other derived data live in dot directories
+		if p != m.root && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if strings.HasSuffix(d.Name(), ".git") {
+			m.refreshBundle(ctx, p)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// scheduleBundle refreshes the clone bundle of the repo at repoPath in the
+// background after a sync, so it doesn't wait for the next optimizeRepo.
+func (m *Mirror) scheduleBundle(repoPath string) {
+	if m.bundleInterval <= 0 {
+		return
+	}
+	m.background.Go(func() {
+		m.refreshBundle(context.Background(), repoPath)
+	})
+}
+
+// writeBundle writes a bundle of the branches and tags of the repo at
+// repoPath, replacing bundlePath atomically.
+func (m *Mirror) writeBundle(ctx context.Context, repoPath, bundlePath string) error {
+	tmpDir := filepath.Join(m.root, bundleDir, "tmp")
+	if err := os.MkdirAll(tmpDir, 0o755); err != nil {
+		return fmt.Errorf("create bundle tmp dir: %w", err)
+	}
+	tmp, err := os.CreateTemp(tmpDir, "bundle-*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	args := []string{"-C", repoPath}
+	if m.packThreads > 0 {
+		args = append(args, "-c", fmt.Sprintf("pack.threads=%d", m.packThreads))
+	}
+	args = append(args, "bundle", "create", tmp.Name(), "--branches", "--tags")
+	cmd := exec.CommandContext(ctx, "git", args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w\noutput: %s", err, output)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(bundlePath), 0o755); err != nil {
+		return fmt.Errorf("create bundle dir: %w", err)
+	}
+	return os.Rename(tmp.Name(), bundlePath)
+}
@@ -6,6 +6,7 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"sync"
 	"syscall"
@@ -21,7 +22,11 @@ const (
 	MinFreeSpace = 1024 * 1024 * 1024
 )
 
-// Cache manages LRU eviction of mirror repositories.
+// fileCacheDirs hold cached files (relative to the mirror root) that are evicted
+// individually, alongside whole mirrors.
+var fileCacheDirs = []string{lfsDir, packCacheDir, bundleDir, archiveDir, goModDir}
+
+// Cache manages LRU eviction of mirror repositories and cached files (LFS objects, packs, bundles, archives, module zips).
 type Cache struct {
 	root       string
 	maxSize    config.SizeSpec
@@ -68,12 +73,19 @@ func (c *Cache) MaybeEvict() {
 
 	c.log.Info("cache size exceeded, starting eviction", "current", formatSize(currentSize), "max", formatSize(maxBytes))
 
-	// Get all repos sorted by access time (oldest first)
+	// Get all repos and cached files, to be sorted by access time (oldest first)
 	repos, err := c.listReposWithAccessTime()
 	if err != nil {
 		c.log.Warn("failed to list repos for eviction", "err", err)
 		return
 	}
+	for _, dir := range fileCacheDirs {
+		files, err := c.listFilesWithAccessTime(dir)
+		if err != nil {
+			c.log.Warn("failed to list cached files for eviction", "dir", dir, "err", err)
+		}
+		repos = append(repos, files...)
+	}
 
 	// Sort by access time (oldest first)
 	sort.Slice(repos, func(i, j int) bool {
@@ -93,9 +105,9 @@ func (c *Cache) MaybeEvict() {
 			continue
 		}
 
-		c.log.Info("evicting repo", "key", repo.key, "size", formatSize(repoSize), "lastAccess", repo.accessTime)
+		c.log.Info("evicting entry", "key", repo.key, "size", formatSize(repoSize), "lastAccess", repo.accessTime)
 		if err := os.RemoveAll(repo.path); err != nil {
-			c.log.Warn("failed to remove repo", "path", repo.path, "err", err)
+			c.log.Warn("failed to remove entry", "path", repo.path, "err", err)
 			continue
 		}
 
@@ -103,16 +115,21 @@ func (c *Cache) MaybeEvict() {
 		c.cleanEmptyParents(repo.path)
 
 		currentSize -= repoSize
+		if repo.isRepo {
+			currentSize -= c.removeDerived(repo.key)
+		}
 		c.accessTime.Delete(repo.key)
 	}
 
 	c.log.Info("eviction complete", "newSize", formatSize(currentSize))
 }
 
+// repoInfo is an evictable cache entry: a mirror directory or a single cached file.
 type repoInfo struct {
 	key        string
 	path       string
 	accessTime time.Time
+	isRepo     bool
 }
 
 // listReposWithAccessTime returns all repos with their access times.
@@ -125,6 +142,11 @@ func (c *Cache) listReposWithAccessTime() ([]repoInfo, error) {
 			return nil // Skip errors
 		}
 
+		// Cached files are listed separately
+		if d.IsDir() && filepath.Dir(path) == c.root && slices.Contains(fileCacheDirs, d.Name()) {
+			return filepath.SkipDir
+		}
+
 		// Look for bare repos (directories ending in .git or containing HEAD file)
 		if d.IsDir() && filepath.Ext(path) == ".git" {
 			// Check if it's actually a git repo
@@ -135,6 +157,7 @@ func (c *Cache) listReposWithAccessTime() ([]repoInfo, error) {
 					key:        key,
 					path:       path,
 					accessTime: accessTime,
+					isRepo:     true,
 				})
 				return filepath.SkipDir
 			}
@@ -145,6 +168,56 @@ func (c *Cache) listReposWithAccessTime() ([]repoInfo, error) {
 	return repos, err
 }
 
+// listFilesWithAccessTime returns all files stored under a cache dir with their access times.
+func (c *Cache) listFilesWithAccessTime(dir string) ([]repoInfo, error) {
+	var files []repoInfo
+
+	err := filepath.WalkDir(filepath.Join(c.root, dir), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // Skip errors (including missing cache dir)
+		}
+		if d.IsDir() {
+			if d.Name() == "tmp" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		key, err := filepath.Rel(c.root, path)
+		if err != nil {
+			return nil
+		}
+		files = append(files, repoInfo{
+			key:        key,
+			path:       path,
+			accessTime: c.getAccessTime(key, path),
+		})
+		return nil
+	})
+
+	return files, err
+}
+
+// removeDerived removes data derived from an evicted repo and returns the freed size.
+func (c *Cache) removeDerived(key string) int64 {
+	var freed int64
+	for _, path := range []string{
+		filepath.Join(c.root, packCacheDir, key),
+		filepath.Join(c.root, bundleDir, key+bundleExt),
+	} {
+		size, err := getDirSize(path)
+		if err != nil || size == 0 {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			c.log.Warn("failed to remove derived data", "path", path, "err", err)
+			continue
+		}
+		c.cleanEmptyParents(path)
+		freed += size
+	}
+	return freed
+}
+
 // pathToKey converts a repo path back to a key (host/owner/repo).
 func (c *Cache) pathToKey(path string) string {
 	rel, err := filepath.Rel(c.root, path)
@@ -0,0 +1,300 @@
+package mirror
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	modzip "golang.org/x/mod/zip"
+)
+
+// goModDir holds generated Go module zips, relative to the mirror root, laid
+// out like a module cache download directory: <module>/@v/<version>.zip.
+const goModDir = ".gomod"
+
+// GoModule is a Go module stored in a mirror.
+type GoModule struct {
+	// Path is the module path, e.g. github.com/acme/widgets/tools/v2.
+	Path string
+	// Dir is the directory of the module in the repo, without any major
+	// version suffix: "tools" for the module above, "" at the root. Version
+	// tags of the module are prefixed with it, e.g. tools/v2.1.0.
+	Dir string
+	// PathMajor is the major version suffix of Path, e.g. "/v2".
+	PathMajor string
+}
+
+func (mod GoModule) tagPrefix() string {
+	if mod.Dir == "" {
+		return "refs/tags/"
+	}
+	return "refs/tags/" + mod.Dir + "/"
+}
+
+// GoVersions returns the versions of mod, from the semver tags of the mirror
+// at repoPath, in increasing order.
+func (m *Mirror) GoVersions(ctx context.Context, repoPath string, mod GoModule) ([]string, error) {
+	refs, err := m.ListRefs(ctx, repoPath, mod.tagPrefix())
+	if err != nil {
+		return nil, err
+	}
+	versions := []string{}
+	for _, ref := range refs {
+		v := strings.TrimPrefix(ref.Name, mod.tagPrefix())
+		if isGoVersion(mod, v) {
+			versions = append(versions, v)
+		}
+	}
+	semver.Sort(versions)
+	return versions, nil
+}
+
+// isGoVersion reports whether v is a canonical version of mod. Versions
+// without a go.mod (+incompatible) are not supported.
+func isGoVersion(mod GoModule, v string) bool {
+	return semver.IsValid(v) && semver.Canonical(v) == v && module.CheckPathMajor(v, mod.PathMajor) == nil
+}
+
+// GoResolve resolves query, a version of mod or "latest", to a canonical
+// version and the commit and time it stands for. The latest version is the
+// highest release, the highest pre-release if there is none, and a
+// pseudo-version of HEAD if the module has no version tag at all. Unknown
+// versions return ErrUnknownRevision.
+func (m *Mirror) GoResolve(ctx context.Context, repoPath string, mod GoModule, query string) (version, commit string, t time.Time, err error) {
+	switch {
+	case query == "latest":
+		versions, err := m.GoVersions(ctx, repoPath, mod)
+		if err != nil {
+			return "", "", time.Time{}, err
+		}
+		if len(versions) == 0 {
+			commit, t, err := m.goCommit(ctx, repoPath, "HEAD")
+			if err != nil {
+				return "", "", time.Time{}, err
+			}
+			return module.PseudoVersion(module.PathMajorPrefix(mod.PathMajor), "", t, commit[:12]), commit, t, nil
+		}
+		version = versions[len(versions)-1]
+		for i := len(versions) - 1; i >= 0; i-- {
+			if semver.Prerelease(versions[i]) == "" {
+				version = versions[i]
+				break
+			}
+		}
+		commit, t, err = m.goCommit(ctx, repoPath, mod.tagPrefix()+version)
+		return version, commit, t, err
+
+	case module.IsPseudoVersion(query) && isGoVersion(mod, query):
+		rev, err := module.PseudoVersionRev(query)
+		if err != nil {
+			return "", "", time.Time{}, fmt.Errorf("%w: %s", ErrUnknownRevision, query)
+		}
+		commit, t, err := m.goCommit(ctx, repoPath, rev)
+		if err != nil {
+			return "", "", time.Time{}, err
+		}
+		// The go command checks the timestamp too, reject forged ones early
+		if pt, _ := module.PseudoVersionTime(query); !pt.Equal(t) || !strings.HasPrefix(commit, rev) {
+			return "", "", time.Time{}, fmt.Errorf("%w: %s", ErrUnknownRevision, query)
+		}
+		return query, commit, t, nil
+
+	case isGoVersion(mod, query):
+		commit, t, err := m.goCommit(ctx, repoPath, mod.tagPrefix()+query)
+		return query, commit, t, err
+	}
+	return "", "", time.Time{}, fmt.Errorf("%w: %s", ErrUnknownRevision, query)
+}
+
+// goCommit resolves rev to a commit and its commit time, in UTC.
+func (m *Mirror) goCommit(ctx context.Context, repoPath, rev string) (string, time.Time, error) {
+	info, err := m.Commit(ctx, repoPath, rev)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	t, err := time.Parse(time.RFC3339, info.Committer.Date)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("parse commit time of %s: %w", info.SHA, err)
+	}
+	return info.SHA, t.UTC(), nil
+}
+
+// goModuleDir returns the directory holding the module at commit: the
+// major version subdirectory (tools/v2) if it has a go.mod, Dir otherwise.
+func (m *Mirror) goModuleDir(ctx context.Context, repoPath string, mod GoModule, commit string) string {
+	if mod.PathMajor == "" || strings.HasPrefix(mod.PathMajor, ".") {
+		return mod.Dir
+	}
+	majorDir := path.Join(mod.Dir, strings.TrimPrefix(mod.PathMajor, "/"))
+	err := exec.CommandContext(ctx, "git", "-C", repoPath, "cat-file", "-e", commit+":"+path.Join(majorDir, "go.mod")).Run()
+	if err == nil {
+		return majorDir
+	}
+	return mod.Dir
+}
+
+// GoMod returns the go.mod file of mod at commit, or a minimal one declaring
+// the module path if the module has none.
+func (m *Mirror) GoMod(ctx context.Context, repoPath string, mod GoModule, commit string) ([]byte, error) {
+	dir := m.goModuleDir(ctx, repoPath, mod, commit)
+	out, err := exec.CommandContext(ctx, "git", "-C", repoPath, "cat-file", "blob", commit+":"+path.Join(dir, "go.mod")).Output()
+	if err != nil {
+		return []byte("module " + mod.Path + "\n"), nil
+	}
+	return out, nil
+}
+
+// GoZip returns the path of the module zip of mod at version, built from
+// commit and cached on first use. Concurrent requests for the same zip share
+// a single build.
+func (m *Mirror) GoZip(ctx context.Context, repoPath string, mod GoModule, version, commit string) (string, error) {
+	escPath, err := module.EscapePath(mod.Path)
+	if err != nil {
+		return "", err
+	}
+	escVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return "", err
+	}
+	key := filepath.Join(goModDir, filepath.FromSlash(escPath), "@v", escVersion+".zip")
+	zipPath := filepath.Join(m.root, key)
+	if _, err := os.Stat(zipPath); err == nil {
+		m.cache.Touch(key)
+		return zipPath, nil
+	}
+
+	_, err, _ = m.group.Do("gomod:"+key, func() (interface{}, error) {
+		if _, err := os.Stat(zipPath); err == nil {
+			return nil, nil
+		}
+		// Detach from the client request: other clients may be waiting on this zip
+		zipCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Minute)
+		defer cancel()
+		if err := m.writeGoZip(zipCtx, repoPath, mod, version, commit, zipPath); err != nil {
+			return nil, err
+		}
+		m.background.Go(m.cache.MaybeEvict)
+		return nil, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	m.cache.Touch(key)
+	return zipPath, nil
+}
+
+// writeGoZip builds the module zip from a git archive of the module
+// directory at commit, replacing zipPath atomically. Files of nested modules
+// and vendor directories are left out by modzip.Create, as the go command
+// does.
+func (m *Mirror) writeGoZip(ctx context.Context, repoPath string, mod GoModule, version, commit, zipPath string) error {
+	start := time.Now()
+	tmpDir := filepath.Join(m.root, goModDir, "tmp")
+	if err := os.MkdirAll(tmpDir, 0o755); err != nil {
+		return fmt.Errorf("create module zip tmp dir: %w", err)
+	}
+	archive, err := os.CreateTemp(tmpDir, "archive-*")
+	if err != nil {
+		return err
+	}
+	archive.Close()
+	defer os.Remove(archive.Name())
+
+	dir := m.goModuleDir(ctx, repoPath, mod, commit)
+	args := []string{"-C", repoPath, "-c", "core.autocrlf=input", "-c", "core.eol=lf",
+		"archive", "--format=zip", "--output=" + archive.Name(), commit}
+	if dir != "" {
+		args = append(args, dir)
+	}
+	if output, err := exec.CommandContext(ctx, "git", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("git archive failed: %w\noutput: %s", err, output)
+	}
+	zr, err := zip.OpenReader(archive.Name())
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	var files []modzip.File
+	haveLicense := false
+	for _, f := range zr.File {
+		name, ok := strings.CutPrefix(f.Name, dir)
+		if dir != "" && (!ok || !strings.HasPrefix(name, "/")) {
+			continue
+		}
+		name = strings.TrimPrefix(name, "/")
+		if name == "" || strings.HasSuffix(name, "/") {
+			continue
+		}
+		files = append(files, zipFile{name: name, f: f})
+		haveLicense = haveLicense || name == "LICENSE"
+	}
+	// Modules in subdirectories inherit the LICENSE of the repo root
+	if !haveLicense && dir != "" {
+		if license, err := exec.CommandContext(ctx, "git", "-C", repoPath, "cat-file", "blob", commit+":LICENSE").Output(); err == nil {
+			files = append(files, dataFile{name: "LICENSE", data: license})
+		}
+	}
+
+	tmp, err := os.CreateTemp(tmpDir, "zip-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = modzip.Create(tmp, module.Version{Path: mod.Path, Version: version}, files)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("create module zip: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(zipPath), 0o755); err != nil {
+		return fmt.Errorf("create module zip dir: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), zipPath); err != nil {
+		return err
+	}
+	m.log.Debug("go module zip complete", "path", repoPath, "module", mod.Path, "version", version, "duration_ms", time.Since(start).Milliseconds())
+	return nil
+}
+
+// zipFile is a file of a git archive, as a module zip file.
+type zipFile struct {
+	name string
+	f    *zip.File
+}
+
+func (f zipFile) Path() string                 { return f.name }
+func (f zipFile) Lstat() (fs.FileInfo, error)  { return f.f.FileInfo(), nil }
+func (f zipFile) Open() (io.ReadCloser, error) { return f.f.Open() }
+
+// dataFile is an in-memory module zip file.
+type dataFile struct {
+	name string
+	data []byte
+}
+
+func (f dataFile) Path() string                 { return f.name }
+func (f dataFile) Lstat() (fs.FileInfo, error)  { return dataFileInfo(f), nil }
+func (f dataFile) Open() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(f.data)), nil }
+
+type dataFileInfo dataFile
+
+func (f dataFileInfo) Name() string       { return path.Base(f.name) }
+func (f dataFileInfo) Size() int64        { return int64(len(f.data)) }
+func (f dataFileInfo) Mode() fs.FileMode  { return 0o644 }
+func (f dataFileInfo) ModTime() time.Time { return time.Time{} }
+func (f dataFileInfo) IsDir() bool        { return false }
+func (f dataFileInfo) Sys() any           { return nil }
@@ -0,0 +1,125 @@
+package mirror
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// lfsDir is the content-addressed LFS object store, relative to the mirror root.
+const lfsDir = ".lfs"
+
+var lfsOIDPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ValidLFSOID reports whether oid is a valid sha256 LFS object id.
+func ValidLFSOID(oid string) bool {
+	return lfsOIDPattern.MatchString(oid)
+}
+
+// LFSObjectPath returns the filesystem path for an LFS object (same layout as git-lfs).
+func (m *Mirror) LFSObjectPath(oid string) string {
+	return filepath.Join(m.root, lfsDir, "objects", oid[0:2], oid[2:4], oid)
+}
+
+// LFSObject returns the path of a stored LFS object, fetching it from href
+// (an upstream download action) if it is not stored yet.
+// Concurrent requests for the same object share a single download.
+func (m *Mirror) LFSObject(ctx context.Context, oid string, size int64, href string, header map[string]string) (string, error) {
+	if !ValidLFSOID(oid) {
+		return "", fmt.Errorf("invalid lfs oid %q", oid)
+	}
+	objPath := m.LFSObjectPath(oid)
+	key := filepath.Join(lfsDir, "objects", oid[0:2], oid[2:4], oid)
+
+	if _, err := os.Stat(objPath); err == nil {
+		m.cache.Touch(key)
+		return objPath, nil
+	}
+
+	_, err, shared := m.group.Do("lfs:"+oid, func() (interface{}, error) {
+		if _, err := os.Stat(objPath); err == nil {
+			return nil, nil
+		}
+		// Detach from the client request: other clients may be waiting on this download
+		dlCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Minute)
+		defer cancel()
+		if err := m.downloadLFSObject(dlCtx, oid, size, href, header); err != nil {
+			return nil, err
+		}
+		m.background.Go(m.cache.MaybeEvict)
+		return nil, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if shared {
+		m.log.Debug("waited for in-flight lfs download", "oid", oid)
+	}
+	m.cache.Touch(key)
+	return objPath, nil
+}
+
+// downloadLFSObject fetches an LFS object and stores it after verifying its size and hash.
+func (m *Mirror) downloadLFSObject(ctx context.Context, oid string, size int64, href string, header map[string]string) error {
+	start := time.Now()
+	m.log.Info("downloading lfs object", "oid", oid, "size", size)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, href, nil)
+	if err != nil {
+		return fmt.Errorf("lfs download request: %w", err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	res, err := m.upstream.Do(req)
+	if err != nil {
+		return fmt.Errorf("lfs download: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("lfs download: unexpected status %d", res.StatusCode)
+	}
+
+	tmpDir := filepath.Join(m.root, lfsDir, "tmp")
+	if err := os.MkdirAll(tmpDir, 0o755); err != nil {
+		return fmt.Errorf("create lfs tmp dir: %w", err)
+	}
+	tmp, err := os.CreateTemp(tmpDir, oid+"-*")
+	if err != nil {
+		return fmt.Errorf("create lfs tmp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), res.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("lfs download: %w", err)
+	}
+	if n != size {
+		return fmt.Errorf("lfs object %s: expected %d bytes, got %d", oid, size, n)
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != oid {
+		return fmt.Errorf("lfs object %s: hash mismatch (got %s)", oid, got)
+	}
+
+	objPath := m.LFSObjectPath(oid)
+	if err := os.MkdirAll(filepath.Dir(objPath), 0o755); err != nil {
+		return fmt.Errorf("create lfs object dir: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), objPath); err != nil {
+		return fmt.Errorf("store lfs object: %w", err)
+	}
+
+	m.log.Info("lfs object stored", "oid", oid, "size", size, "duration_ms", time.Since(start).Milliseconds())
+	return nil
+}
@@ -2,7 +2,6 @@ package mirror
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -68,11 +67,19 @@ type Mirror struct {
 	cache             *Cache
 	packThreads       int
 	maintainAfterSync bool
+	bundleInterval    time.Duration     // Clone bundles are regenerated when older than this, 0 disables them
+	upstreamCAs       map[string]string // CA bundle per upstream URL prefix, passed to git as http.<url>.sslCAInfo
+	syncHook          SyncHook          // Called in the background after each successful clone or sync
+	auth              *authCache        // Upstream authorization decisions for private repos, nil disables caching
+	credentialHook    CredentialHook    // Told whether upstream accepted the credential of each clone and sync
+	upstream          *http.Client      // Access checks and LFS downloads, verified like git does with upstreamCAs
 
 	group      singleflight.Group
 	maintGroup singleflight.Group
-	lastSync   sync.Map // map[repoKey]time.Time
-	repoLocks  sync.Map // map[repoKey]*sync.Mutex
+	lastSync   sync.Map       // map[repoKey]time.Time
+	repoLocks  sync.Map       // map[repoKey]*sync.Mutex
+	refsStates sync.Map       // map[repoPath]string, refs fingerprint for pack cache keys
+	background sync.WaitGroup // Maintenance, eviction and sync hooks outliving the request that started them
 }
 
 // New creates a new Mirror manager.
@@ -88,9 +95,23 @@ func New(root string, staleAfter time.Duration, maxSize config.SizeSpec, packThr
 		cache:             NewCache(root, maxSize, log),
 		packThreads:       packThreads,
 		maintainAfterSync: maintainAfterSync,
+		upstream:          &http.Client{},
 	}, nil
 }
 
+// SetUpstreamCAs makes git verify upstreams under each URL prefix (e.g.
+// https://ghe.example.com/) against the given CA bundle file.
+func (m *Mirror) SetUpstreamCAs(cas map[string]string) {
+	m.upstreamCAs = cas
+}
+
+// SetUpstreamTransport sends the access checks made with client credentials
+// and LFS downloads through rt, so they verify upstream certificates like git
+// syncs do.
+func (m *Mirror) SetUpstreamTransport(rt http.RoundTripper) {
+	m.upstream = &http.Client{Transport: rt}
+}
+
 // RepoPath returns the filesystem path for a repo mirror.
 func (m *Mirror) RepoPath(repoRelPath *RepoRelPath) string {
 	return filepath.Join(m.root, repoRelPath.String()+".git")
@@ -100,6 +121,14 @@ func (m *Mirror) RepoPath(repoRelPath *RepoRelPath) string {
 // authHeader is the Authorization header value from the client request (can be empty).
 // Returns the path to the bare repo and the cache status.
 func (m *Mirror) EnsureRepo(ctx context.Context, repoRelPath *RepoRelPath, upstreamURL, authHeader string) (string, Status, error) {
+	return m.EnsureRepoAs(ctx, repoRelPath, upstreamURL, authHeader, authHeader)
+}
+
+// EnsureRepoAs is EnsureRepo for mirrors synced with a credential of the
+// proxy rather than the client's: clones and syncs use authHeader, while
+// access to private mirrors is checked with clientAuth, including right after
+// a clone or sync.
+func (m *Mirror) EnsureRepoAs(ctx context.Context, repoRelPath *RepoRelPath, upstreamURL, authHeader, clientAuth string) (string, Status, error) {
 	start := time.Now()
 	repoPath := m.RepoPath(repoRelPath)
 	key := repoRelPath.String()
@@ -121,7 +150,11 @@ func (m *Mirror) EnsureRepo(ctx context.Context, repoRelPath *RepoRelPath, upstr
 			m.lastSync.Store(key, time.Now())
 			m.cache.Touch(key)
 			// Trigger LRU eviction check in background after clone
-			go m.cache.MaybeEvict()
+			m.background.Go(m.cache.MaybeEvict)
+			if authHeader != "" {
+				m.auth.put(key, authHeader, true)
+			}
+			m.runSyncHook(ctx, repoRelPath, repoPath, authHeader)
 			return StatusClone, nil
 		}
 		// Repo already exists, signal that no clone was needed
@@ -136,6 +169,13 @@ func (m *Mirror) EnsureRepo(ctx context.Context, repoRelPath *RepoRelPath, upstr
 		m.log.Info("waited for in-flight clone check", "repo", key, "status", status, "wait_duration_ms", time.Since(cloneCheckStart).Milliseconds())
 	}
 	if status == StatusClone {
+		// The clone only proves the credential it was made with, which is
+		// another client's if this one joined it
+		if shared || clientAuth != authHeader {
+			if err := m.checkAuth(ctx, key, repoPath, upstreamURL, clientAuth, clientAuth != authHeader); err != nil {
+				return "", "", err
+			}
+		}
 		m.log.Debug("ensure repo complete (clone)", "repo", key, "total_duration_ms", time.Since(start).Milliseconds())
 		return repoPath, status, nil
 	}
@@ -146,44 +186,140 @@ func (m *Mirror) EnsureRepo(ctx context.Context, repoRelPath *RepoRelPath, upstr
 	// Check if we need to sync first - sync validates auth implicitly via git fetch
 	// This avoids a separate ls-remote call (~110ms) when we're going to fetch anyway
 	status = StatusHit
+	syncShared := false
 	if m.isStale(key) {
 		syncStart := time.Now()
 		// Sync using singleflight (concurrent requests share same fetch)
-		_, err, shared := m.group.Do("sync:"+key, func() (interface{}, error) {
-			return nil, m.syncRepo(ctx, repoPath, upstreamURL, authHeader)
-		})
+		_, shared, err := m.syncOnce(ctx, key, repoPath, upstreamURL, authHeader)
 		if shared {
 			m.log.Debug("waited for in-flight sync", "repo", key, "wait_duration_ms", time.Since(syncStart).Milliseconds())
 		}
 		if err != nil {
 			// Continue serving stale data, but still report as hit
 			m.log.Warn("sync failed, serving stale", "repo", key, "err", err, "duration_ms", time.Since(syncStart).Milliseconds())
+			if isAuthFailure(err) {
+				// Access may have been revoked, check again below
+				m.auth.invalidate(key)
+			}
 		} else {
 			status = StatusSync
+			syncShared = shared
 			m.lastSync.Store(key, time.Now())
+			if !shared && authHeader != "" {
+				m.auth.put(key, authHeader, true)
+			}
 			m.log.Debug("ensure repo complete (sync)", "repo", key, "sync_duration_ms", time.Since(syncStart).Milliseconds(), "total_duration_ms", time.Since(start).Milliseconds())
 
 			if m.maintainAfterSync {
 				m.scheduleOptimize(repoPath, false)
 			}
+			if !shared {
+				m.scheduleBundle(repoPath)
+				m.runSyncHook(ctx, repoRelPath, repoPath, authHeader)
+			}
 		}
 	} else {
 		m.log.Debug("ensure repo complete (hit)", "repo", key, "total_duration_ms", time.Since(start).Milliseconds())
 	}
 
 	// Repo is fresh - validate auth only for private repos (cache hit case)
-	// If sync was successful, authentication validity is already guaranteed
-	if m.requiresAuth(repoPath) && status != StatusSync {
-		authStart := time.Now()
-		if err := m.validateAuth(ctx, upstreamURL, authHeader); err != nil {
-			m.log.Warn("auth validation failed", "repo", key, "err", err, "duration_ms", time.Since(authStart).Milliseconds())
-			return "", "", fmt.Errorf("authentication required: %w", err)
+	// A sync this request made itself with the client's credential already
+	// proved it; a joined one proved someone else's
+	if status != StatusSync || syncShared || clientAuth != authHeader {
+		if err := m.checkAuth(ctx, key, repoPath, upstreamURL, clientAuth, clientAuth != authHeader); err != nil {
+			return "", "", err
 		}
-		m.log.Debug("auth validation passed", "repo", key, "duration_ms", time.Since(authStart).Milliseconds())
 	}
 	return repoPath, status, nil
 }
 
+// checkAuth makes sure upstream grants authHeader access to the mirror at
+// repoPath if it is private, from the decision cache when possible. When
+// upstream gives no definite answer, access is allowed unless failClosed.
+func (m *Mirror) checkAuth(ctx context.Context, key, repoPath, upstreamURL, authHeader string, failClosed bool) error {
+	if !m.requiresAuth(repoPath) {
+		return nil
+	}
+	if allowed, ok := m.auth.get(key, authHeader); ok {
+		if !allowed {
+			m.log.Debug("auth validation failed (cached)", "repo", key)
+			return fmt.Errorf("%w: access denied by upstream", ErrAuthDenied)
+		}
+		m.log.Debug("auth validation passed (cached)", "repo", key)
+		return nil
+	}
+	authStart := time.Now()
+	decided, err := m.validateAuth(ctx, upstreamURL, authHeader)
+	if decided {
+		m.auth.put(key, authHeader, err == nil)
+	} else if err != nil && !failClosed {
+		// Don't let an upstream incident take private repos down
+		m.log.Warn("auth validation inconclusive, allowing", "repo", key, "err", err)
+		return nil
+	}
+	if err != nil {
+		m.log.Warn("auth validation failed", "repo", key, "err", err, "duration_ms", time.Since(authStart).Milliseconds())
+		return err
+	}
+	m.log.Debug("auth validation passed", "repo", key, "duration_ms", time.Since(authStart).Milliseconds())
+	return nil
+}
+
+// Refresh syncs an existing mirror right away, regardless of SYNC_STALE_AFTER,
+// with a fetch started no earlier than notBefore. A sync in flight that
+// started since is joined; an older one may have missed the caller's change,
+// so it is waited for and followed by a new one. Fetches of a repo never run
+// concurrently. It does nothing if the mirror has not been cloned yet.
+func (m *Mirror) Refresh(ctx context.Context, repoRelPath *RepoRelPath, upstreamURL, authHeader string, notBefore time.Time) error {
+	start := time.Now()
+	repoPath := m.RepoPath(repoRelPath)
+	key := repoRelPath.String()
+
+	if _, err := os.Stat(repoPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	for {
+		started, shared, err := m.syncOnce(ctx, key, repoPath, upstreamURL, authHeader)
+		if started.Before(notBefore) {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue
+		}
+		if err != nil {
+			if isAuthFailure(err) {
+				m.auth.invalidate(key)
+			}
+			return err
+		}
+		if shared {
+			m.log.Debug("refresh joined in-flight sync", "repo", key, "duration_ms", time.Since(start).Milliseconds())
+			return nil
+		}
+		break
+	}
+	m.lastSync.Store(key, time.Now())
+	m.log.Debug("refresh complete", "repo", key, "duration_ms", time.Since(start).Milliseconds())
+
+	if m.maintainAfterSync {
+		m.scheduleOptimize(repoPath, false)
+	}
+	m.scheduleBundle(repoPath)
+	m.runSyncHook(ctx, repoRelPath, repoPath, authHeader)
+	return nil
+}
+
+// syncOnce runs syncRepo, or joins the sync of key already in flight, and
+// returns when that sync started.
+func (m *Mirror) syncOnce(ctx context.Context, key, repoPath, upstreamURL, authHeader string) (started time.Time, shared bool, err error) {
+	v, err, shared := m.group.Do("sync:"+key, func() (interface{}, error) {
+		started := time.Now()
+		return started, m.syncRepo(ctx, repoPath, upstreamURL, authHeader)
+	})
+	return v.(time.Time), shared, err
+}
+
 // isStale returns true if the repo needs syncing.
 func (m *Mirror) isStale(key string) bool {
 	lastSync, ok := m.lastSync.Load(key)
@@ -204,38 +340,44 @@ func (m *Mirror) markRequiresAuth(repoPath string) error {
 	return os.WriteFile(filepath.Join(repoPath, ".requires-auth"), []byte("1"), 0o644)
 }
 
-// validateAuth validates the auth token can access the upstream repo using git ls-remote.
-func (m *Mirror) validateAuth(ctx context.Context, upstreamURL, authHeader string) error {
+// validateAuth checks that authHeader grants access to the upstream repo with
+// an info/refs request. 401, 403 and 404 answers deny access. decided is false,
+// with an error, when upstream gave no definite answer (outage, rate limit,
+// server error); the caller chooses whether that denies access.
+func (m *Mirror) validateAuth(ctx context.Context, upstreamURL, authHeader string) (decided bool, err error) {
 	start := time.Now()
 	parsedUrl, err := url.Parse(upstreamURL)
 	if err != nil {
 		m.log.Error("auth validation failed", "duration_ms", time.Since(start).Milliseconds(), "upstream", upstreamURL)
-		return fmt.Errorf("Failed to parse upstreamURL: %s", err)
+		return false, fmt.Errorf("Failed to parse upstreamURL: %s", err)
 	}
 	parsedUrl = parsedUrl.JoinPath("info", "refs")
-	parsedUrl.Query().Set("service", "git-upload-pack")
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	client := &http.Client{Transport: tr}
-	req, err := http.NewRequest("GET", parsedUrl.String(), nil)
+	parsedUrl.RawQuery = "service=git-upload-pack"
+	req, err := http.NewRequestWithContext(ctx, "GET", parsedUrl.String(), nil)
 	if err != nil {
 		m.log.Error("auth validation failed during req setup", "error", err)
-		return err
+		return false, err
 	}
-	req.Header.Add("Authorization", authHeader)
-	res, err := client.Do(req)
-
+	if authHeader != "" {
+		req.Header.Add("Authorization", authHeader)
+	}
+	res, err := m.upstream.Do(req)
 	if err != nil {
-		// When failed to auhenticate due to upstream outage, proceed the process assuming that the auth info is valid
 		m.log.Warn("auth validation failed due to upstream outage", "duration_ms", time.Since(start).Milliseconds(), "upstream", upstreamURL, "error", err)
-	} else if res.StatusCode == http.StatusUnauthorized {
-		m.log.Error("auth validation failed", "duration_ms", time.Since(start).Milliseconds(), "upstream", upstreamURL)
-		return fmt.Errorf("git ls-remote failed")
-	} else {
-		m.log.Debug("auth validation complete", "duration_ms", time.Since(start).Milliseconds(), "upstream", upstreamURL)
+		return false, fmt.Errorf("check access upstream: %w", err)
 	}
-	return nil
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden || res.StatusCode == http.StatusNotFound:
+		m.log.Error("auth validation failed", "duration_ms", time.Since(start).Milliseconds(), "upstream", upstreamURL, "status", res.StatusCode)
+		return true, fmt.Errorf("%w: upstream answered %s", ErrAuthDenied, res.Status)
+	case res.StatusCode/100 != 2:
+		m.log.Warn("auth validation inconclusive", "duration_ms", time.Since(start).Milliseconds(), "upstream", upstreamURL, "status", res.StatusCode)
+		return false, fmt.Errorf("check access upstream: upstream answered %s", res.Status)
+	}
+	m.log.Debug("auth validation complete", "duration_ms", time.Since(start).Milliseconds(), "upstream", upstreamURL)
+	return true, nil
 }
 
 // cloneRepo creates a new bare mirror.
@@ -262,11 +404,15 @@ func (m *Mirror) cloneRepo(ctx context.Context, repoPath, upstreamURL, authHeade
 
 	cloneStart := time.Now()
 	cmd := exec.CommandContext(ctx, "git", args...)
-	cmd.Env = gitEnv(authHeader)
+	cmd.Env = m.gitEnv(authHeader)
 	output, err := cmd.CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("git clone failed: %w\noutput: %s", err, output)
+	}
+	m.reportCredential(ctx, upstreamURL, authHeader, err)
 	if err != nil {
 		m.log.Debug("git clone failed", "duration_ms", time.Since(cloneStart).Milliseconds(), "path", repoPath)
-		return fmt.Errorf("git clone failed: %w\noutput: %s", err, output)
+		return err
 	}
 	m.log.Debug("git clone command complete", "duration_ms", time.Since(cloneStart).Milliseconds(), "path", repoPath)
 
@@ -330,6 +476,9 @@ func (m *Mirror) optimizeRepo(ctx context.Context, repoPath string, full bool) {
 		m.log.Debug("git multi-pack-index complete", "path", repoPath, "duration_ms", time.Since(midxStart).Milliseconds())
 	}
 
+	// Clone bundle advertised through bundle-uri
+	m.refreshBundle(ctx, repoPath)
+
 	m.log.Info("repo optimization complete", "path", repoPath, "full", full, "total_duration_ms", time.Since(start).Milliseconds())
 }
 
@@ -351,11 +500,24 @@ func (m *Mirror) syncRepo(ctx context.Context, repoPath, upstreamURL, authHeader
 	}
 
 	cmd := exec.CommandContext(ctx, "git", args...)
-	cmd.Env = gitEnv(authHeader)
+	cmd.Env = m.gitEnv(authHeader)
 	output, err := cmd.CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("git fetch failed: %w\noutput: %s", err, output)
+	}
+	m.reportCredential(ctx, upstreamURL, authHeader, err)
 	if err != nil {
 		m.log.Debug("git fetch failed", "duration_ms", time.Since(start).Milliseconds(), "path", repoPath)
-		return fmt.Errorf("git fetch failed: %w\noutput: %s", err, output)
+		return err
+	}
+
+	// Cached packs are only valid for the refs they were computed from
+	if _, ok := m.refsStates.Load(repoPath); ok {
+		if _, err := m.updateRefsState(ctx, repoPath); err != nil {
+			m.log.Warn("failed to update refs state", "path", repoPath, "err", err)
+			m.refsStates.Delete(repoPath)
+			m.invalidatePackCache(repoPath)
+		}
 	}
 
 	m.log.Debug("sync complete", "path", repoPath, "duration_ms", time.Since(start).Milliseconds())
@@ -402,7 +564,7 @@ func (m *Mirror) MaintainAll(ctx context.Context, full bool) error {
 
 // scheduleOptimize runs optimizeRepo with a per-repo singleflight to avoid concurrent maintenance.
 func (m *Mirror) scheduleOptimize(repoPath string, full bool) {
-	go func() {
+	m.background.Go(func() {
 		_, err, _ := m.maintGroup.Do(repoPath, func() (interface{}, error) {
 			m.optimizeRepo(context.Background(), repoPath, full)
 			return nil, nil
@@ -410,7 +572,13 @@ func (m *Mirror) scheduleOptimize(repoPath string, full bool) {
 		if err != nil {
 			m.log.Warn("optimize singleflight failed", "path", repoPath, "err", err)
 		}
-	}()
+	})
+}
+
+// Wait blocks until the maintenance, eviction and sync hooks running in the
+// background are done.
+func (m *Mirror) Wait() {
+	m.background.Wait()
 }
 
 // SetLastSync is a test helper to seed lastSync for a repo key.
@@ -419,19 +587,29 @@ func (m *Mirror) SetLastSync(repoKey string, t time.Time) {
 }
 
 // gitEnv returns environment variables for git commands.
-// Uses GIT_CONFIG_* env vars to pass auth without persisting to repo config.
-func gitEnv(authHeader string) []string {
+// Uses GIT_CONFIG_* env vars to pass auth and upstream CAs without persisting
+// them to repo config.
+func (m *Mirror) gitEnv(authHeader string) []string {
 	env := append(os.Environ(),
 		"GIT_TERMINAL_PROMPT=0",
 		"GIT_CONFIG_GLOBAL=/dev/null",
 		"GIT_CONFIG_SYSTEM=/dev/null",
 	)
+	var config [][2]string
 	if authHeader != "" {
-		env = append(env,
-			"GIT_CONFIG_COUNT=1",
-			"GIT_CONFIG_KEY_0=http.extraheader",
-			fmt.Sprintf("GIT_CONFIG_VALUE_0=Authorization: %s", authHeader),
-		)
+		config = append(config, [2]string{"http.extraheader", "Authorization: " + authHeader})
+	}
+	for prefix, caFile := range m.upstreamCAs {
+		config = append(config, [2]string{"http." + prefix + ".sslCAInfo", caFile})
+	}
+	if len(config) > 0 {
+		env = append(env, fmt.Sprintf("GIT_CONFIG_COUNT=%d", len(config)))
+		for i, kv := range config {
+			env = append(env,
+				fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", i, kv[0]),
+				fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", i, kv[1]),
+			)
+		}
 	}
 	return env
 }
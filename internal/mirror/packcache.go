@@ -0,0 +1,109 @@
+package mirror
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// packCacheDir holds cached upload-pack responses, relative to the mirror root.
+// Entries live under the repo key (host/owner/repo) and are keyed by the
+// refs state of the mirror and the normalized client request.
+const packCacheDir = ".packcache"
+
+// PackCacheEntry is a cached upload-pack response location.
+type PackCacheEntry struct {
+	Path string // Final location of the cached response
+	key  string // Cache key used for LRU tracking
+}
+
+// PackCacheEntry returns the cache entry for a normalized upload-pack request
+// against repoRelPath, and whether a cached response exists for it.
+func (m *Mirror) PackCacheEntry(ctx context.Context, repoRelPath *RepoRelPath, request []byte) (*PackCacheEntry, bool, error) {
+	refs, err := m.refsState(ctx, m.RepoPath(repoRelPath))
+	if err != nil {
+		return nil, false, err
+	}
+	h := sha256.New()
+	h.Write([]byte(refs))
+	h.Write([]byte{0})
+	h.Write(request)
+	name := hex.EncodeToString(h.Sum(nil))
+
+	key := filepath.Join(packCacheDir, repoRelPath.String(), name)
+	entry := &PackCacheEntry{Path: filepath.Join(m.root, key), key: key}
+	if _, err := os.Stat(entry.Path); err == nil {
+		m.cache.Touch(key)
+		return entry, true, nil
+	}
+	return entry, false, nil
+}
+
+// CreatePackCacheTemp creates a temporary file to write a response for entry into.
+func (m *Mirror) CreatePackCacheTemp() (*os.File, error) {
+	tmpDir := filepath.Join(m.root, packCacheDir, "tmp")
+	if err := os.MkdirAll(tmpDir, 0o755); err != nil {
+		return nil, fmt.Errorf("create pack cache tmp dir: %w", err)
+	}
+	return os.CreateTemp(tmpDir, "pack-*")
+}
+
+// CommitPackCache moves a fully written temporary file into the cache.
+func (m *Mirror) CommitPackCache(entry *PackCacheEntry, tmpPath string) error {
+	if err := os.MkdirAll(filepath.Dir(entry.Path), 0o755); err != nil {
+		return fmt.Errorf("create pack cache dir: %w", err)
+	}
+	if err := os.Rename(tmpPath, entry.Path); err != nil {
+		return fmt.Errorf("store pack cache entry: %w", err)
+	}
+	m.cache.Touch(entry.key)
+	m.background.Go(m.cache.MaybeEvict)
+	return nil
+}
+
+// invalidatePackCache drops all cached responses for the repo at repoPath.
+func (m *Mirror) invalidatePackCache(repoPath string) {
+	rel, err := filepath.Rel(m.root, repoPath)
+	if err != nil {
+		return
+	}
+	dir := filepath.Join(m.root, packCacheDir, strings.TrimSuffix(rel, ".git"))
+	if err := os.RemoveAll(dir); err != nil {
+		m.log.Warn("failed to invalidate pack cache", "path", dir, "err", err)
+		return
+	}
+	m.log.Debug("pack cache invalidated", "path", dir)
+}
+
+// refsState returns a fingerprint of the refs of the repo at repoPath,
+// computing it if it isn't known yet.
+func (m *Mirror) refsState(ctx context.Context, repoPath string) (string, error) {
+	if v, ok := m.refsStates.Load(repoPath); ok {
+		return v.(string), nil
+	}
+	state, err := m.updateRefsState(ctx, repoPath)
+	return state, err
+}
+
+// updateRefsState recomputes the refs fingerprint of the repo at repoPath and
+// invalidates cached packs if refs changed since it was last computed.
+func (m *Mirror) updateRefsState(ctx context.Context, repoPath string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "for-each-ref", "--format=%(objectname) %(refname)")
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git for-each-ref failed: %w", err)
+	}
+	sum := sha256.Sum256(out)
+	state := hex.EncodeToString(sum[:])
+
+	prev, loaded := m.refsStates.Swap(repoPath, state)
+	if loaded && prev.(string) != state {
+		m.invalidatePackCache(repoPath)
+	}
+	return state, nil
+}
@@ -0,0 +1,79 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// ErrNotFound is returned by ResolveBlob when no file matches.
+var ErrNotFound = errors.New("not found")
+
+// ResolveBlob finds the file addressed by refPath, "<ref>/<path>", in the
+// mirror at repoPath and returns its blob id and size. The ref may contain
+// slashes: the shortest ref for which the remainder names a file wins.
+func (m *Mirror) ResolveBlob(ctx context.Context, repoPath, refPath string) (oid string, size int64, err error) {
+	if strings.Contains(refPath, "\n") {
+		return "", 0, ErrNotFound
+	}
+	parts := strings.Split(refPath, "/")
+	var candidates []string
+	for i := 1; i < len(parts); i++ {
+		ref, path := strings.Join(parts[:i], "/"), strings.Join(parts[i:], "/")
+		if ref == "" || path == "" || strings.HasPrefix(ref, "-") || strings.Contains(ref, ":") {
+			continue
+		}
+		candidates = append(candidates, ref+":"+path)
+	}
+	if len(candidates) == 0 {
+		return "", 0, ErrNotFound
+	}
+
+	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "cat-file", "--batch-check")
+	cmd.Stdin = strings.NewReader(strings.Join(candidates, "\n") + "\n")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", 0, fmt.Errorf("git cat-file failed: %w", err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[1] != "blob" {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		return fields[0], size, nil
+	}
+	return "", 0, ErrNotFound
+}
+
+// BlobReader streams the content of blob oid from the mirror at repoPath.
+// The caller must close the reader, which also waits for git to exit.
+func (m *Mirror) BlobReader(ctx context.Context, repoPath, oid string) (io.ReadCloser, error) {
+	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "cat-file", "blob", oid)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("git cat-file failed: %w", err)
+	}
+	return &cmdReader{ReadCloser: stdout, cmd: cmd}, nil
+}
+
+// cmdReader is the stdout of a command, waiting for it on Close.
+type cmdReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (r *cmdReader) Close() error {
+	_ = r.ReadCloser.Close()
+	return r.cmd.Wait()
+}
@@ -0,0 +1,114 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Ref is a ref of a mirror. Peeled is the commit an annotated tag points to.
+type Ref struct {
+	Name   string `json:"ref"`
+	SHA    string `json:"sha"`
+	Peeled string `json:"peeled,omitempty"`
+}
+
+// Signature is the author or committer of a commit.
+type Signature struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	Date  string `json:"date"`
+}
+
+// CommitInfo describes a commit of a mirror.
+type CommitInfo struct {
+	SHA       string    `json:"sha"`
+	Tree      string    `json:"tree"`
+	Parents   []string  `json:"parents"`
+	Author    Signature `json:"author"`
+	Committer Signature `json:"committer"`
+	Message   string    `json:"message"`
+}
+
+// ListRefs returns the refs of the mirror at repoPath whose name starts with
+// prefix (e.g. refs/tags/v1), all of them if prefix is empty.
+func (m *Mirror) ListRefs(ctx context.Context, repoPath, prefix string) ([]Ref, error) {
+	out, err := exec.CommandContext(ctx, "git", "-C", repoPath, "for-each-ref", "--format=%(objectname) %(refname) %(*objectname)").Output()
+	if err != nil {
+		return nil, fmt.Errorf("git for-each-ref failed: %w", err)
+	}
+	refs := []Ref{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.HasPrefix(fields[1], prefix) {
+			continue
+		}
+		ref := Ref{SHA: fields[0], Name: fields[1]}
+		if len(fields) == 3 {
+			ref.Peeled = fields[2]
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+// ResolveRef returns the commit a ref (or any revision) points to.
+func (m *Mirror) ResolveRef(ctx context.Context, repoPath, rev string) (string, error) {
+	if rev == "" || strings.HasPrefix(rev, "-") {
+		return "", fmt.Errorf("%w: %s", ErrUnknownRevision, rev)
+	}
+	out, err := exec.CommandContext(ctx, "git", "-C", repoPath, "rev-parse", "--verify", "--quiet", rev+"^{commit}").Output()
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrUnknownRevision, rev)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// IsAncestor reports whether commit is an ancestor of (or the same as) ref.
+func (m *Mirror) IsAncestor(ctx context.Context, repoPath, commit, ref string) (bool, error) {
+	commitSHA, err := m.ResolveRef(ctx, repoPath, commit)
+	if err != nil {
+		return false, err
+	}
+	refSHA, err := m.ResolveRef(ctx, repoPath, ref)
+	if err != nil {
+		return false, err
+	}
+	err = exec.CommandContext(ctx, "git", "-C", repoPath, "merge-base", "--is-ancestor", commitSHA, refSHA).Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("git merge-base failed: %w", err)
+	}
+	return true, nil
+}
+
+// Commit returns the metadata of the commit rev resolves to.
+func (m *Mirror) Commit(ctx context.Context, repoPath, rev string) (*CommitInfo, error) {
+	sha, err := m.ResolveRef(ctx, repoPath, rev)
+	if err != nil {
+		return nil, err
+	}
+	out, err := exec.CommandContext(ctx, "git", "-C", repoPath, "show", "--no-patch",
+		"--format=%H%x00%T%x00%P%x00%an%x00%ae%x00%aI%x00%cn%x00%ce%x00%cI%x00%B", sha).Output()
+	if err != nil {
+		return nil, fmt.Errorf("git show failed: %w", err)
+	}
+	f := bytes.SplitN(out, []byte{0}, 10)
+	if len(f) != 10 {
+		return nil, fmt.Errorf("unexpected git show output for %s", sha)
+	}
+	return &CommitInfo{
+		SHA:       string(f[0]),
+		Tree:      string(f[1]),
+		Parents:   strings.Fields(string(f[2])),
+		Author:    Signature{Name: string(f[3]), Email: string(f[4]), Date: string(f[5])},
+		Committer: Signature{Name: string(f[6]), Email: string(f[7]), Date: string(f[8])},
+		Message:   strings.TrimRight(string(f[9]), "\n"),
+	}, nil
+}
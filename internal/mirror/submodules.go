@@ -0,0 +1,54 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// SyncHook is called after a mirror has been cloned or synced, with the
+// context of the request that triggered it (detached from its cancellation)
+// and the Authorization header used for the sync.
+type SyncHook func(ctx context.Context, repoRelPath *RepoRelPath, repoPath, authHeader string)
+
+// SetSyncHook installs hook, run in the background after each successful
+// clone or sync.
+func (m *Mirror) SetSyncHook(hook SyncHook) {
+	m.syncHook = hook
+}
+
+func (m *Mirror) runSyncHook(ctx context.Context, repoRelPath *RepoRelPath, repoPath, authHeader string) {
+	if m.syncHook == nil {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	m.background.Go(func() { m.syncHook(ctx, repoRelPath, repoPath, authHeader) })
+}
+
+// SubmoduleURLs returns the URLs of the submodules declared in .gitmodules
+// on the default branch of the mirror at repoPath, as written there (they
+// may be relative to the superproject URL).
+func (m *Mirror) SubmoduleURLs(ctx context.Context, repoPath string) ([]string, error) {
+	if err := exec.CommandContext(ctx, "git", "-C", repoPath, "cat-file", "-e", "HEAD:.gitmodules").Run(); err != nil {
+		return nil, nil
+	}
+	out, err := exec.CommandContext(ctx, "git", "-C", repoPath, "config", "--blob", "HEAD:.gitmodules",
+		"--get-regexp", `^submodule\..*\.url$`).Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		// No submodule has a URL
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("git config --blob failed: %w", err)
+	}
+	var urls []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if _, url, ok := strings.Cut(line, " "); ok && url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls, nil
+}
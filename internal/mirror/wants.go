@@ -0,0 +1,88 @@
+package mirror
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// HasObjects reports whether every object id of ids and every ref of refs
+// resolves to an object in the mirror at repoPath. Both come from clients
+// and cat-file takes any revision expression, so anything but a full object
+// id or a refs/ name is reported missing without asking git.
+func (m *Mirror) HasObjects(ctx context.Context, repoPath string, ids, refs []string) (bool, error) {
+	for _, id := range ids {
+		if !isObjectID(id) {
+			return false, nil
+		}
+	}
+	for _, ref := range refs {
+		if !isRefName(ref) {
+			return false, nil
+		}
+	}
+	names := append(append([]string(nil), ids...), refs...)
+	if len(names) == 0 {
+		return true, nil
+	}
+	cmd := exec.CommandContext(ctx, "git", "-C", repoPath, "cat-file", "--batch-check")
+	cmd.Stdin = strings.NewReader(strings.Join(names, "\n") + "\n")
+	output, err := cmd.Output()
+	if err != nil {
+		return false, fmt.Errorf("git cat-file failed: %w", err)
+	}
+	sc := bufio.NewScanner(bytes.NewReader(output))
+	for sc.Scan() {
+		if strings.HasSuffix(sc.Text(), " missing") {
+			return false, nil
+		}
+	}
+	return true, sc.Err()
+}
+
+// isObjectID reports whether s is a full SHA-1 or SHA-256 object id.
+func isObjectID(s string) bool {
+	if len(s) != 40 && len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// isRefName reports whether s is a ref name under refs/ that git reads as
+// that ref only, following the rules of git check-ref-format.
+func isRefName(s string) bool {
+	if !strings.HasPrefix(s, "refs/") || strings.Contains(s, "..") || strings.Contains(s, "@{") ||
+		strings.HasSuffix(s, ".") || strings.ContainsAny(s, " ~^:?*[\\") {
+		return false
+	}
+	for _, c := range s {
+		if c < 0x20 || c == 0x7f {
+			return false
+		}
+	}
+	for _, part := range strings.Split(s, "/")[1:] {
+		if part == "" || strings.HasPrefix(part, ".") || strings.HasSuffix(part, ".lock") {
+			return false
+		}
+	}
+	return true
+}
+
+// LastSync returns when the mirror of repoRelPath was last cloned or synced,
+// or the zero time if it hasn't been since the proxy started.
+func (m *Mirror) LastSync(repoRelPath *RepoRelPath) time.Time {
+	t, ok := m.lastSync.Load(repoRelPath.String())
+	if !ok {
+		return time.Time{}
+	}
+	return t.(time.Time)
+}
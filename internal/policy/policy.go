@@ -0,0 +1,153 @@
+// Package policy decides which repositories the proxy serves, from an
+// ordered list of allow and deny rules reloaded from disk when it changes.
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checkInterval bounds how often the rules file is checked for changes.
+const checkInterval = 5 * time.Second
+
+// Rule is an entry of the rules file. It applies to repos whose
+// host/owner/repo path matches Match (a path.Match glob, where * stops at
+// slashes) or Regex (against the whole path); exactly one of them is set.
+// Matching ignores case, as GitHub paths do.
+type Rule struct {
+	Name   string `json:"name,omitempty"` // Label in metrics and logs, defaults to the pattern
+	Action string `json:"action"`         // allow or deny
+	Match  string `json:"match,omitempty"`
+	Regex  string `json:"regex,omitempty"`
+	Reason string `json:"reason,omitempty"` // Sent to clients with the 403 of a deny rule
+
+	re *regexp.Regexp
+}
+
+// matches reports whether the rule applies to repo, lowercased.
+func (r *Rule) matches(repo string) bool {
+	if r.re != nil {
+		return r.re.MatchString(repo)
+	}
+	ok, _ := path.Match(strings.ToLower(r.Match), repo)
+	return ok
+}
+
+// Decision is the outcome of the rules for a repo.
+type Decision struct {
+	Allowed bool
+	Rule    string // Name of the matching rule, "default" if none matched
+	Reason  string
+}
+
+// Policy evaluates the rules of a file, first match wins. Repos matching no
+// rule are allowed, so a final {"action": "deny", "regex": ".*"} turns the
+// list into an allowlist.
+type Policy struct {
+	file string
+	log  *slog.Logger
+
+	mu        sync.Mutex
+	rules     []Rule
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+// Load reads the rules in file, failing if they are invalid.
+func Load(file string, log *slog.Logger) (*Policy, error) {
+	p := &Policy{file: file, log: log}
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, fmt.Errorf("read policy: %w", err)
+	}
+	if err := p.reloadLocked(info.ModTime()); err != nil {
+		return nil, err
+	}
+	p.checkedAt = time.Now()
+	return p, nil
+}
+
+// Evaluate returns the decision for repo (host/owner/repo), checking the
+// file for changes at most every checkInterval. If a reload fails, the
+// previous rules stay in force.
+func (p *Policy) Evaluate(repo string) Decision {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if time.Since(p.checkedAt) >= checkInterval {
+		p.checkedAt = time.Now()
+		if info, err := os.Stat(p.file); err != nil {
+			p.log.Warn("policy check failed", "file", p.file, "err", err)
+		} else if !info.ModTime().Equal(p.modTime) {
+			if err := p.reloadLocked(info.ModTime()); err != nil {
+				p.log.Error("policy reload failed, keeping previous rules", "file", p.file, "err", err)
+			} else {
+				p.log.Info("policy reloaded", "file", p.file, "rules", len(p.rules))
+			}
+		}
+	}
+
+	repo = strings.ToLower(repo)
+	for i := range p.rules {
+		r := &p.rules[i]
+		if r.matches(repo) {
+			return Decision{Allowed: r.Action == "allow", Rule: r.Name, Reason: r.Reason}
+		}
+	}
+	return Decision{Allowed: true, Rule: "default"}
+}
+
+func (p *Policy) reloadLocked(modTime time.Time) error {
+	data, err := os.ReadFile(p.file)
+	if err != nil {
+		return fmt.Errorf("read policy: %w", err)
+	}
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return fmt.Errorf("parse policy %s: %w", p.file, err)
+	}
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return fmt.Errorf("policy %s: rule %d: %w", p.file, i, err)
+		}
+	}
+	p.rules, p.modTime = rules, modTime
+	return nil
+}
+
+func (r *Rule) compile() error {
+	if r.Action != "allow" && r.Action != "deny" {
+		return fmt.Errorf("action %q must be allow or deny", r.Action)
+	}
+	pattern := r.Match
+	switch {
+	case (r.Match == "") == (r.Regex == ""):
+		return errors.New("exactly one of match or regex is required")
+	case r.Regex != "":
+		// Anchored, so github.com/our-org/.* doesn't admit our-org-evil
+		re, err := regexp.Compile("(?i)^(?:" + r.Regex + ")$")
+		if err != nil {
+			return fmt.Errorf("regex %q: %w", r.Regex, err)
+		}
+		r.re, pattern = re, r.Regex
+	default:
+		if _, err := path.Match(r.Match, ""); err != nil {
+			return fmt.Errorf("match %q: %w", r.Match, err)
+		}
+	}
+	if r.Name == "" {
+		r.Name = pattern
+	}
+	if r.Reason == "" && r.Action == "deny" {
+		r.Reason = "repository denied by policy rule " + r.Name
+	}
+	return nil
+}
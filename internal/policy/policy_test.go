@@ -0,0 +1,79 @@
+package policy
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeRules(t *testing.T, file, rules string, mod time.Time) {
+	t.Helper()
+	if err := os.WriteFile(file, []byte(rules), 0o600); err != nil {
+		t.Fatalf("write rules: %v", err)
+	}
+	if err := os.Chtimes(file, mod, mod); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.json")
+	writeRules(t, file, `[
+		{"action": "deny", "match": "github.com/our-org/secret", "reason": "not for CI"},
+		{"name": "org", "action": "allow", "match": "github.com/our-org/*"},
+		{"action": "allow", "regex": "^github\\.com/actions/[^/]+$"},
+		{"name": "tools", "action": "allow", "regex": "github\\.com/tools/.*"},
+		{"action": "deny", "match": "*/*/*"}
+	]`, time.Now().Add(-time.Hour))
+	p, err := Load(file, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	for repo, want := range map[string]Decision{
+		"github.com/our-org/app":               {Allowed: true, Rule: "org"},
+		"github.com/our-org/secret":            {Allowed: false, Rule: "github.com/our-org/secret", Reason: "not for CI"},
+		"github.com/actions/checkout":          {Allowed: true, Rule: `^github\.com/actions/[^/]+$`},
+		"github.com/someone/app":               {Allowed: false, Rule: "*/*/*", Reason: "repository denied by policy rule */*/*"},
+		"gitlab.com/group/sub/app":             {Allowed: true, Rule: "default"},
+		"github.com/Our-Org/Secret":            {Allowed: false, Rule: "github.com/our-org/secret", Reason: "not for CI"},
+		"github.com/tools/lint":                {Allowed: true, Rule: "tools"},
+		"evil.example/x/github.com/tools/lint": {Allowed: true, Rule: "default"},
+	} {
+		if got := p.Evaluate(repo); got != want {
+			t.Errorf("%s: got %+v, want %+v", repo, got, want)
+		}
+	}
+
+	// Changes are picked up, invalid files keep the previous rules
+	writeRules(t, file, `[{"action": "deny", "match": "github.com/our-org/*"}]`, time.Now())
+	p.checkedAt = time.Time{}
+	if d := p.Evaluate("github.com/our-org/app"); d.Allowed {
+		t.Fatalf("expected reloaded rules to deny, got %+v", d)
+	}
+	writeRules(t, file, `[{"action": "maybe", "match": "*"}]`, time.Now().Add(time.Minute))
+	p.checkedAt = time.Time{}
+	if d := p.Evaluate("github.com/our-org/app"); d.Allowed {
+		t.Fatalf("expected previous rules after a bad reload, got %+v", d)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for name, rules := range map[string]string{
+		"action":     `[{"action": "block", "match": "*"}]`,
+		"no pattern": `[{"action": "deny"}]`,
+		"both":       `[{"action": "deny", "match": "*", "regex": ".*"}]`,
+		"regex":      `[{"action": "deny", "regex": "("}]`,
+		"glob":       `[{"action": "deny", "match": "["}]`,
+		"json":       `{"action": "deny"}`,
+	} {
+		file := filepath.Join(t.TempDir(), "policy.json")
+		writeRules(t, file, rules, time.Now())
+		if _, err := Load(file, slog.New(slog.NewTextHandler(io.Discard, nil))); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
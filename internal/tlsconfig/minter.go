@@ -0,0 +1,95 @@
+package tlsconfig
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// mintedValidity is how long minted certificates are valid for.
+	mintedValidity = 7 * 24 * time.Hour
+	// mintedRenewBefore is how long before expiry a cached certificate is replaced.
+	mintedRenewBefore = 24 * time.Hour
+)
+
+// Minter issues certificates for arbitrary host names, signed by a local CA,
+// to terminate TLS on intercepted CONNECT tunnels. Clients must trust the CA.
+type Minter struct {
+	ca  *x509.Certificate
+	key crypto.Signer
+	// leafKey is shared by all minted certificates, generating one per host
+	// would only slow down the first connection.
+	leafKey *ecdsa.PrivateKey
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+// NewMinter loads the CA certificate and key used to sign minted certificates.
+func NewMinter(caCertFile, caKeyFile string) (*Minter, error) {
+	pair, err := tls.LoadX509KeyPair(caCertFile, caKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load CA key pair: %w", err)
+	}
+	if pair.Leaf == nil || !pair.Leaf.IsCA {
+		return nil, fmt.Errorf("%s is not a CA certificate", caCertFile)
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("CA key can't sign certificates")
+	}
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Minter{ca: pair.Leaf, key: signer, leafKey: leafKey, certs: make(map[string]*tls.Certificate)}, nil
+}
+
+// Certificate returns a certificate for host, minting it on first use.
+func (m *Minter) Certificate(host string) (*tls.Certificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cert, ok := m.certs[host]; ok && time.Until(cert.Leaf.NotAfter) > mintedRenewBefore {
+		return cert, nil
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(mintedValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, m.ca, &m.leafKey.PublicKey, m.key)
+	if err != nil {
+		return nil, fmt.Errorf("mint certificate for %s: %w", host, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{Certificate: [][]byte{der, m.ca.Raw}, PrivateKey: m.leafKey, Leaf: leaf}
+	m.certs[host] = cert
+	return cert, nil
+}
@@ -0,0 +1,258 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// issue creates a certificate for cn signed by parent (self-signed if nil),
+// returning it with its key.
+func issue(t *testing.T, cn string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              []string{cn},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func writePair(t *testing.T, certFile, keyFile string, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	t.Helper()
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o600); err != nil {
+		t.Fatalf("write cert: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+}
+
+func TestReloaderPicksUpNewCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	first, firstKey := issue(t, "first.example.com", false, nil, nil)
+	writePair(t, certFile, keyFile, first, firstKey)
+
+	r, err := NewReloader(certFile, keyFile, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("new reloader: %v", err)
+	}
+	if cert, _ := r.GetCertificate(nil); cert.Leaf.Subject.CommonName != "first.example.com" {
+		t.Fatalf("unexpected certificate %s", cert.Leaf.Subject.CommonName)
+	}
+
+	second, secondKey := issue(t, "second.example.com", false, nil, nil)
+	writePair(t, certFile, keyFile, second, secondKey)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	r.checkedAt = time.Time{}
+	if cert, _ := r.GetCertificate(nil); cert.Leaf.Subject.CommonName != "second.example.com" {
+		t.Fatalf("certificate not reloaded, got %s", cert.Leaf.Subject.CommonName)
+	}
+
+	// A broken file keeps the previous certificate
+	os.WriteFile(certFile, []byte("garbage"), 0o600)
+	future = future.Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	r.checkedAt = time.Time{}
+	if cert, _ := r.GetCertificate(nil); cert.Leaf.Subject.CommonName != "second.example.com" {
+		t.Fatalf("expected previous certificate to be kept, got %s", cert.Leaf.Subject.CommonName)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := issue(t, "test ca", true, nil, nil)
+	serverCert, serverKey := issue(t, "127.0.0.1", false, ca, caKey)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writePair(t, certFile, keyFile, serverCert, serverKey)
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0o600)
+
+	cfg, err := New(certFile, keyFile, caFile, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := &http.Server{
+		Handler:  http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.Write([]byte("ok")) }),
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+	url := "https://" + ln.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+	}
+
+	if _, err := client().Get(url); err == nil {
+		t.Fatalf("expected request without client certificate to fail")
+	}
+
+	clientCert, clientKey := issue(t, "runner", false, ca, caKey)
+	res, err := client(tls.Certificate{Certificate: [][]byte{clientCert.Raw}, PrivateKey: clientKey}).Get(url)
+	if err != nil {
+		t.Fatalf("request with client certificate: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+}
+
+func TestUpstreamTransportTrustsCAPerHost(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := issue(t, "internal ca", true, nil, nil)
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0o600)
+
+	// Two upstreams signed by the same private CA, configured for one only
+	serve := func() string {
+		t.Helper()
+		cert, key := issue(t, "127.0.0.1", false, ca, caKey)
+		ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}},
+		})
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		srv := &http.Server{
+			Handler:  http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.Write([]byte("ok")) }),
+			ErrorLog: log.New(io.Discard, "", 0),
+		}
+		go srv.Serve(ln)
+		t.Cleanup(func() { srv.Close() })
+		return "https://" + ln.Addr().String() + "/"
+	}
+	internal, other := serve(), serve()
+
+	tr, err := UpstreamTransport(map[string]string{internal: caFile})
+	if err != nil {
+		t.Fatalf("upstream transport: %v", err)
+	}
+	client := &http.Client{Transport: tr}
+	res, err := client.Get(internal + "acme/widgets.git/info/refs")
+	if err != nil {
+		t.Fatalf("request to the configured upstream: %v", err)
+	}
+	res.Body.Close()
+	if _, err := client.Get(other + "acme/widgets.git/info/refs"); err == nil {
+		t.Fatal("expected the private CA not to be trusted for another upstream")
+	}
+
+	if _, err := UpstreamTransport(map[string]string{internal: filepath.Join(dir, "missing.pem")}); err == nil {
+		t.Fatal("expected an error for a missing CA file")
+	}
+}
+
+func TestClientCAReloaded(t *testing.T) {
+	dir := t.TempDir()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	serverCA, serverCAKey := issue(t, "server ca", true, nil, nil)
+	serverCert, serverKey := issue(t, "127.0.0.1", false, serverCA, serverCAKey)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writePair(t, certFile, keyFile, serverCert, serverKey)
+	oldCA, oldCAKey := issue(t, "old client ca", true, nil, nil)
+	newCA, newCAKey := issue(t, "new client ca", true, nil, nil)
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: oldCA.Raw}), 0o600)
+
+	certs, err := NewReloader(certFile, keyFile, logger)
+	if err != nil {
+		t.Fatalf("new reloader: %v", err)
+	}
+	clientCAs, err := NewPoolReloader(caFile, logger)
+	if err != nil {
+		t.Fatalf("new pool reloader: %v", err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig(certs, clientCAs))
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := &http.Server{
+		Handler:  http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.Write([]byte("ok")) }),
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCA)
+	get := func(ca *x509.Certificate, caKey *ecdsa.PrivateKey) (*http.Response, error) {
+		cert, key := issue(t, "runner", false, ca, caKey)
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}},
+			ForceAttemptHTTP2: true,
+		}}
+		defer client.CloseIdleConnections()
+		res, err := client.Get("https://" + ln.Addr().String())
+		if err == nil {
+			res.Body.Close()
+		}
+		return res, err
+	}
+
+	res, err := get(oldCA, oldCAKey)
+	if err != nil {
+		t.Fatalf("request with the old client CA: %v", err)
+	}
+	if res.ProtoMajor != 2 {
+		t.Fatalf("expected HTTP/2 to be negotiated, got %s", res.Proto)
+	}
+	if _, err := get(newCA, newCAKey); err == nil {
+		t.Fatal("expected a certificate from the new CA to be refused before rotation")
+	}
+
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: newCA.Raw}), 0o600)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(caFile, future, future)
+	clientCAs.checkedAt = time.Time{}
+	if _, err := get(newCA, newCAKey); err != nil {
+		t.Fatalf("request with the rotated client CA: %v", err)
+	}
+	if _, err := get(oldCA, oldCAKey); err == nil {
+		t.Fatal("expected the old client CA to be dropped after rotation")
+	}
+}
@@ -0,0 +1,61 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// UpstreamTransport returns a transport verifying the upstream under each URL
+// prefix of cas (scheme://host[:port]/) with the system roots and that CA
+// bundle only. Other upstreams are verified with the system roots, so a
+// private CA configured for one host can't vouch for another.
+func UpstreamTransport(cas map[string]string) (http.RoundTripper, error) {
+	t := &upstreamTransport{
+		base:   http.DefaultTransport.(*http.Transport).Clone(),
+		byAddr: make(map[string]*http.Transport, len(cas)),
+	}
+	for prefix, file := range cas {
+		u, err := url.Parse(prefix)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid upstream URL %q", prefix)
+		}
+		pool, err := RootCAs(file)
+		if err != nil {
+			return nil, err
+		}
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.TLSClientConfig = &tls.Config{RootCAs: pool}
+		t.byAddr[address(u)] = tr
+	}
+	return t, nil
+}
+
+// upstreamTransport sends each request through the transport trusting the
+// CA of its host and port.
+type upstreamTransport struct {
+	base   *http.Transport
+	byAddr map[string]*http.Transport
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if tr, ok := t.byAddr[address(req.URL)]; ok {
+		return tr.RoundTrip(req)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// address returns the host:port u connects to.
+func address(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}